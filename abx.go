@@ -0,0 +1,400 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/bwmarrin/dca/dcaenc"
+	"github.com/layeh/gopus"
+)
+
+const (
+	// abxWindow is the length in samples of the blocks whose spectra are
+	// compared, about 43ms at 48kHz
+	abxWindow = 2048
+
+	// abxCutoff is the highest frequency compared, as nobody hears the
+	// differences above it
+	abxCutoff = 20000.0
+
+	// abxFloor is the level in dBFS spectra are clamped to
+	abxFloor = -100.0
+
+	// abxSilence is the level in dBFS below which blocks of the original
+	// are left out as silence
+	abxSilence = -70.0
+
+	// abxLoudnessMatch is the most a version can differ in loudness from
+	// the original, in LU, before listeners tend to pick the louder one
+	abxLoudnessMatch = 0.5
+)
+
+// abxVersion is one encode listed in the report of the abx command
+type abxVersion struct {
+	Bitrate  int     `json:"bitrate"`
+	File     string  `json:"file"`
+	Bytes    int64   `json:"bytes"`
+	Loudness float64 `json:"loudness"`
+	Match    float64 `json:"loudness_diff"`
+	Spectral float64 `json:"spectral_diff"`
+}
+
+// abxReport is the report printed by the abx command
+type abxReport struct {
+	File     string        `json:"file"`
+	Loudness float64       `json:"loudness"`
+	Versions []*abxVersion `json:"versions"`
+}
+
+// abxCmd implements "dca abx" which encodes an input at several bitrates
+// and decodes each encode to a wav lined up sample for sample with the
+// original, for listening tests, reporting how far each strays from it
+func abxCmd(args []string) {
+
+	var dir, bitrates string
+	var jsonOutput bool
+
+	fs := flag.NewFlagSet("abx", flag.ExitOnError)
+	fs.StringVar(&InFile, "i", "", "infile")
+	fs.StringVar(&dir, "o", "abx", "folder to write the wav files to")
+	fs.StringVar(&bitrates, "ab", "48,64,96", "comma separated audio encoding bitrates in kb/s to compare")
+	fs.IntVar(&Channels, "ac", 2, "audio channels")
+	fs.IntVar(&FrameRate, "ar", 48000, "audio sampling rate")
+	fs.IntVar(&FrameSize, "as", 960, "audio frame size can be 960 (20ms), 1920 (40ms), or 2880 (60ms)")
+	fs.StringVar(&Application, "aa", "audio", "audio application can be voip, audio, or lowdelay")
+	fs.Var((*clockValue)(&StartTime), "ss", "time to start the excerpt at, like 1:23, 90 or 1m30s")
+	fs.Var((*clockValue)(&ClipTime), "t", "length of the excerpt, like 0:30, 30 or 30s")
+	fs.BoolVar(&jsonOutput, "json", false, "print the report as json")
+	fs.Parse(args)
+
+	if InFile == "" || isPipe(InFile) {
+		reportError(exitUsage, "error: abx requires an infile")
+		exit()
+	}
+
+	rates, err := parseBitrates(bitrates)
+	if err != nil {
+		reportError(exitUsage, "error:", err)
+		exit()
+	}
+
+	original, err := readInFile()
+	if err != nil {
+		reportError(exitFFmpeg, "error reading infile:", err)
+		exit()
+	}
+
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		reportError(exitOutput, "error:", err)
+		exit()
+	}
+
+	report := &abxReport{
+		File:     filepath.Join(dir, "original.wav"),
+		Loudness: measurePCM(original),
+	}
+
+	err = writeWav(report.File, original, FrameRate, Channels)
+	if err != nil {
+		reportError(exitOutput, "error:", err)
+		exit()
+	}
+
+	for _, rate := range rates {
+		decoded, size, err := abxEncode(original, rate)
+		if err != nil {
+			reportError(exitEncode, err)
+			exit()
+		}
+
+		version := &abxVersion{
+			Bitrate:  rate,
+			File:     filepath.Join(dir, fmt.Sprintf("%dk.wav", rate)),
+			Bytes:    size,
+			Loudness: measurePCM(decoded),
+			Spectral: roundLevel(spectralDifference(original, decoded)),
+		}
+		version.Match = roundLevel(version.Loudness - report.Loudness)
+
+		err = writeWav(version.File, decoded, FrameRate, Channels)
+		if err != nil {
+			reportError(exitOutput, "error:", err)
+			exit()
+		}
+
+		report.Versions = append(report.Versions, version)
+	}
+
+	if jsonOutput {
+		json.NewEncoder(os.Stdout).Encode(report)
+		return
+	}
+
+	fmt.Printf("%-9s %7.2f LUFS%34s%s\n", "original:", report.Loudness, "", report.File)
+
+	seconds := float64(len(original)/Channels) / float64(FrameRate)
+	mismatched := false
+	for _, v := range report.Versions {
+		fmt.Printf("%-9s %7.2f LUFS %+6.2f LU %6.2f dB %6.1f kb/s  %s\n",
+			fmt.Sprintf("%dk:", v.Bitrate), v.Loudness, v.Match, v.Spectral, float64(v.Bytes)*8/1000/seconds, v.File)
+
+		if math.Abs(v.Match) > abxLoudnessMatch {
+			mismatched = true
+		}
+	}
+
+	if mismatched {
+		fmt.Printf("note: some versions differ from the original by more than %.1f LU, level match them before listening\n", abxLoudnessMatch)
+	}
+}
+
+// parseBitrates parses a comma separated list of bitrates in kb/s
+func parseBitrates(s string) ([]int, error) {
+
+	var rates []int
+	for _, field := range strings.Split(s, ",") {
+		rate, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || rate < 1 || rate > 512 {
+			return nil, fmt.Errorf("invalid bitrate %q", field)
+		}
+		rates = append(rates, rate)
+	}
+
+	return rates, nil
+}
+
+// readInFile decodes all of InFile with ffmpeg the same way it is decoded for
+// encoding
+func readInFile() ([]int16, error) {
+
+	ffmpeg := pcmCommand(InFile)
+	stdout, err := ffmpeg.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("StdoutPipe Error: %s", err)
+	}
+
+	err = startCommand(ffmpeg)
+	if err != nil {
+		return nil, fmt.Errorf("RunStart Error: %s", err)
+	}
+
+	buf, err := ioutil.ReadAll(stdout)
+	if err != nil {
+		waitCommand(ffmpeg)
+		return nil, fmt.Errorf("error reading from ffmpeg stdout: %s", err)
+	}
+
+	err = waitCommand(ffmpeg)
+	if err != nil {
+		return nil, fmt.Errorf("ffmpeg: %s", err)
+	}
+
+	// a partial sample frame at the end is dropped
+	buf = buf[:len(buf)-len(buf)%(Channels*2)]
+
+	return pcmFrame(buf), nil
+}
+
+// abxEncode encodes pcm at bitrate kb/s with the current settings and
+// decodes it again, returning the decoded pcm without the encoder delay so
+// it lines up with the original, and the bytes of opus it took
+func abxEncode(pcm []int16, bitrate int) ([]int16, int64, error) {
+
+	Bitrate = bitrate
+	encoder, err := newEncoder()
+	if err != nil {
+		return nil, 0, fmt.Errorf("NewEncoder Error: %s", err)
+	}
+
+	decoder, err := gopus.NewDecoder(FrameRate, Channels)
+	if err != nil {
+		return nil, 0, fmt.Errorf("NewDecoder Error: %s", err)
+	}
+
+	delay := dcaenc.PreSkip(Application) * FrameRate / 48000
+	samples := len(pcm) / Channels
+
+	var decoded []int16
+	var size int64
+	frame := make([]int16, FrameSize*Channels)
+
+	// silence after the end gets the delayed samples back out
+	for n := 0; n < samples+delay; n += FrameSize {
+		for i := range frame {
+			frame[i] = 0
+		}
+		if n < samples {
+			copy(frame, pcm[n*Channels:])
+		}
+
+		opus, err := encoder.Encode(frame)
+		if err != nil {
+			return nil, 0, fmt.Errorf("Encoding Error: %s", err)
+		}
+		size += int64(len(opus))
+
+		out, err := decoder.Decode(opus, FrameSize, false)
+		if err != nil {
+			return nil, 0, fmt.Errorf("Decoding Error: %s", err)
+		}
+		decoded = append(decoded, out...)
+	}
+
+	if len(decoded) < (delay+samples)*Channels {
+		return nil, 0, fmt.Errorf("decoded %d samples of %d", len(decoded)/Channels, delay+samples)
+	}
+
+	return decoded[delay*Channels : (delay+samples)*Channels], size, nil
+}
+
+// measurePCM returns the integrated loudness of pcm
+func measurePCM(pcm []int16) float64 {
+
+	meter := newLoudnessMeter(FrameRate, Channels)
+	meter.Add(pcm)
+
+	return meter.Report().Integrated
+}
+
+// writeWav writes pcm16 of the given sample rate and channels to a wav
+// file
+func writeWav(name string, pcm []int16, rate, channels int) error {
+
+	file, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	wbuf := bufio.NewWriterSize(file, 16384)
+	wbuf.Write(wavHeader(rate, channels, "s16le", int64(len(pcm)*2)))
+
+	err = binary.Write(wbuf, binary.LittleEndian, pcm)
+	if err != nil {
+		return err
+	}
+
+	err = wbuf.Flush()
+	if err != nil {
+		return err
+	}
+
+	return file.Close()
+}
+
+// spectralDifference compares the spectra of two versions of the same
+// audio, mixed to mono, block by block, and returns how far apart they are
+// on average in dB across the audible frequencies. Blocks where the
+// original is silent are left out, as there is nothing to hear in them.
+func spectralDifference(original, encoded []int16) float64 {
+
+	window := make([]float64, abxWindow)
+	scale := 0.0
+	for i := range window {
+		window[i] = 0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(abxWindow))
+		scale += window[i]
+	}
+
+	bins := int(abxCutoff * abxWindow / float64(FrameRate))
+	if bins > abxWindow/2 {
+		bins = abxWindow / 2
+	}
+
+	a := make([]complex128, abxWindow)
+	b := make([]complex128, abxWindow)
+
+	sum, count := 0.0, 0
+	for start := 0; start+abxWindow*Channels <= len(original); start += abxWindow * Channels {
+
+		energy := 0.0
+		for i := 0; i < abxWindow; i++ {
+			x, y := 0.0, 0.0
+			for c := 0; c < Channels; c++ {
+				x += float64(original[start+i*Channels+c])
+				y += float64(encoded[start+i*Channels+c])
+			}
+			x /= 32768 * float64(Channels)
+			y /= 32768 * float64(Channels)
+
+			energy += x * x
+			a[i] = complex(x*window[i], 0)
+			b[i] = complex(y*window[i], 0)
+		}
+
+		if 10*math.Log10(energy/abxWindow) < abxSilence {
+			continue
+		}
+
+		fft(a)
+		fft(b)
+
+		for k := 1; k <= bins; k++ {
+			sum += math.Abs(binLevel(a[k], scale) - binLevel(b[k], scale))
+			count++
+		}
+	}
+
+	if count == 0 {
+		return 0
+	}
+
+	return sum / float64(count)
+}
+
+// binLevel returns the level of a frequency bin in dBFS, no lower than
+// abxFloor
+func binLevel(x complex128, scale float64) float64 {
+
+	amplitude := 2 * math.Hypot(real(x), imag(x)) / scale
+	if amplitude <= 0 {
+		return abxFloor
+	}
+
+	return math.Max(20*math.Log10(amplitude), abxFloor)
+}
+
+// fft replaces x, whose length must be a power of two, with its discrete
+// Fourier transform
+func fft(x []complex128) {
+
+	n := len(x)
+
+	// bit reversed order
+	for i, j := 1, 0; i < n; i++ {
+		bit := n >> 1
+		for ; j&bit != 0; bit >>= 1 {
+			j ^= bit
+		}
+		j ^= bit
+
+		if i < j {
+			x[i], x[j] = x[j], x[i]
+		}
+	}
+
+	for size := 2; size <= n; size <<= 1 {
+		angle := -2 * math.Pi / float64(size)
+		step := complex(math.Cos(angle), math.Sin(angle))
+
+		for start := 0; start < n; start += size {
+			w := complex(1, 0)
+			for k := 0; k < size/2; k++ {
+				even := x[start+k]
+				odd := x[start+k+size/2] * w
+				x[start+k] = even + odd
+				x[start+k+size/2] = even - odd
+				w *= step
+			}
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// gainPoint is a point of a volume envelope, a gain in dB at a time from
+// the start of the input
+type gainPoint struct {
+	Time time.Duration
+	Gain float64
+}
+
+// parseAutomation reads a volume envelope with one point per line, given
+// as a time and a gain in dB such as "1m30s -12". Times are durations or
+// plain seconds. Blank lines and lines starting with # are skipped.
+func parseAutomation(r io.Reader) ([]gainPoint, error) {
+
+	var points []gainPoint
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: expected a time and a gain in dB", line)
+		}
+
+		t, err := parseTime(fields[0])
+		if err != nil || t < 0 {
+			return nil, fmt.Errorf("line %d: invalid time %q", line, fields[0])
+		}
+
+		gain, err := strconv.ParseFloat(strings.TrimSuffix(strings.ToLower(fields[1]), "db"), 64)
+		if err != nil || math.IsInf(gain, 0) || math.IsNaN(gain) {
+			return nil, fmt.Errorf("line %d: invalid gain %q", line, fields[1])
+		}
+
+		points = append(points, gainPoint{t, gain})
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(points) == 0 {
+		return nil, fmt.Errorf("no points in automation")
+	}
+
+	sort.Stable(byTime(points))
+
+	return points, nil
+}
+
+// parseTime parses a time given as a duration or as plain seconds
+func parseTime(s string) (time.Duration, error) {
+
+	if seconds, err := strconv.ParseFloat(s, 64); err == nil {
+		return time.Duration(seconds * float64(time.Second)), nil
+	}
+
+	return time.ParseDuration(s)
+}
+
+// byTime sorts gain points by time
+type byTime []gainPoint
+
+func (p byTime) Len() int           { return len(p) }
+func (p byTime) Less(i, j int) bool { return p[i].Time < p[j].Time }
+func (p byTime) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+// gainAt returns the gain in dB at t, moving linearly from each point to
+// the next and holding the first and last gain before and after them
+func gainAt(points []gainPoint, t time.Duration) float64 {
+
+	i := sort.Search(len(points), func(i int) bool {
+		return points[i].Time > t
+	})
+
+	if i == 0 {
+		return points[0].Gain
+	}
+	if i == len(points) {
+		return points[len(points)-1].Gain
+	}
+
+	a, b := points[i-1], points[i]
+	frac := float64(t-a.Time) / float64(b.Time-a.Time)
+
+	return a.Gain + (b.Gain-a.Gain)*frac
+}
+
+// envelope returns a pcm stage that applies a volume envelope to the pcm
+// on its way to the encoder
+func envelope(points []gainPoint) pcmStage {
+
+	return func(in <-chan []int16, out chan<- []int16) error {
+
+		position := 0 // samples per channel so far
+
+		for pcm := range in {
+			for i := 0; i+Channels <= len(pcm); i += Channels {
+				t := time.Duration(position) * time.Second / time.Duration(FrameRate)
+				gain := math.Pow(10, gainAt(points, t)/20)
+
+				applyGain(pcm[i:i+Channels], gain, false)
+				position++
+			}
+
+			select {
+			case out <- pcm:
+			case <-quit:
+				return nil
+			}
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,446 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// catalogFile is the catalog dca catalog uses unless told otherwise
+const catalogFile = "dca-catalog.db"
+
+// catalogSchema creates the tables of a catalog. Files are keyed by their
+// absolute path, and hold what an index entry does with the song info and
+// opus settings flattened into columns of their own.
+var catalogSchema = []string{`
+CREATE TABLE IF NOT EXISTS files (
+	path        TEXT PRIMARY KEY,
+	size        INTEGER NOT NULL,
+	mtime       INTEGER NOT NULL,
+	duration    INTEGER NOT NULL,
+	frames      INTEGER NOT NULL,
+	checksum    TEXT NOT NULL,
+	title       TEXT NOT NULL DEFAULT '',
+	artist      TEXT NOT NULL DEFAULT '',
+	album       TEXT NOT NULL DEFAULT '',
+	genre       TEXT NOT NULL DEFAULT '',
+	comments    TEXT NOT NULL DEFAULT '',
+	bitrate     INTEGER NOT NULL DEFAULT 0,
+	sample_rate INTEGER NOT NULL DEFAULT 0,
+	application TEXT NOT NULL DEFAULT '',
+	frame_size  INTEGER NOT NULL DEFAULT 0,
+	channels    INTEGER NOT NULL DEFAULT 0,
+	fingerprint TEXT NOT NULL DEFAULT '',
+	pre_skip    INTEGER NOT NULL DEFAULT 0,
+	error       TEXT NOT NULL DEFAULT ''
+)`,
+	`CREATE INDEX IF NOT EXISTS files_checksum ON files (checksum)`,
+	`CREATE INDEX IF NOT EXISTS files_fingerprint ON files (fingerprint)`,
+	`PRAGMA user_version = 1`,
+}
+
+// catalogColumns are the columns of the files table in the order they are
+// read and written
+const catalogColumns = `path, size, mtime, duration, frames, checksum,
+	title, artist, album, genre, comments,
+	bitrate, sample_rate, application, frame_size, channels, fingerprint, pre_skip,
+	error`
+
+// Catalog is a sqlite database of DCA files from any number of folders,
+// for players that would rather query their library than scan it
+type Catalog struct {
+	db *sql.DB
+}
+
+// CatalogQuery picks the files of a catalog whose song info contains each
+// of the given strings, ignoring case. Text may be in any of the title,
+// artist, album or genre. Empty fields match everything.
+type CatalogQuery struct {
+	Text   string
+	Title  string
+	Artist string
+	Album  string
+	Genre  string
+}
+
+// OpenCatalog opens the catalog at path, creating it if it doesn't exist
+func OpenCatalog(path string) (*Catalog, error) {
+
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, stmt := range catalogSchema {
+		_, err = db.Exec(stmt)
+		if err != nil {
+			db.Close()
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+	}
+
+	return &Catalog{db: db}, nil
+}
+
+// Close closes the catalog
+func (c *Catalog) Close() error {
+	return c.db.Close()
+}
+
+// Put adds files to the catalog, replacing any already there with the
+// same path
+func (c *Catalog) Put(entries []*IndexEntry) error {
+
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	stmt, err := tx.Prepare("INSERT OR REPLACE INTO files (" + catalogColumns + ") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+
+	for _, entry := range entries {
+		info := entry.Info
+		if info == nil {
+			info = &SongMetadata{}
+		}
+		opus := entry.Opus
+		if opus == nil {
+			opus = &OpusMetadata{}
+		}
+
+		_, err = stmt.Exec(entry.Path, entry.Size, entry.ModTime, entry.Duration, entry.Frames, entry.Checksum,
+			info.Title, info.Artist, info.Album, info.Genre, info.Comments,
+			opus.Bitrate, opus.SampleRate, opus.Application, opus.FrameSize, opus.Channels, opus.Fingerprint, opus.PreSkip,
+			entry.Error)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Remove removes files from the catalog by path
+func (c *Catalog) Remove(paths []string) error {
+
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	for _, path := range paths {
+		_, err = tx.Exec("DELETE FROM files WHERE path = ?", path)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Files returns the files of the catalog below dir, or all of them if dir
+// is empty, by path
+func (c *Catalog) Files(dir string) (map[string]*IndexEntry, error) {
+
+	query := "SELECT " + catalogColumns + " FROM files"
+	var args []interface{}
+	if dir != "" {
+		prefix := strings.TrimSuffix(dir, string(filepath.Separator)) + string(filepath.Separator)
+		query += " WHERE substr(path, 1, ?) = ?"
+		args = append(args, len(prefix), prefix)
+	}
+
+	entries, err := c.query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make(map[string]*IndexEntry)
+	for _, entry := range entries {
+		files[entry.Path] = entry
+	}
+
+	return files, nil
+}
+
+// Search returns the files of the catalog matching q, by path
+func (c *Catalog) Search(q CatalogQuery) ([]*IndexEntry, error) {
+
+	var where []string
+	var args []interface{}
+
+	like := func(column, value string) {
+		if value == "" {
+			return
+		}
+		where = append(where, column+" LIKE ? ESCAPE '\\'")
+		args = append(args, "%"+escapeLike(value)+"%")
+	}
+
+	like("title", q.Title)
+	like("artist", q.Artist)
+	like("album", q.Album)
+	like("genre", q.Genre)
+	like("(title || ' ' || artist || ' ' || album || ' ' || genre)", q.Text)
+
+	query := "SELECT " + catalogColumns + " FROM files"
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY path"
+
+	return c.query(query, args...)
+}
+
+// query runs a query selecting catalogColumns and returns the files it
+// selects
+func (c *Catalog) query(query string, args ...interface{}) ([]*IndexEntry, error) {
+
+	rows, err := c.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []*IndexEntry
+	for rows.Next() {
+		entry := &IndexEntry{
+			Info: &SongMetadata{},
+			Opus: &OpusMetadata{},
+		}
+		info, opus := entry.Info, entry.Opus
+
+		err = rows.Scan(&entry.Path, &entry.Size, &entry.ModTime, &entry.Duration, &entry.Frames, &entry.Checksum,
+			&info.Title, &info.Artist, &info.Album, &info.Genre, &info.Comments,
+			&opus.Bitrate, &opus.SampleRate, &opus.Application, &opus.FrameSize, &opus.Channels, &opus.Fingerprint, &opus.PreSkip,
+			&entry.Error)
+		if err != nil {
+			return nil, err
+		}
+
+		// files that couldn't be read have neither
+		if entry.Error != "" {
+			entry.Info, entry.Opus = nil, nil
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, rows.Err()
+}
+
+// escapeLike escapes the wildcards of a LIKE pattern
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// catalogCommands are the subcommands of dca catalog
+var catalogCommands = map[string]func(args []string){
+	"add":    catalogAddCmd,
+	"list":   catalogListCmd,
+	"plan":   catalogPlanCmd,
+	"search": catalogSearchCmd,
+}
+
+// catalogCmd implements "dca catalog" which keeps a sqlite catalog of DCA
+// files that can be searched and listed
+func catalogCmd(args []string) {
+
+	if len(args) > 0 {
+		if command, ok := catalogCommands[args[0]]; ok {
+			command(args[1:])
+			return
+		}
+	}
+
+	fmt.Println("usage: dca catalog add|list|plan|search [options]")
+}
+
+// catalogAddCmd implements "dca catalog add" which adds the DCA files given,
+// and every one below the folders given, to the catalog. Files that haven't
+// changed since they were added are kept as they were, and files of those
+// folders that are gone are removed.
+func catalogAddCmd(args []string) {
+
+	var path string
+	var jobs int
+
+	fs := flag.NewFlagSet("catalog add", flag.ExitOnError)
+	fs.StringVar(&path, "db", catalogFile, "catalog to update")
+	fs.IntVar(&jobs, "jobs", runtime.NumCPU(), "number of files to scan at once")
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		reportError(exitUsage, "error: catalog add requires files or folders")
+		return
+	}
+
+	catalog, err := OpenCatalog(path)
+	if err != nil {
+		reportError(exitFailure, "error opening catalog:", err)
+		exit()
+	}
+	defer catalog.Close()
+
+	failed := false
+	for _, arg := range fs.Args() {
+		added, err := catalog.add(arg, jobs)
+		if err != nil {
+			reportError(exitInput, "error adding", arg+":", err)
+			failed = true
+			continue
+		}
+
+		for _, entry := range added {
+			if entry.Error != "" {
+				reportError(exitInput, "error adding", entry.Path+":", entry.Error)
+			}
+		}
+		fmt.Printf("added %d files from %s\n", len(added), arg)
+	}
+
+	if failed {
+		exit()
+	}
+}
+
+// add adds a DCA file, or the DCA files below a folder, to the catalog and
+// returns their entries
+func (c *Catalog) add(path string, jobs int) ([]*IndexEntry, error) {
+
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if !fi.IsDir() {
+		known, err := c.Files("")
+		if err != nil {
+			return nil, err
+		}
+
+		entries := []*IndexEntry{indexEntry(path, path, known)}
+		return entries, c.Put(entries)
+	}
+
+	known, err := c.Files(path)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := scanLibrary(path, jobs, func(file string) string { return file }, known)
+
+	err = c.Put(entries)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		delete(known, entry.Path)
+	}
+
+	var gone []string
+	for file := range known {
+		gone = append(gone, file)
+	}
+
+	return entries, c.Remove(gone)
+}
+
+// catalogListCmd implements "dca catalog list" which prints every file of
+// the catalog
+func catalogListCmd(args []string) {
+
+	var path string
+	var asJSON bool
+
+	fs := flag.NewFlagSet("catalog list", flag.ExitOnError)
+	fs.StringVar(&path, "db", catalogFile, "catalog to list")
+	fs.BoolVar(&asJSON, "json", false, "print the files as a json array")
+	fs.Parse(args)
+
+	printCatalog(path, CatalogQuery{}, asJSON)
+}
+
+// catalogSearchCmd implements "dca catalog search" which prints the files
+// of the catalog whose song info matches
+func catalogSearchCmd(args []string) {
+
+	var path string
+	var asJSON bool
+	var q CatalogQuery
+
+	fs := flag.NewFlagSet("catalog search", flag.ExitOnError)
+	fs.StringVar(&path, "db", catalogFile, "catalog to search")
+	fs.BoolVar(&asJSON, "json", false, "print the files as a json array")
+	fs.StringVar(&q.Title, "title", "", "title contains")
+	fs.StringVar(&q.Artist, "artist", "", "artist contains")
+	fs.StringVar(&q.Album, "album", "", "album contains")
+	fs.StringVar(&q.Genre, "genre", "", "genre contains")
+	fs.Parse(args)
+
+	q.Text = strings.Join(fs.Args(), " ")
+
+	printCatalog(path, q, asJSON)
+}
+
+// printCatalog prints the files of the catalog at path matching q, one
+// path, duration in milliseconds, artist and title per line or as json
+func printCatalog(path string, q CatalogQuery, asJSON bool) {
+
+	if _, err := os.Stat(path); err != nil {
+		reportError(exitInput, "error opening catalog:", err)
+		exit()
+	}
+
+	catalog, err := OpenCatalog(path)
+	if err != nil {
+		reportError(exitInput, "error opening catalog:", err)
+		exit()
+	}
+	defer catalog.Close()
+
+	entries, err := catalog.Search(q)
+	if err != nil {
+		reportError(exitInput, "error searching catalog:", err)
+		exit()
+	}
+
+	if asJSON {
+		if entries == nil {
+			entries = []*IndexEntry{}
+		}
+
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(entries)
+		return
+	}
+
+	for _, entry := range entries {
+		if entry.Info == nil {
+			fmt.Printf("%s\t%d\t\t\n", entry.Path, entry.Duration)
+			continue
+		}
+		fmt.Printf("%s\t%d\t%s\t%s\n", entry.Path, entry.Duration, entry.Info.Artist, entry.Info.Title)
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bwmarrin/dca/dcaenc"
+)
+
+// clipName returns the name a clip of a sprite is looked up by, its file
+// name without the extension
+func clipName(track string) string {
+
+	name := filepath.Base(track)
+
+	return strings.TrimSuffix(name, filepath.Ext(name))
+}
+
+// clipCmd implements "dca clip" which copies one named clip out of a
+// sprite made with -sprite, seeking straight to its frames
+func clipCmd(args []string) {
+
+	var name string
+	var list bool
+
+	fs := flag.NewFlagSet("clip", flag.ExitOnError)
+	fs.StringVar(&InFile, "i", "pipe:0", "sprite infile")
+	fs.StringVar(&OutFile, "o", "pipe:1", "outfile")
+	fs.StringVar(&name, "name", "", "name of the clip to copy")
+	fs.BoolVar(&list, "list", false, "list the clips with their first frame and frame count")
+	fs.BoolVar(&RawOutput, "raw", false, "Raw opus output (no metadata or magic bytes)")
+	fs.Parse(args)
+
+	if name == "" && !list {
+		reportError(exitUsage, "error: -name or -list is required")
+		return
+	}
+
+	input, err := openInFile()
+	if err != nil {
+		reportError(exitInput, "error opening infile:", err)
+		return
+	}
+	defer input.Close()
+
+	// files are read straight from memory when they can be mapped
+	in := io.Reader(input)
+	if data, err := mapFile(input); err == nil {
+		defer unmapFile(data)
+		in = bytes.NewReader(data)
+	}
+
+	decoder := dcaenc.NewDecoder(in)
+
+	metadata, err := decoder.Metadata()
+	if err != nil {
+		reportError(exitInput, "error reading header:", err)
+		return
+	}
+
+	if list {
+		for _, track := range metadata.Tracks {
+			if track.Name != "" {
+				fmt.Println(track.Name, track.Offset, track.Frames)
+			}
+		}
+		return
+	}
+
+	first, count, err := decoder.Clip(name)
+	if err != nil {
+		reportError(exitUsage, "error:", err)
+		exit()
+	}
+
+	if OutFile != "pipe:1" {
+		Output, err = os.Create(OutFile)
+		if err != nil {
+			reportError(exitOutput, "error opening outfile:", err)
+			return
+		}
+		defer Output.Close()
+	}
+
+	// files seek straight to the clip, pipes are read through to it
+	seekable := false
+	switch in := in.(type) {
+	case *bytes.Reader:
+		seekable = true
+	case *os.File:
+		fi, err := in.Stat()
+		seekable = err == nil && fi.Mode().IsRegular()
+	}
+
+	if seekable {
+		err = decoder.SeekFrame(first)
+	} else {
+		for i := 0; i < first && err == nil; i++ {
+			_, err = decoder.OpusFrame()
+		}
+	}
+	if err != nil {
+		reportError(exitInput, "error seeking to clip:", err)
+		exit()
+	}
+
+	wbuf := bufio.NewWriterSize(Output, 16384)
+
+	if RawOutput == false {
+		// the clip keeps the parity of the sprite
+		Parity = parityGroup(metadata)
+
+		Metadata = *metadata
+		for _, track := range metadata.Tracks {
+			if track.Name == name {
+				Metadata.SongInfo = track.Info
+			}
+		}
+		Metadata.Tracks = nil
+		Metadata.Extra = &ExtraMetadata{}
+
+		err = writeHeader(wbuf, false)
+		if err != nil {
+			reportError(exitOutput, "error writing output:", err)
+			exit()
+		}
+	}
+
+	out := newFrameWriter(wbuf)
+
+	for i := 0; i < count; i++ {
+		opus, err := decoder.OpusFrame()
+		if err != nil {
+			reportError(exitInput, "error reading input:", err)
+			exit()
+		}
+
+		err = out.WriteFrame(opus)
+		if err != nil {
+			reportError(exitOutput, "error writing output:", err)
+			exit()
+		}
+	}
+
+	err = out.Flush()
+	if err == nil {
+		err = wbuf.Flush()
+	}
+	if err != nil {
+		reportError(exitOutput, "error writing output:", err)
+		exit()
+	}
+}
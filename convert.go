@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// showConversion prints the audio format of each input and the steps
+// taking it to the pcm16 dca encodes, for -show-conversion, so a file that
+// sounds wrong can be traced to how it was converted
+func showConversion() {
+
+	inputs := Inputs
+	if AlbumMode {
+		inputs = Tracks
+	}
+	if len(inputs) == 0 {
+		inputs = []string{InFile}
+	}
+
+	output := fmt.Sprintf("s16 %d Hz %s", FrameRate, layoutName(Channels, ""))
+
+	for _, input := range inputs {
+		var source string
+		var steps []string
+
+		switch {
+		case OpusInput:
+			source = "opus 48000 Hz stereo"
+			steps = []string{"stored as is"}
+
+		case Signal != nil:
+			source = "generated " + input
+			steps = []string{"generated at the output format"}
+
+		case NoFFmpeg:
+			format := fmt.Sprintf("s%d", WavIn.bits)
+			if WavIn.float {
+				format = "flt"
+			}
+
+			// -no-ffmpeg converts in dca, in the same steps
+			source = fmt.Sprintf("%s %d Hz %s, without ffmpeg", WavIn.encoding, WavIn.rate, layoutName(WavIn.channels, ""))
+			steps = trimSteps()
+			steps = append(steps, conversionSteps(format, WavIn.rate, WavIn.channels, "")...)
+			steps = append(steps, volumeSteps()...)
+
+		case isPipe(input):
+			source = "pcm16 from " + inputSource(input)
+			steps = append(trimSteps(), "read as is, assumed to be "+output)
+
+		default:
+			data := FFprobeData
+			if data == nil || input != InFile {
+				var err error
+				data, err = probe(input)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "%s: can't probe: %s\n", input, err)
+					continue
+				}
+			}
+
+			if len(data.Streams) == 0 {
+				fmt.Fprintf(os.Stderr, "%s: no audio stream\n", input)
+				continue
+			}
+
+			stream := data.Streams[0]
+			rate, _ := strconv.Atoi(stream.SampleRate)
+
+			source = fmt.Sprintf("stream %d, %s %s %d Hz %s", stream.Index, stream.CodecName, stream.SampleFmt, rate, layoutName(stream.Channels, stream.ChannelLayout))
+			steps = trimSteps()
+			steps = append(steps, "decode "+stream.CodecName)
+			steps = append(steps, conversionSteps(stream.SampleFmt, rate, stream.Channels, stream.ChannelLayout)...)
+			steps = append(steps, volumeSteps()...)
+		}
+
+		fmt.Fprintf(os.Stderr, "%s: %s -> %s\n", input, source, output)
+		for _, step := range steps {
+			fmt.Fprintf(os.Stderr, "  %s\n", step)
+		}
+	}
+}
+
+// conversionSteps returns how audio of a sample format, rate and channels
+// is converted to the output format
+func conversionSteps(format string, rate, channels int, layout string) []string {
+
+	var steps []string
+
+	if channels > 0 && channels != Channels {
+		verb := "downmix"
+		if channels < Channels {
+			verb = "upmix"
+		}
+		steps = append(steps, fmt.Sprintf("%s %s to %s", verb, layoutName(channels, layout), layoutName(Channels, "")))
+	}
+
+	if rate > 0 && rate != FrameRate {
+		steps = append(steps, fmt.Sprintf("resample %d Hz to %d Hz", rate, FrameRate))
+	}
+
+	// planar formats only change layout on the way to s16
+	format = strings.TrimSuffix(format, "p")
+	if format != "" && format != "s16" {
+		steps = append(steps, fmt.Sprintf("convert %s samples to s16", format))
+	}
+
+	return steps
+}
+
+// trimSteps returns the steps cutting the input to -ss and -t
+func trimSteps() []string {
+
+	var steps []string
+	if StartTime > 0 {
+		steps = append(steps, "seek to "+StartTime.String())
+	}
+	if ClipTime > 0 {
+		steps = append(steps, "stop after "+ClipTime.String())
+	}
+
+	return steps
+}
+
+// volumeSteps returns the step applying -vol, if it changes anything. Pcm
+// read as is doesn't go through it.
+func volumeSteps() []string {
+
+	if Volume == 256 {
+		return nil
+	}
+
+	return []string{fmt.Sprintf("volume %d/256", Volume)}
+}
+
+// layoutName names a channel layout, falling back on the channel count
+func layoutName(channels int, layout string) string {
+
+	if layout != "" {
+		return layout
+	}
+
+	switch channels {
+	case 1:
+		return "mono"
+	case 2:
+		return "stereo"
+	}
+
+	return fmt.Sprintf("%d channels", channels)
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/dca/dcaenc"
+)
+
+// parseClock parses a time given as [[h:]m:]s such as 1:30 or 1:02:03.5,
+// or like parseTime as a duration or plain seconds
+func parseClock(s string) (time.Duration, error) {
+
+	if !strings.Contains(s, ":") {
+		return parseTime(s)
+	}
+
+	parts := strings.Split(s, ":")
+	if len(parts) > 3 {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+
+	seconds := 0.0
+	for i, part := range parts {
+		n, err := strconv.ParseFloat(part, 64)
+		if err != nil || n < 0 || (i > 0 && n >= 60) {
+			return 0, fmt.Errorf("invalid time %q", s)
+		}
+		seconds = seconds*60 + n
+	}
+
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// clockValue is a flag.Value for a time given as parseClock takes it
+type clockValue time.Duration
+
+// String implements flag.Value
+func (c *clockValue) String() string {
+	return time.Duration(*c).String()
+}
+
+// Set implements flag.Value
+func (c *clockValue) Set(value string) error {
+
+	t, err := parseClock(value)
+	if err != nil {
+		return err
+	}
+
+	*c = clockValue(t)
+	return nil
+}
+
+// cutCmd implements "dca cut" which copies the frames of a DCA file between
+// two times into a new file, without re-encoding them
+func cutCmd(args []string) {
+
+	var from, to string
+
+	fs := flag.NewFlagSet("cut", flag.ExitOnError)
+	fs.StringVar(&InFile, "i", "pipe:0", "infile")
+	fs.StringVar(&OutFile, "o", "pipe:1", "outfile")
+	fs.StringVar(&from, "from", "0", "time to cut from, like 1:00, 90 or 1m30s")
+	fs.StringVar(&to, "to", "", "time to cut to, the end of the input if not set")
+	fs.Parse(args)
+
+	start, err := parseClock(from)
+	if err != nil {
+		reportError(exitUsage, "error: -from:", err)
+		return
+	}
+
+	end := time.Duration(-1)
+	if to != "" {
+		end, err = parseClock(to)
+		if err != nil {
+			reportError(exitUsage, "error: -to:", err)
+			return
+		}
+
+		if end <= start {
+			reportError(exitUsage, "error: -to must be after -from")
+			return
+		}
+	}
+
+	input, err := openInFile()
+	if err != nil {
+		reportError(exitInput, "error opening infile:", err)
+		return
+	}
+	defer input.Close()
+
+	// files are read straight from memory when they can be mapped
+	in := io.Reader(input)
+	if data, err := mapFile(input); err == nil {
+		defer unmapFile(data)
+		in = bytes.NewReader(data)
+	}
+
+	rbuf := bufio.NewReaderSize(in, 16384)
+
+	metadata, err := dcaenc.ReadHeader(rbuf)
+	if err != nil {
+		reportError(exitInput, "error reading header:", err)
+		return
+	}
+
+	if metadata.Opus == nil || metadata.Opus.FrameSize <= 0 || metadata.Opus.SampleRate <= 0 {
+		reportError(exitInput, "error: no opus metadata")
+		return
+	}
+
+	if len(metadata.Streams) > 0 {
+		reportError(exitUsage, "error: multitrack files must be split with dca demux first")
+		return
+	}
+
+	// times past a seam would have to skip the padding at it
+	if metadata.Extra != nil && len(metadata.Extra.Seams) > 0 {
+		reportError(exitUsage, "error: files appended to with -append can't be cut, decode them instead")
+		return
+	}
+
+	cut := planCut(metadata, start, end)
+	if cut.frames == 0 {
+		reportError(exitUsage, "error: -from is past the end of the input")
+		return
+	}
+
+	if OutFile != "pipe:1" {
+		Output, err = os.Create(OutFile)
+		if err != nil {
+			reportError(exitOutput, "error opening outfile:", err)
+			return
+		}
+		defer Output.Close()
+
+		if fi, err := Output.Stat(); err == nil && fi.Mode().IsRegular() {
+			Seekable = true
+		}
+	}
+
+	frames := dcaenc.NewFrameReader(rbuf, metadata)
+
+	err = skipFrames(in, rbuf, frames, seekIndex(metadata), cut.first)
+	if err != nil {
+		reportError(exitInput, "error seeking to -from:", err)
+		exit()
+	}
+
+	Metadata = *metadata
+	Metadata.Tracks = nil
+	Metadata.Extra = &ExtraMetadata{
+		Samples:  cut.samples,
+		Duration: cut.samples * 1000 / metadata.Opus.SampleRate,
+	}
+	if cut.frames > 0 {
+		Metadata.Extra.Frames = cut.frames
+	}
+
+	// an indexed file is cut to an indexed file
+	if metadata.Extra != nil && metadata.Extra.Index != nil {
+		Metadata.Extra.Index = &SeekIndex{Interval: metadata.Extra.Index.Interval}
+	}
+
+	// splice points only line up in the cut if it starts on one
+	if Metadata.Opus.SpliceInterval > 0 && cut.first%Metadata.Opus.SpliceInterval != 0 {
+		opus := *Metadata.Opus
+		opus.SpliceInterval = 0
+		Metadata.Opus = &opus
+	}
+
+	// the cut keeps the parity of the file it came from
+	Parity = parityGroup(metadata)
+
+	wbuf := bufio.NewWriterSize(Output, 16384)
+
+	err = writeHeader(wbuf, Seekable)
+	if err != nil {
+		reportError(exitOutput, "error writing output:", err)
+		exit()
+	}
+
+	out := newFrameWriter(wbuf)
+
+	written := 0
+	for cut.frames < 0 || written < cut.frames {
+		opus, err := frames.ReadFrame()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			reportError(exitInput, "error reading input:", err)
+			exit()
+		}
+
+		err = out.WriteFrame(opus)
+		if err != nil {
+			reportError(exitOutput, "error writing output:", err)
+			exit()
+		}
+		written++
+	}
+
+	err = out.Flush()
+	if err == nil {
+		err = wbuf.Flush()
+	}
+	if err != nil {
+		reportError(exitOutput, "error writing output:", err)
+		exit()
+	}
+
+	if Seekable {
+		// whatever follows the cut is padding to be trimmed on decode
+		EndPadding = written * metadata.Opus.FrameSize
+		if cut.samples > 0 && cut.samples < EndPadding {
+			EndPadding -= cut.samples
+		} else {
+			EndPadding = 0
+		}
+
+		err = patchHeader(Output)
+		if err != nil {
+			reportError(exitOutput, "error updating header:", err)
+		}
+	}
+}
+
+// cutRange is the frames of a file a cut copies, and the samples per
+// channel of audio they hold after the encoder delay is trimmed
+type cutRange struct {
+	first   int
+	frames  int // -1 for up to the end
+	samples int // 0 when unknown
+}
+
+// planCut returns the frames to copy for a cut from start to end, or to
+// the end of the file when end is negative. Both times are rounded to the
+// nearest frame, and the encoder delay is kept so that the new file trims
+// it the same way as the old one.
+func planCut(metadata *MetadataStruct, start, end time.Duration) cutRange {
+
+	rate := metadata.Opus.SampleRate
+	size := metadata.Opus.FrameSize
+	delay := metadata.Opus.PreSkip * rate / 48000
+
+	// samples per channel of the audio, and the frames holding it
+	total := 0
+	frames := -1
+	if metadata.Extra != nil {
+		total = metadata.Extra.Samples
+		if metadata.Extra.Frames > 0 {
+			frames = metadata.Extra.Frames
+		}
+	}
+
+	nearest := func(t time.Duration) int {
+		return int((t.Seconds()*float64(rate) + float64(size)/2) / float64(size))
+	}
+
+	cut := cutRange{first: nearest(start), frames: -1}
+
+	// the samples after the end of the audio are padding
+	samples := -1
+	if end >= 0 {
+		samples = (nearest(end) - cut.first) * size
+	}
+	if total > 0 && (samples < 0 || cut.first*size+samples > total) {
+		samples = total - cut.first*size
+	}
+
+	if samples > 0 {
+		cut.samples = samples
+		cut.frames = (delay + samples + size - 1) / size
+	}
+
+	if frames >= 0 {
+		left := frames - cut.first
+		if left < 0 {
+			left = 0
+		}
+		if cut.frames < 0 || cut.frames > left {
+			cut.frames = left
+		}
+	}
+
+	return cut
+}
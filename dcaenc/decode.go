@@ -0,0 +1,173 @@
+package dcaenc
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// Decoder reads the opus frames of a DCA stream, such as a file written by
+// the dca tool, for sending to Discord as they are
+type Decoder struct {
+	src      *countingReader
+	r        *bufio.Reader
+	metadata *Metadata
+	frames   *FrameReader
+	err      error
+
+	// where the frames start in the stream
+	header int64
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+// Read implements io.Reader
+func (c *countingReader) Read(p []byte) (int, error) {
+
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// NewDecoder returns a Decoder reading a DCA stream from r. Streams read
+// from an io.Seeker, such as a file, can be seeked with Seek and SeekFrame.
+func NewDecoder(r io.Reader) *Decoder {
+
+	src := &countingReader{r: r}
+	return &Decoder{src: src, r: bufio.NewReaderSize(src, 16384)}
+}
+
+// Metadata reads the header of the stream if it hasn't been already, and
+// returns its metadata
+func (d *Decoder) Metadata() (*Metadata, error) {
+
+	if d.metadata != nil || d.err != nil {
+		return d.metadata, d.err
+	}
+
+	d.metadata, d.err = ReadHeader(d.r)
+	if d.err != nil {
+		return nil, d.err
+	}
+
+	// frames of a multitrack file are preceded by their stream index, and
+	// are interleaved so can't be played as they are
+	if len(d.metadata.Streams) > 0 {
+		d.err = fmt.Errorf("multitrack files can't be decoded, demux them with dca demux first")
+		return d.metadata, d.err
+	}
+
+	d.header = d.src.n - int64(d.r.Buffered())
+	d.frames = NewFrameReader(d.r, d.metadata)
+	return d.metadata, nil
+}
+
+// SeekFrame moves to a frame of the stream, so that OpusFrame returns it
+// next. Files with a seek index jump to the entry before the frame and
+// read on from there, others read every frame from the start of the file.
+func (d *Decoder) SeekFrame(frame int) error {
+
+	_, err := d.Metadata()
+	if err != nil {
+		return err
+	}
+
+	seeker, ok := d.src.r.(io.Seeker)
+	if !ok {
+		return fmt.Errorf("stream can't be seeked")
+	}
+
+	if frame < 0 {
+		return fmt.Errorf("invalid frame %d", frame)
+	}
+
+	start, offset := 0, int64(0)
+	if d.metadata.Extra != nil && d.metadata.Extra.Index != nil {
+		start, offset = d.metadata.Extra.Index.Lookup(frame)
+	}
+
+	_, err = seeker.Seek(d.header+offset, os.SEEK_SET)
+	if err != nil {
+		return err
+	}
+	d.r.Reset(d.src)
+	d.frames = NewFrameReader(d.r, d.metadata)
+
+	for i := start; i < frame; i++ {
+		_, err = d.frames.ReadFrame()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return fmt.Errorf("stream only has %d frames", i)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Seek moves to the frame a time of the audio falls in, counted from the
+// start of the audio after the encoder delay
+func (d *Decoder) Seek(t time.Duration) error {
+
+	metadata, err := d.Metadata()
+	if err != nil {
+		return err
+	}
+
+	opus := metadata.Opus
+	if opus == nil || opus.SampleRate <= 0 || opus.FrameSize <= 0 {
+		return fmt.Errorf("stream has no opus metadata to seek by time with")
+	}
+
+	sample := opus.PreSkip*opus.SampleRate/48000 + int(t.Seconds()*float64(opus.SampleRate))
+
+	return d.SeekFrame(sample / opus.FrameSize)
+}
+
+// Clip returns the first frame and the number of frames of the clip of a
+// sprite with the given name, for SeekFrame to move to
+func (d *Decoder) Clip(name string) (first, frames int, err error) {
+
+	metadata, err := d.Metadata()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	for _, track := range metadata.Tracks {
+		if track.Name == name {
+			return track.Offset, track.Frames, nil
+		}
+	}
+
+	if len(metadata.Tracks) == 0 || metadata.Tracks[0].Name == "" {
+		return 0, 0, fmt.Errorf("stream is not a sprite")
+	}
+
+	return 0, 0, fmt.Errorf("no clip is named %q", name)
+}
+
+// OpusFrame returns the next opus frame, with repeat markers expanded and
+// damaged frames rebuilt from parity where they can be. It returns io.EOF
+// at the end of the stream.
+func (d *Decoder) OpusFrame() ([]byte, error) {
+
+	_, err := d.Metadata()
+	if err != nil {
+		return nil, err
+	}
+
+	opus, err := d.frames.ReadFrame()
+	if err == io.ErrUnexpectedEOF {
+		// a file cut short ends with whatever frames were complete
+		return nil, io.EOF
+	}
+
+	return opus, err
+}
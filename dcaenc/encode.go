@@ -0,0 +1,571 @@
+package dcaenc
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/layeh/gopus"
+)
+
+// Options are the settings audio is encoded with, as the flags of the same
+// names are for the dca tool
+type Options struct {
+	Volume      int    // change audio volume (256=normal)
+	Channels    int    // 1 for mono, 2 for stereo
+	FrameRate   int    // one of 8000, 12000, 16000, 24000 or 48000
+	FrameSize   int    // 960 (20ms), 1920 (40ms) or 2880 (60ms)
+	Bitrate     int    // kb/s, 8 to 512
+	Application string // voip, audio or lowdelay
+
+	// BufferedFrames is how many frames are encoded ahead of the reader
+	BufferedFrames int
+
+	// SpliceInterval resets the opus encoder every this many frames, so
+	// the stream can be cut at those frames without artifacts. 0 only
+	// resets it when Splice is called.
+	SpliceInterval int
+
+	// Deterministic sets every encoder setting that would otherwise be
+	// left to the libopus defaults, which can change between versions
+	Deterministic bool
+
+	// FFmpeg is the ffmpeg executable to decode the input with, found in
+	// PATH if empty
+	FFmpeg string
+}
+
+// StdOptions are the defaults of the dca tool, which suit Discord
+var StdOptions = &Options{
+	Volume:         256,
+	Channels:       2,
+	FrameRate:      48000,
+	FrameSize:      960,
+	Bitrate:        64,
+	Application:    "audio",
+	BufferedFrames: 100,
+}
+
+// check returns an error for settings opus can't encode with
+func (o *Options) check() error {
+
+	switch o.FrameRate {
+	case 8000, 12000, 16000, 24000, 48000:
+	default:
+		return fmt.Errorf("invalid frame rate %d", o.FrameRate)
+	}
+
+	if o.Channels != 1 && o.Channels != 2 {
+		return fmt.Errorf("invalid channels %d", o.Channels)
+	}
+
+	if o.FrameSize <= 0 {
+		return fmt.Errorf("invalid frame size %d", o.FrameSize)
+	}
+
+	if o.SpliceInterval < 0 {
+		return fmt.Errorf("invalid splice interval %d", o.SpliceInterval)
+	}
+
+	if o.Bitrate < 1 || o.Bitrate > 512 {
+		return fmt.Errorf("invalid bitrate %d", o.Bitrate)
+	}
+
+	switch o.Application {
+	case "voip", "audio", "lowdelay":
+	default:
+		return fmt.Errorf("invalid application %q", o.Application)
+	}
+
+	return nil
+}
+
+// FrameEncoder encodes pcm to opus a frame at a time, resetting the
+// encoder at splice points. Encoder runs the audio of its input through
+// one, and programs with pcm of their own can use one directly. It is not
+// safe for concurrent use.
+type FrameEncoder struct {
+	opts     Options
+	opus     *gopus.Encoder
+	maxBytes int
+
+	// frames encoded so far, whether Splice was called since the last of
+	// them, and the frames the encoder was reset at
+	frames  int
+	splice  bool
+	splices []int
+}
+
+// NewFrameEncoder returns a FrameEncoder for the opus settings of opts, or
+// StdOptions if opts is nil. Frames of FrameSize samples per channel are
+// encoded with them.
+func NewFrameEncoder(opts *Options) (*FrameEncoder, error) {
+
+	if opts == nil {
+		opts = StdOptions
+	}
+
+	opus, err := gopus.NewEncoder(opts.FrameRate, opts.Channels, gopus.Audio)
+	if err != nil {
+		return nil, err
+	}
+
+	opus.SetBitrate(opts.Bitrate * 1000)
+
+	switch opts.Application {
+	case "voip":
+		opus.SetApplication(gopus.Voip)
+	case "lowdelay":
+		opus.SetApplication(gopus.RestrictedLowDelay)
+	default:
+		opus.SetApplication(gopus.Audio)
+	}
+
+	if opts.Deterministic {
+		opus.SetVbr(true)
+	}
+
+	return &FrameEncoder{
+		opts:     *opts,
+		opus:     opus,
+		maxBytes: opts.FrameSize * opts.Channels * 2,
+	}, nil
+}
+
+// Encode encodes a frame of pcm, resetting the encoder first if the frame
+// is a splice point
+func (f *FrameEncoder) Encode(pcm []int16) ([]byte, error) {
+
+	interval := f.opts.SpliceInterval
+	if f.frames > 0 && (f.splice || interval > 0 && f.frames%interval == 0) {
+		f.opus.ResetState()
+		f.splices = append(f.splices, f.frames)
+	}
+	f.splice = false
+	f.frames++
+
+	return f.opus.Encode(pcm, f.opts.FrameSize, f.maxBytes)
+}
+
+// Flush encodes enough silence after the end of the input to get the
+// encoder delay back out of the encoder, as the last samples of the input
+// would be lost otherwise. padding is the silence the last frame was
+// already padded with, in samples per channel. It returns the frames of
+// silence and the padding of the stream with them, to be trimmed on
+// decode.
+func (f *FrameEncoder) Flush(padding int) ([][]byte, int, error) {
+
+	pcm := make([]int16, f.opts.FrameSize*f.opts.Channels)
+	delay := PreSkip(f.opts.Application) * f.opts.FrameRate / 48000
+
+	var flush [][]byte
+	for ; padding < delay; padding += f.opts.FrameSize {
+		opus, err := f.Encode(pcm)
+		if err != nil {
+			return flush, padding, err
+		}
+		flush = append(flush, opus)
+	}
+
+	return flush, padding, nil
+}
+
+// Splice resets the encoder before the next frame it encodes, so nothing
+// before that frame carries over into it
+func (f *FrameEncoder) Splice() {
+	f.splice = true
+}
+
+// SplicePoints returns the frames the encoder has been reset at so far
+func (f *FrameEncoder) SplicePoints() []int {
+	return append([]int(nil), f.splices...)
+}
+
+// SetBitrate changes the bitrate of the frames encoded from now on, in
+// bits per second
+func (f *FrameEncoder) SetBitrate(bitrate int) {
+	f.opus.SetBitrate(bitrate)
+}
+
+// Encoder encodes the audio of an input to opus as it is read. Either read
+// it as a DCA stream, header and all, through Read, or take the opus
+// frames one at a time from OpusFrame, but not both.
+type Encoder struct {
+	opts     Options
+	metadata *Metadata
+
+	cmd    *exec.Cmd
+	stderr *bytes.Buffer
+	opus   *FrameEncoder
+
+	frames chan []byte
+	err    error
+
+	// what Read has left to return of the header and the last frame
+	buf    bytes.Buffer
+	header bool
+
+	// closed on Resume while paused, nil otherwise. lock also guards opus,
+	// which Splice and SplicePoints reach into while it encodes.
+	lock   sync.Mutex
+	paused chan struct{}
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+// NewEncoder starts encoding input, a file or url ffmpeg can read, with
+// opts, or StdOptions if opts is nil
+func NewEncoder(input string, opts *Options) (*Encoder, error) {
+	return startEncoder(input, nil, opts)
+}
+
+// EncodeReader starts encoding the audio read from r, in any format ffmpeg
+// can tell from its contents, with opts, or StdOptions if opts is nil
+func EncodeReader(r io.Reader, opts *Options) (*Encoder, error) {
+	return startEncoder("pipe:0", r, opts)
+}
+
+// startEncoder starts ffmpeg decoding input to pcm for the encoder, with
+// stdin as its standard input
+func startEncoder(input string, stdin io.Reader, opts *Options) (*Encoder, error) {
+
+	if opts == nil {
+		opts = StdOptions
+	}
+
+	err := opts.check()
+	if err != nil {
+		return nil, err
+	}
+
+	e := &Encoder{
+		opts:   *opts,
+		stderr: &bytes.Buffer{},
+		frames: make(chan []byte, opts.BufferedFrames),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+
+	e.opus, err = NewFrameEncoder(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	ffmpeg := opts.FFmpeg
+	if ffmpeg == "" {
+		ffmpeg = "ffmpeg"
+	}
+
+	e.cmd = exec.Command(ffmpeg, "-loglevel", "error", "-i", input, "-vol", strconv.Itoa(opts.Volume), "-f", "s16le", "-ar", strconv.Itoa(opts.FrameRate), "-ac", strconv.Itoa(opts.Channels), "pipe:1")
+	e.cmd.Stdin = stdin
+	e.cmd.Stderr = e.stderr
+
+	stdout, err := e.cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	err = e.cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+
+	source := "file"
+	if stdin != nil {
+		source = "pipe"
+	}
+
+	e.metadata = &Metadata{
+		Dca: &DCAMetadata{
+			Version: FormatVersion,
+			Tool: &ToolMetadata{
+				Name:   "dcaenc",
+				Url:    "https://github.com/bwmarrin/dca",
+				Author: "bwmarrin",
+			},
+		},
+		SongInfo: &SongMetadata{},
+		Origin: &OriginMetadata{
+			Source:   source,
+			Channels: opts.Channels,
+			Encoding: "pcm16/s16le",
+		},
+		Opus: &OpusMetadata{
+			Bitrate:     opts.Bitrate * 1000,
+			SampleRate:  opts.FrameRate,
+			Application: opts.Application,
+			FrameSize:   opts.FrameSize,
+			Channels:    opts.Channels,
+			PreSkip:     PreSkip(opts.Application),
+
+			SpliceInterval: opts.SpliceInterval,
+		},
+		Extra: &ExtraMetadata{},
+	}
+	e.metadata.Opus.Fingerprint = Fingerprint(e.metadata.Opus, opts.Volume)
+
+	go e.run(stdout)
+
+	return e, nil
+}
+
+// run encodes the pcm ffmpeg writes to stdout, until it ends or the
+// encoder is closed
+func (e *Encoder) run(stdout io.ReadCloser) {
+
+	defer close(e.done)
+	defer close(e.frames)
+
+	// anything ffmpeg started that still has the pipe open is stopped by
+	// closing it
+	err := e.encode(bufio.NewReaderSize(stdout, 16384))
+	if err != nil {
+		e.cmd.Process.Kill()
+		stdout.Close()
+	}
+
+	// ffmpeg is killed when closed early, which isn't worth reporting
+	waitErr := e.cmd.Wait()
+	select {
+	case <-e.stop:
+		return
+	default:
+	}
+
+	if err == nil && waitErr != nil {
+		err = fmt.Errorf("ffmpeg: %s", waitErr)
+		if msg := strings.TrimSpace(e.stderr.String()); msg != "" {
+			err = fmt.Errorf("ffmpeg: %s", msg)
+		}
+	}
+	e.err = err
+}
+
+// encode encodes every frame of pcm read from r, then enough silence to
+// get the encoder delay back out of the encoder
+func (e *Encoder) encode(r io.Reader) error {
+
+	samples := e.opts.FrameSize * e.opts.Channels
+
+	buf := make([]byte, samples*2)
+	pcm := make([]int16, samples)
+
+	frames := 0
+	padding := 0
+	for padding == 0 {
+		err := e.waitPaused()
+		if err != nil {
+			return err
+		}
+
+		n, err := io.ReadFull(r, buf)
+		if err == io.EOF {
+			break
+		}
+		if err == io.ErrUnexpectedEOF {
+			// the last frame is padded with silence
+			for i := n; i < len(buf); i++ {
+				buf[i] = 0
+			}
+			padding = (len(buf) - n) / (e.opts.Channels * 2)
+		} else if err != nil {
+			return err
+		}
+
+		for i := range pcm {
+			pcm[i] = int16(binary.LittleEndian.Uint16(buf[i*2:]))
+		}
+
+		opus, err := e.encodeFrame(pcm)
+		if err != nil {
+			return err
+		}
+
+		err = e.send(opus)
+		if err != nil {
+			return err
+		}
+		frames++
+	}
+
+	if frames == 0 {
+		return nil
+	}
+
+	e.lock.Lock()
+	flush, _, err := e.opus.Flush(padding)
+	e.lock.Unlock()
+
+	for _, opus := range flush {
+		err := e.send(opus)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err != nil {
+		return fmt.Errorf("Encoding Error: %s", err)
+	}
+
+	return nil
+}
+
+// waitPaused waits for the encoder to be resumed if it is paused
+func (e *Encoder) waitPaused() error {
+
+	e.lock.Lock()
+	paused := e.paused
+	e.lock.Unlock()
+
+	if paused == nil {
+		return nil
+	}
+
+	select {
+	case <-paused:
+		return nil
+	case <-e.stop:
+		return io.EOF
+	}
+}
+
+// Pause stops reading the input until Resume is called. ffmpeg is left
+// waiting to write, so a download it is reading slows to a stop too.
+// Frames already encoded can still be read.
+func (e *Encoder) Pause() {
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if e.paused == nil {
+		e.paused = make(chan struct{})
+	}
+}
+
+// Resume carries on encoding after Pause
+func (e *Encoder) Resume() {
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if e.paused != nil {
+		close(e.paused)
+		e.paused = nil
+	}
+}
+
+// Splice resets the opus encoder before the next frame it encodes, so the
+// stream can be cut there without artifacts, such as where one track ends
+// and the next begins in a continuous input. Up to BufferedFrames frames
+// may already be encoded ahead of the reader, so SplicePoints tells where
+// the reset happened. A reset drops the few milliseconds of audio the
+// encoder was holding back.
+func (e *Encoder) Splice() {
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	e.opus.Splice()
+}
+
+// SplicePoints returns the frames the encoder has been reset at so far,
+// by Splice or SpliceInterval
+func (e *Encoder) SplicePoints() []int {
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	return e.opus.SplicePoints()
+}
+
+// encodeFrame encodes a frame of pcm
+func (e *Encoder) encodeFrame(pcm []int16) ([]byte, error) {
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	opus, err := e.opus.Encode(pcm)
+	if err != nil {
+		return nil, fmt.Errorf("Encoding Error: %s", err)
+	}
+
+	return opus, nil
+}
+
+// send hands a frame of opus on to the reader
+func (e *Encoder) send(opus []byte) error {
+
+	select {
+	case e.frames <- opus:
+		return nil
+	case <-e.stop:
+		return io.EOF
+	}
+}
+
+// Metadata returns the metadata the DCA stream of the encoder starts with
+func (e *Encoder) Metadata() *Metadata {
+	return e.metadata
+}
+
+// OpusFrame returns the next opus frame, ready to be sent to Discord. It
+// returns io.EOF once the input is done, or the error that stopped the
+// encode.
+func (e *Encoder) OpusFrame() ([]byte, error) {
+
+	opus, ok := <-e.frames
+	if ok {
+		return opus, nil
+	}
+
+	if e.err != nil {
+		return nil, e.err
+	}
+
+	return nil, io.EOF
+}
+
+// Read reads the encoded audio as a DCA stream
+func (e *Encoder) Read(p []byte) (int, error) {
+
+	if e.buf.Len() == 0 {
+		if !e.header {
+			e.header = true
+
+			err := WriteHeader(&e.buf, e.metadata, false, 0)
+			if err != nil {
+				return 0, err
+			}
+		} else {
+			opus, err := e.OpusFrame()
+			if err != nil {
+				return 0, err
+			}
+
+			WriteFrame(&e.buf, opus)
+		}
+	}
+
+	return e.buf.Read(p)
+}
+
+// Close stops the encoder, killing ffmpeg if the input isn't done. Frames
+// encoded before it was closed can still be read.
+func (e *Encoder) Close() error {
+
+	e.stopOnce.Do(func() {
+		close(e.stop)
+		e.cmd.Process.Kill()
+	})
+	<-e.done
+
+	return nil
+}
@@ -0,0 +1,275 @@
+package dcaenc
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// ReadFrame reads one length prefixed opus frame
+func ReadFrame(r io.Reader) ([]byte, error) {
+
+	var opuslen int16
+
+	// read frame header
+	err := binary.Read(r, binary.LittleEndian, &opuslen)
+	if err != nil {
+		return nil, err
+	}
+
+	if opuslen < 0 {
+		return nil, fmt.Errorf("invalid frame length %d", opuslen)
+	}
+
+	// read opus data
+	opus := make([]byte, opuslen)
+	_, err = io.ReadFull(r, opus)
+	if err != nil {
+		return nil, err
+	}
+
+	return opus, nil
+}
+
+// WriteFrame writes a single opus frame with its length header. This runs
+// for every frame so it writes the bytes directly rather than going
+// through binary.Write.
+func WriteFrame(w io.Writer, opus []byte) error {
+
+	// write header
+	var header [2]byte
+	binary.LittleEndian.PutUint16(header[:], uint16(len(opus)))
+	_, err := w.Write(header[:])
+	if err != nil {
+		return err
+	}
+
+	// write opus data to the output
+	_, err = w.Write(opus)
+	return err
+}
+
+// FrameReader reads the frames of a DCA stream, expanding repeat markers
+// back into the frames they stand for and checking frames against their
+// parity.
+//
+// A frame length of -N is a repeat marker, standing for N more copies of
+// the frame before it. Files with parity have a parity frame after every
+// group of frames, as written by ParityFrame.
+type FrameReader struct {
+	r io.Reader
+
+	// the last frame read, and how many more times it is to be returned
+	last   []byte
+	repeat int
+
+	// frames per parity frame, and the frames of the current group still
+	// to be returned
+	parity int
+	group  [][]byte
+}
+
+// NewFrameReader returns a FrameReader reading frames from r, positioned
+// after the header of a stream with the given metadata, which may be nil
+// for raw input
+func NewFrameReader(r io.Reader, metadata *Metadata) *FrameReader {
+
+	fr := &FrameReader{r: r}
+	if metadata != nil && metadata.Dca != nil {
+		fr.parity = metadata.Dca.Parity
+	}
+
+	return fr
+}
+
+// Parity returns the number of frames each parity frame of the stream
+// covers, 0 if it has none
+func (fr *FrameReader) Parity() int {
+	return fr.parity
+}
+
+// Skipped tells the reader that frames were skipped by seeking over them,
+// the last of them being last, with repeat more copies of it still to be
+// returned
+func (fr *FrameReader) Skipped(last []byte, repeat int) {
+	fr.last = last
+	fr.repeat = repeat
+}
+
+// ReadFrame returns the next frame
+func (fr *FrameReader) ReadFrame() ([]byte, error) {
+
+	if fr.parity > 0 {
+		if len(fr.group) == 0 {
+			err := fr.readGroup()
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		opus := fr.group[0]
+		fr.group = fr.group[1:]
+		return opus, nil
+	}
+
+	if fr.repeat > 0 {
+		fr.repeat--
+		return fr.last, nil
+	}
+
+	var opuslen int16
+
+	err := binary.Read(fr.r, binary.LittleEndian, &opuslen)
+	if err != nil {
+		return nil, err
+	}
+
+	if opuslen < 0 {
+		if fr.last == nil {
+			return nil, fmt.Errorf("repeat marker before the first frame")
+		}
+
+		fr.repeat = -int(opuslen) - 1
+		return fr.last, nil
+	}
+
+	opus := make([]byte, opuslen)
+	_, err = io.ReadFull(fr.r, opus)
+	if err != nil {
+		return nil, err
+	}
+
+	fr.last = opus
+	return opus, nil
+}
+
+// readGroup reads the next group of frames and its parity frame, repairing
+// a damaged frame where it can. Frames that can't be repaired are returned
+// as they are, for the decoder to report.
+func (fr *FrameReader) readGroup() error {
+
+	var group [][]byte
+	for len(group) <= fr.parity {
+		opus, err := ReadFrame(fr.r)
+		if err == io.EOF && len(group) > 0 {
+			break
+		}
+		if err == io.ErrUnexpectedEOF && len(group) > 0 {
+			// a truncated stream has no parity for its last group
+			fr.group = group
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		group = append(group, opus)
+	}
+
+	// the last frame of a group, full or not, is its parity
+	parity := group[len(group)-1]
+	group = group[:len(group)-1]
+
+	RepairGroup(group, parity)
+
+	fr.group = group
+	return nil
+}
+
+// ParityFrame returns the parity frame of a group of frames. It starts
+// with the number of frames in the group, then holds the length and CRC-32
+// of each as a uint16 and uint32, and ends with the XOR of all their data.
+// Receivers of a stream sent over an unreliable transport write an empty
+// frame for any they lose, and a frame that is missing or damaged is
+// rebuilt from the rest of its group as long as it is the only one.
+func ParityFrame(group [][]byte) []byte {
+
+	size := 0
+	for _, opus := range group {
+		if len(opus) > size {
+			size = len(opus)
+		}
+	}
+
+	head := 1 + 6*len(group)
+	parity := make([]byte, head+size)
+	parity[0] = byte(len(group))
+
+	for i, opus := range group {
+		entry := parity[1+6*i:]
+		binary.LittleEndian.PutUint16(entry, uint16(len(opus)))
+		binary.LittleEndian.PutUint32(entry[2:], crc32.ChecksumIEEE(opus))
+
+		for j, b := range opus {
+			parity[head+j] ^= b
+		}
+	}
+
+	return parity
+}
+
+// DamagedFrames returns the indexes of the frames of a group that don't
+// match the lengths and checksums in its parity frame
+func DamagedFrames(group [][]byte, parity []byte) ([]int, error) {
+
+	head := 1 + 6*len(group)
+	if len(parity) < head || int(parity[0]) != len(group) {
+		return nil, fmt.Errorf("parity frame does not match its group")
+	}
+
+	var damaged []int
+	for i, opus := range group {
+		entry := parity[1+6*i:]
+		if len(opus) != int(binary.LittleEndian.Uint16(entry)) ||
+			crc32.ChecksumIEEE(opus) != binary.LittleEndian.Uint32(entry[2:]) {
+			damaged = append(damaged, i)
+		}
+	}
+
+	return damaged, nil
+}
+
+// RepairGroup checks the frames of a group against its parity frame and
+// rebuilds the one that is missing or damaged, if there is only one
+func RepairGroup(group [][]byte, parity []byte) error {
+
+	damaged, err := DamagedFrames(group, parity)
+	if err != nil {
+		return err
+	}
+
+	if len(damaged) == 0 {
+		return nil
+	}
+	if len(damaged) > 1 {
+		return fmt.Errorf("more than one frame of a group is damaged")
+	}
+
+	head := 1 + 6*len(group)
+	bad := damaged[0]
+
+	entry := parity[1+6*bad:]
+	size := int(binary.LittleEndian.Uint16(entry))
+	if head+size > len(parity) {
+		return fmt.Errorf("parity frame does not match its group")
+	}
+
+	opus := make([]byte, size)
+	copy(opus, parity[head:])
+	for i, other := range group {
+		if i == bad {
+			continue
+		}
+		for j := 0; j < len(other) && j < size; j++ {
+			opus[j] ^= other[j]
+		}
+	}
+
+	if crc32.ChecksumIEEE(opus) != binary.LittleEndian.Uint32(entry[2:]) {
+		return fmt.Errorf("frame could not be rebuilt from parity")
+	}
+
+	group[bad] = opus
+	return nil
+}
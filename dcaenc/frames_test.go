@@ -0,0 +1,198 @@
+package dcaenc
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+// stream returns a DCA stream without a header of the given items, a
+// []byte being a frame and an int a repeat marker for that many copies
+func stream(items ...interface{}) []byte {
+
+	var buf bytes.Buffer
+	for _, item := range items {
+		switch item := item.(type) {
+		case []byte:
+			WriteFrame(&buf, item)
+		case int:
+			binary.Write(&buf, binary.LittleEndian, int16(-item))
+		}
+	}
+
+	return buf.Bytes()
+}
+
+// damage returns a copy of opus with its first byte flipped
+func damage(opus []byte) []byte {
+
+	damaged := append([]byte(nil), opus...)
+	damaged[0] ^= 0xff
+
+	return damaged
+}
+
+var (
+	frameA = []byte{1, 2, 3}
+	frameB = []byte{4, 5, 6, 7, 8}
+	frameC = []byte{9}
+)
+
+func TestRepairGroup(t *testing.T) {
+
+	parity := ParityFrame([][]byte{frameA, frameB, frameC})
+
+	tests := []struct {
+		name  string
+		group [][]byte
+		err   bool
+	}{
+		{"intact", [][]byte{frameA, frameB, frameC}, false},
+		{"lost", [][]byte{frameA, {}, frameC}, false},
+		{"lost shortest", [][]byte{frameA, frameB, {}}, false},
+		{"damaged", [][]byte{damage(frameA), frameB, frameC}, false},
+		{"two lost", [][]byte{{}, {}, frameC}, true},
+		{"lost and damaged", [][]byte{frameA, {}, damage(frameC)}, true},
+		{"wrong group", [][]byte{frameA, frameB}, true},
+	}
+
+	for _, tt := range tests {
+		err := RepairGroup(tt.group, parity)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%s: expected an error", tt.name)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+
+		want := [][]byte{frameA, frameB, frameC}
+		if !reflect.DeepEqual(tt.group, want) {
+			t.Errorf("%s: got %v, want %v", tt.name, tt.group, want)
+		}
+	}
+}
+
+func TestFrameReader(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		stream []byte
+		parity int
+		want   [][]byte
+		err    bool
+	}{
+		{
+			name:   "frames",
+			stream: stream(frameA, frameB, frameC),
+			want:   [][]byte{frameA, frameB, frameC},
+		},
+		{
+			name:   "repeat",
+			stream: stream(frameA, 2, frameB, 1),
+			want:   [][]byte{frameA, frameA, frameA, frameB, frameB},
+		},
+		{
+			name:   "repeat first",
+			stream: stream(2, frameA),
+			err:    true,
+		},
+		{
+			name: "parity",
+			stream: stream(frameA, frameB, ParityFrame([][]byte{frameA, frameB}),
+				frameC, ParityFrame([][]byte{frameC})),
+			parity: 2,
+			want:   [][]byte{frameA, frameB, frameC},
+		},
+		{
+			name: "parity repair",
+			stream: stream(frameA, []byte{}, ParityFrame([][]byte{frameA, frameB}),
+				damage(frameC), ParityFrame([][]byte{frameC})),
+			parity: 2,
+			want:   [][]byte{frameA, frameB, frameC},
+		},
+		{
+			name: "parity truncated",
+			stream: append(stream(frameA, frameB, ParityFrame([][]byte{frameA, frameB}), frameC),
+				stream(frameB)[:3]...),
+			parity: 2,
+			want:   [][]byte{frameA, frameB, frameC},
+		},
+	}
+
+	for _, tt := range tests {
+		metadata := &Metadata{Dca: &DCAMetadata{Parity: tt.parity}}
+		fr := NewFrameReader(bytes.NewReader(tt.stream), metadata)
+
+		var got [][]byte
+		var err error
+		for {
+			var opus []byte
+			opus, err = fr.ReadFrame()
+			if err != nil {
+				break
+			}
+			got = append(got, opus)
+		}
+
+		if tt.err {
+			if err == io.EOF {
+				t.Errorf("%s: expected an error", tt.name)
+			}
+			continue
+		}
+
+		if err != io.EOF {
+			t.Errorf("%s: %s", tt.name, err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// benchmarkFrame is about the size of a 20ms frame at 128kb/s
+var benchmarkFrame = make([]byte, 320)
+
+// writeFrameBinary is how WriteFrame used to write frames, with
+// binary.Write, kept to compare against
+func writeFrameBinary(w io.Writer, opus []byte) error {
+
+	opuslen := int16(len(opus))
+	err := binary.Write(w, binary.LittleEndian, &opuslen)
+	if err != nil {
+		return err
+	}
+
+	return binary.Write(w, binary.LittleEndian, &opus)
+}
+
+func benchmarkWriteFrame(b *testing.B, write func(io.Writer, []byte) error) {
+
+	w := bufio.NewWriterSize(ioutil.Discard, 16384)
+
+	b.SetBytes(int64(len(benchmarkFrame) + 2))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		err := write(w, benchmarkFrame)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkWriteFrame(b *testing.B) {
+	benchmarkWriteFrame(b, WriteFrame)
+}
+
+func BenchmarkWriteFrameBinary(b *testing.B) {
+	benchmarkWriteFrame(b, writeFrameBinary)
+}
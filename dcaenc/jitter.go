@@ -0,0 +1,182 @@
+package dcaenc
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// jitterWindow is how many frames in a row an adaptive JitterBuffer has to
+// play without running dry before it shrinks by a frame
+const jitterWindow = 500
+
+// JitterBuffer smooths out frames arriving irregularly, such as a DCA stream
+// read from the network, into one frame per frame length. Frames are pushed
+// as they arrive and popped at the pace they play at, from a buffer of a
+// target number of frames that absorbs late arrivals.
+//
+// The buffer fills up to its target before playing starts. When it runs dry,
+// Pop returns no frame, for the player to fill with silence or concealment,
+// until it has filled up again. An adaptive buffer adds a frame to its target
+// each time it runs dry, up to its maximum, and drops one again after
+// playing steadily for a while, so it keeps as little delay as the network
+// allows. Frames arriving while the buffer is at its maximum push the oldest
+// ones out.
+type JitterBuffer struct {
+	frame    time.Duration
+	max      int
+	adaptive bool
+
+	lock   sync.Mutex
+	notify chan struct{}
+	queue  [][]byte
+	closed bool
+
+	// frames buffered before playing, whether it is filling up to it, and
+	// frames played since it last ran dry
+	target    int
+	buffering bool
+	steady    int
+
+	// when playing started and how many frames have been due since
+	start time.Time
+	ticks int
+}
+
+// NewJitterBuffer returns a JitterBuffer for frames of the given length,
+// buffering target frames and holding at most max, which must be at least
+// target
+func NewJitterBuffer(frame time.Duration, target, max int, adaptive bool) (*JitterBuffer, error) {
+
+	if frame <= 0 {
+		return nil, fmt.Errorf("invalid frame length %s", frame)
+	}
+
+	if target < 1 || max < target {
+		return nil, fmt.Errorf("invalid jitter buffer of %d frames, at most %d", target, max)
+	}
+
+	return &JitterBuffer{
+		frame:     frame,
+		max:       max,
+		adaptive:  adaptive,
+		notify:    make(chan struct{}, 1),
+		target:    target,
+		buffering: true,
+	}, nil
+}
+
+// Push adds a frame that has arrived
+func (j *JitterBuffer) Push(opus []byte) {
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	if j.closed {
+		return
+	}
+
+	j.queue = append(j.queue, opus)
+	if len(j.queue) > j.max {
+		j.queue = j.queue[1:]
+	}
+
+	j.wake()
+}
+
+// Close marks the end of the stream. The frames still buffered can be
+// popped, after which Pop returns io.EOF.
+func (j *JitterBuffer) Close() {
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	j.closed = true
+	j.wake()
+}
+
+// wake lets a Pop waiting for the first frames check again
+func (j *JitterBuffer) wake() {
+
+	select {
+	case j.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Pop waits until the next frame is due to play and returns it. It returns
+// a nil frame if the buffer has run dry or is filling up again, and io.EOF
+// once the stream is closed and every frame has been popped.
+func (j *JitterBuffer) Pop() ([]byte, error) {
+
+	j.lock.Lock()
+
+	// the clock starts with the first frame played
+	for j.start.IsZero() {
+		if len(j.queue) >= j.target || j.closed {
+			j.start = time.Now()
+			break
+		}
+
+		j.lock.Unlock()
+		<-j.notify
+		j.lock.Lock()
+	}
+
+	due := j.start.Add(time.Duration(j.ticks) * j.frame)
+	j.ticks++
+	j.lock.Unlock()
+
+	time.Sleep(due.Sub(time.Now()))
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	if j.buffering {
+		if len(j.queue) < j.target && !j.closed {
+			return nil, nil
+		}
+		j.buffering = false
+	}
+
+	if len(j.queue) == 0 {
+		if j.closed {
+			return nil, io.EOF
+		}
+
+		j.buffering = true
+		j.steady = 0
+		if j.adaptive && j.target < j.max {
+			j.target++
+		}
+		return nil, nil
+	}
+
+	opus := j.queue[0]
+	j.queue = j.queue[1:]
+
+	// a steady stream needs less delay, so a frame of it is dropped
+	if j.adaptive {
+		j.steady++
+		if j.steady >= jitterWindow && j.target > 1 {
+			j.target--
+			j.steady = 0
+			if len(j.queue) > j.target {
+				j.queue = j.queue[1:]
+			}
+		}
+	}
+
+	return opus, nil
+}
+
+// Depth returns the frames buffered and the number the buffer is aiming
+// for
+func (j *JitterBuffer) Depth() (int, int) {
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	return len(j.queue), j.target
+}
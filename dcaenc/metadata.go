@@ -0,0 +1,377 @@
+// Package dcaenc reads and writes DCA files, the format of opus audio the
+// dca tool produces for Discord bots, and encodes audio to it with ffmpeg
+// and libopus, so bots can encode and play files without running the dca
+// binary.
+//
+// A DCA file starts with the magic bytes "DCA1", an int32 length and a json
+// metadata block, followed by opus frames, each preceded by its length as
+// an int16. All numbers are little endian.
+package dcaenc
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// FormatVersion is the current version of the DCA format
+const FormatVersion int8 = 1
+
+// Magic is written at the start of a DCA file
+var Magic = fmt.Sprintf("DCA%d", FormatVersion)
+
+// Metadata is the json metadata block of a DCA file
+//
+// https://github.com/bwmarrin/dca/issues/5#issuecomment-189713886
+type Metadata struct {
+	Dca      *DCAMetadata      `json:"dca"`
+	SongInfo *SongMetadata     `json:"info"`
+	Origin   *OriginMetadata   `json:"origin"`
+	Opus     *OpusMetadata     `json:"opus"`
+	Extra    *ExtraMetadata    `json:"extra"`
+	Tracks   []*TrackMetadata  `json:"tracks,omitempty"`
+	Streams  []*StreamMetadata `json:"streams,omitempty"`
+}
+
+// DCAMetadata contains the DCA version, and the optional format extensions
+// the file uses. Parity is the number of frames each parity frame covers,
+// when it has them.
+type DCAMetadata struct {
+	Version    int8          `json:"version"`
+	Tool       *ToolMetadata `json:"tool"`
+	Extensions []string      `json:"extensions,omitempty"`
+	Parity     int           `json:"parity,omitempty"`
+}
+
+// ToolMetadata contains the name and version of what wrote the file
+type ToolMetadata struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	Url     string `json:"url"`
+	Author  string `json:"author"`
+}
+
+// SongMetadata contains information about the song that was encoded
+type SongMetadata struct {
+	Title    string  `json:"title"`
+	Artist   string  `json:"artist"`
+	Album    string  `json:"album"`
+	Genre    string  `json:"genre"`
+	Comments string  `json:"comments"`
+	Cover    *string `json:"cover"`
+}
+
+// OriginMetadata contains information about where the song came from,
+// audio bitrate, channels and original encoding
+type OriginMetadata struct {
+	Source   string `json:"source"`
+	Bitrate  int    `json:"abr"`
+	Channels int    `json:"channels"`
+	Encoding string `json:"encoding"`
+	Url      string `json:"url"`
+}
+
+// OpusMetadata contains information about how the file was encoded with
+// Opus. Fingerprint is the hex SHA-1 of these settings and the volume, for
+// telling whether a file matches the settings wanted for it. PreSkip is
+// the encoder delay at the start of the audio in 48kHz samples, as in an
+// Ogg Opus header.
+type OpusMetadata struct {
+	Bitrate     int    `json:"abr"`
+	SampleRate  int    `json:"sample_rate"`
+	Application string `json:"mode"`
+	FrameSize   int    `json:"frame_size"`
+	Channels    int    `json:"channels"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+	PreSkip     int    `json:"pre_skip,omitempty"`
+
+	// SpliceInterval is how many frames apart the encoder was reset, 0 if
+	// it never was
+	SpliceInterval int `json:"splice_interval,omitempty"`
+}
+
+// TrackMetadata contains information about one of the works in a file
+// holding several of them. Offset is the frame the track starts in and
+// Duration is its length in milliseconds. Clips of a soundboard sprite also
+// have a Name to look them up by and the number of Frames they span.
+type TrackMetadata struct {
+	Info     *SongMetadata `json:"info"`
+	Name     string        `json:"name,omitempty"`
+	Offset   int           `json:"offset"`
+	Frames   int           `json:"frames,omitempty"`
+	Duration int           `json:"duration"`
+}
+
+// StreamMetadata contains information about one of the streams of a
+// multitrack file, such as one speaker of a voice recording. When a file
+// has streams, each frame is preceded by a uint8 holding the index of its
+// stream in this list, and frames are interleaved in time order.
+type StreamMetadata struct {
+	ID     string `json:"id"`
+	Source string `json:"source"`
+}
+
+// GapMetadata marks frames of silence that stand in for audio a live input
+// didn't deliver in time. Offset is the first frame of the gap.
+type GapMetadata struct {
+	Offset int `json:"offset"`
+	Frames int `json:"frames"`
+}
+
+// SeamMetadata marks where a later run of dca -append starts in a file.
+// Frame is the first frame of the run, PreSkip its encoder delay in 48kHz
+// samples as in OpusMetadata and Samples the length of its input per
+// channel. Decoded audio between the end of one run's input and the end
+// of the next run's delay is padding.
+type SeamMetadata struct {
+	Frame   int `json:"frame"`
+	PreSkip int `json:"pre_skip"`
+	Samples int `json:"samples"`
+}
+
+// ExtraMetadata holds what is only known once encoding is done.
+//
+// SourceError is set when the input failed part way through, so the audio
+// is incomplete.
+//
+// The remaining fields are filled in for file outputs only. Duration is in
+// milliseconds, Bitrate is the average achieved in bits per second and
+// Checksum is the hex SHA-1 of all frames including their length headers
+// and stream indexes. Samples is the length of the input per channel,
+// without the silence the last frame was padded with, summed over the
+// runs of a file appended to.
+type ExtraMetadata struct {
+	SourceError string `json:"source_error,omitempty"`
+	Duration    int    `json:"duration,omitempty"`
+	Frames      int    `json:"frames,omitempty"`
+	Samples     int    `json:"samples,omitempty"`
+	Bitrate     int    `json:"abr,omitempty"`
+	Checksum    string `json:"checksum,omitempty"`
+
+	// SplicePoints are the frames the encoder was reset at, where the
+	// file can be cut without the first frame depending on the audio
+	// before it
+	SplicePoints []int `json:"splice_points,omitempty"`
+
+	// Gaps are where silence was put in for a live input that stalled
+	Gaps []*GapMetadata `json:"gaps,omitempty"`
+
+	// Seams are where runs appended to the file start
+	Seams []*SeamMetadata `json:"seams,omitempty"`
+
+	// Index is the seek index of the file, if it has one
+	Index *SeekIndex `json:"index,omitempty"`
+
+	// Loudness is how loud the input was measured to be before encoding,
+	// for files that were normalized
+	Loudness *LoudnessMetadata `json:"loudness,omitempty"`
+
+	// Quality is how close the encode came to its input, for files that
+	// were checked
+	Quality *QualityMetadata `json:"quality,omitempty"`
+}
+
+// QualityMetadata is the score of an encode compared with its input. The
+// spectral metric is the average difference of their spectra in dB, lower
+// being better, and visqol and pesq are a MOS-LQO from 1 to 5, higher
+// being better.
+type QualityMetadata struct {
+	Metric string  `json:"metric"`
+	Score  float64 `json:"score"`
+}
+
+// LoudnessMetadata is the loudness of an input as defined by EBU R128, its
+// integrated loudness in LUFS, true peak in dBTP and loudness range in LU,
+// and the gain in dB applied to it when it was encoded
+type LoudnessMetadata struct {
+	Integrated float64 `json:"integrated"`
+	TruePeak   float64 `json:"true_peak"`
+	Range      float64 `json:"range"`
+	Gain       float64 `json:"gain"`
+}
+
+// SeekIndex lets readers jump close to any frame of a file instead of
+// reading every frame before it. Frames are the frame numbers of the
+// entries, one at or before every Interval frames, and Offsets where each
+// starts in bytes from the end of the header, so they stay valid when the
+// header is rewritten. The time of an entry is its frame number times the
+// frame size over the sample rate.
+type SeekIndex struct {
+	Interval int     `json:"interval"`
+	Frames   []int   `json:"frames,omitempty"`
+	Offsets  []int64 `json:"offsets,omitempty"`
+}
+
+// gzipMagic starts a metadata block that is gzip compressed. Plain json
+// metadata always starts with '{', so the first byte of the block is enough
+// to tell the two apart.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// EncodeMetadata returns metadata as json, gzip compressed if compress is
+// set
+func EncodeMetadata(metadata *Metadata, compress bool) ([]byte, error) {
+
+	data, err := json.Marshal(metadata)
+	if err != nil || !compress {
+		return data, err
+	}
+
+	var buf bytes.Buffer
+	zw, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = zw.Write(data)
+	if err != nil {
+		return nil, err
+	}
+
+	err = zw.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// DecodeMetadata parses a metadata block, decompressing it first if it is
+// gzip compressed. Padding after the compressed data is ignored like
+// trailing whitespace is for json.
+func DecodeMetadata(block []byte) (*Metadata, error) {
+
+	if IsCompressed(block) {
+		zr, err := gzip.NewReader(bytes.NewReader(block))
+		if err != nil {
+			return nil, err
+		}
+		zr.Multistream(false)
+
+		block, err = ioutil.ReadAll(zr)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var metadata Metadata
+	err := json.Unmarshal(block, &metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	return &metadata, nil
+}
+
+// IsCompressed reports whether a metadata block is gzip compressed
+func IsCompressed(block []byte) bool {
+	return bytes.HasPrefix(block, gzipMagic)
+}
+
+// ReadHeader reads the magic bytes and json metadata from the start of a
+// DCA file
+func ReadHeader(r io.Reader) (*Metadata, error) {
+
+	magic := make([]byte, len(Magic))
+	_, err := io.ReadFull(r, magic)
+	if err != nil {
+		return nil, err
+	}
+
+	if string(magic) != Magic {
+		return nil, fmt.Errorf("not a %s file", Magic)
+	}
+
+	var jsonlen int32
+	err = binary.Read(r, binary.LittleEndian, &jsonlen)
+	if err != nil {
+		return nil, err
+	}
+
+	if jsonlen < 0 {
+		return nil, fmt.Errorf("invalid metadata length %d", jsonlen)
+	}
+
+	jsonbuf := make([]byte, jsonlen)
+	_, err = io.ReadFull(r, jsonbuf)
+	if err != nil {
+		return nil, err
+	}
+
+	return DecodeMetadata(jsonbuf)
+}
+
+// WriteHeader writes the magic bytes and json metadata, followed by
+// padding spaces so the metadata can be rewritten in place later
+func WriteHeader(w io.Writer, metadata *Metadata, compress bool, padding int) error {
+
+	_, err := io.WriteString(w, Magic)
+	if err != nil {
+		return err
+	}
+
+	json, err := EncodeMetadata(metadata, compress)
+	if err != nil {
+		return fmt.Errorf("failed to encode the Metadata JSON: %s", err)
+	}
+	json = append(json, bytes.Repeat([]byte(" "), padding)...)
+
+	jsonlen := int32(len(json))
+	err = binary.Write(w, binary.LittleEndian, &jsonlen)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(json)
+	return err
+}
+
+// Fingerprint returns a hash of every setting that changes how audio is
+// encoded, so files can be compared against the settings wanted for them
+// without comparing each field
+func Fingerprint(opus *OpusMetadata, volume int) string {
+
+	// unknown applications are encoded as audio
+	application := opus.Application
+	if application != "voip" && application != "lowdelay" {
+		application = "audio"
+	}
+
+	settings := fmt.Sprintf("abr=%d mode=%s sample_rate=%d channels=%d frame_size=%d vol=%d",
+		opus.Bitrate, application, opus.SampleRate, opus.Channels, opus.FrameSize, volume)
+
+	sum := sha1.Sum([]byte(settings))
+	return hex.EncodeToString(sum[:])
+}
+
+// PreSkip returns the number of 48kHz samples of encoder delay libopus
+// adds to the start of a stream encoded with the given application
+func PreSkip(application string) int {
+
+	if application == "lowdelay" {
+		return 120
+	}
+
+	return 312
+}
+
+// SplicePoints returns the frames of a stream of the given number of
+// frames that an encoder reset every interval frames was reset at
+func SplicePoints(interval, frames int) []int {
+
+	if interval <= 0 {
+		return nil
+	}
+
+	var points []int
+	for i := interval; i < frames; i += interval {
+		points = append(points, i)
+	}
+
+	return points
+}
@@ -0,0 +1,93 @@
+package dcaenc
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMetadataRoundTrip(t *testing.T) {
+
+	cover := strings.Repeat("cover", 1000)
+	metadata := &Metadata{
+		Dca:      &DCAMetadata{Version: FormatVersion, Tool: &ToolMetadata{Name: "dca"}},
+		SongInfo: &SongMetadata{Title: "title", Cover: &cover},
+		Origin:   &OriginMetadata{Source: "file", Channels: 2},
+		Opus:     &OpusMetadata{Bitrate: 64000, SampleRate: 48000, Application: "audio", FrameSize: 960, Channels: 2, PreSkip: 312},
+		Extra:    &ExtraMetadata{Frames: 10, Index: &SeekIndex{Interval: 4, Frames: []int{0, 4}, Offsets: []int64{0, 20}}},
+	}
+
+	tests := []struct {
+		name     string
+		compress bool
+		padding  int
+	}{
+		{"json", false, 0},
+		{"json padded", false, 64},
+		{"gzip", true, 0},
+		{"gzip padded", true, 64},
+	}
+
+	for _, tt := range tests {
+		block, err := EncodeMetadata(metadata, tt.compress)
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+
+		if IsCompressed(block) != tt.compress {
+			t.Errorf("%s: IsCompressed = %v", tt.name, !tt.compress)
+		}
+		if tt.compress && len(block) > len(cover)/2 {
+			t.Errorf("%s: %d bytes is not compressed", tt.name, len(block))
+		}
+
+		block = append(block, bytes.Repeat([]byte(" "), tt.padding)...)
+
+		got, err := DecodeMetadata(block)
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, metadata) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, metadata)
+		}
+
+		// and the same through a header
+		var buf bytes.Buffer
+		err = WriteHeader(&buf, metadata, tt.compress, tt.padding)
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+
+		got, err = ReadHeader(&buf)
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, metadata) {
+			t.Errorf("%s: header got %+v, want %+v", tt.name, got, metadata)
+		}
+	}
+}
+
+func TestDecodeMetadataErrors(t *testing.T) {
+
+	tests := []struct {
+		name  string
+		block []byte
+	}{
+		{"empty", nil},
+		{"truncated json", []byte(`{"dca":`)},
+		{"truncated gzip", gzipMagic},
+	}
+
+	for _, tt := range tests {
+		_, err := DecodeMetadata(tt.block)
+		if err == nil {
+			t.Errorf("%s: expected an error", tt.name)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package dcaenc
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+)
+
+// BuildSeekIndex reads the frames of a DCA stream with the given metadata
+// from r, positioned after its header, and returns a seek index with an
+// entry at or before every interval frames. Entries are always on a frame
+// a reader can start at: never on a repeat marker, and for files with
+// parity on the first frame of a group, so the interval is rounded up to
+// whole groups.
+func BuildSeekIndex(r io.Reader, metadata *Metadata, interval int) (*SeekIndex, error) {
+
+	if interval < 1 {
+		return nil, fmt.Errorf("invalid seek index interval %d", interval)
+	}
+
+	if len(metadata.Streams) > 0 {
+		return nil, fmt.Errorf("multitrack files can't be indexed")
+	}
+
+	parity := 0
+	if metadata.Dca != nil {
+		parity = metadata.Dca.Parity
+	}
+	if parity > 0 {
+		interval = (interval + parity - 1) / parity * parity
+	}
+
+	index := &SeekIndex{Interval: interval}
+
+	// where the frame is that the next frame of the stream can be started
+	// from, and the next frame that needs an entry
+	var pos, lastPos int64
+	frame, lastFrame, next := 0, 0, 0
+	inGroup := 0
+
+	add := func(frame int, pos int64) {
+		if n := len(index.Frames); n > 0 && index.Frames[n-1] == frame {
+			return
+		}
+		index.Frames = append(index.Frames, frame)
+		index.Offsets = append(index.Offsets, pos)
+	}
+
+	lenbuf := make([]byte, 2)
+	for {
+		_, err := io.ReadFull(r, lenbuf)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return index, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		opuslen := int16(binary.LittleEndian.Uint16(lenbuf))
+
+		// a repeat marker stands for -opuslen more copies of the frame
+		// before it, which is where a reader wanting any of them starts
+		if opuslen < 0 {
+			n := -int(opuslen)
+			if next < frame+n {
+				add(lastFrame, lastPos)
+				next = (frame+n-1)/interval*interval + interval
+			}
+			frame += n
+			pos += 2
+			continue
+		}
+
+		_, err = io.CopyN(ioutil.Discard, r, int64(opuslen))
+		if err == io.EOF {
+			return index, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// the parity frame after each group isn't a frame of the audio
+		if parity > 0 && inGroup == parity {
+			inGroup = 0
+			pos += 2 + int64(opuslen)
+			continue
+		}
+
+		if frame >= next {
+			add(frame, pos)
+			next = frame/interval*interval + interval
+		}
+
+		lastFrame, lastPos = frame, pos
+		frame++
+		inGroup++
+		pos += 2 + int64(opuslen)
+	}
+}
+
+// Lookup returns the last entry of the index at or before frame, as its
+// frame number and offset. Frames before the first entry start at the
+// first frame of the stream.
+func (idx *SeekIndex) Lookup(frame int) (int, int64) {
+
+	i := sort.SearchInts(idx.Frames, frame+1) - 1
+	if i < 0 || i >= len(idx.Offsets) {
+		return 0, 0
+	}
+
+	return idx.Frames[i], idx.Offsets[i]
+}
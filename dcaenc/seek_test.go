@@ -0,0 +1,117 @@
+package dcaenc
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestBuildSeekIndex(t *testing.T) {
+
+	// frameA takes 5 bytes with its length, a marker 2 and the parity
+	// frame of two frameAs 18
+	parity := ParityFrame([][]byte{frameA, frameA})
+
+	tests := []struct {
+		name     string
+		stream   []byte
+		metadata *Metadata
+		interval int
+		want     *SeekIndex
+		err      bool
+	}{
+		{
+			name:     "frames",
+			stream:   stream(frameA, frameA, frameA, frameA, frameA),
+			metadata: &Metadata{},
+			interval: 2,
+			want:     &SeekIndex{Interval: 2, Frames: []int{0, 2, 4}, Offsets: []int64{0, 10, 20}},
+		},
+		{
+			// frames 1 to 3 are repeats, so frame 0 is where a reader
+			// wanting frame 2 starts
+			name:     "repeat",
+			stream:   stream(frameA, 3, frameA, frameA),
+			metadata: &Metadata{},
+			interval: 2,
+			want:     &SeekIndex{Interval: 2, Frames: []int{0, 4}, Offsets: []int64{0, 7}},
+		},
+		{
+			// the interval is rounded up to whole groups
+			name:     "parity",
+			stream:   stream(frameA, frameA, parity, frameA, frameA, parity, frameA),
+			metadata: &Metadata{Dca: &DCAMetadata{Parity: 2}},
+			interval: 3,
+			want:     &SeekIndex{Interval: 4, Frames: []int{0, 4}, Offsets: []int64{0, 56}},
+		},
+		{
+			name:     "empty",
+			metadata: &Metadata{},
+			interval: 2,
+			want:     &SeekIndex{Interval: 2},
+		},
+		{
+			name:     "no interval",
+			stream:   stream(frameA),
+			metadata: &Metadata{},
+			err:      true,
+		},
+		{
+			name:     "multitrack",
+			stream:   stream(frameA),
+			metadata: &Metadata{Streams: []*StreamMetadata{{ID: "a"}}},
+			interval: 2,
+			err:      true,
+		},
+	}
+
+	for _, tt := range tests {
+		index, err := BuildSeekIndex(bytes.NewReader(tt.stream), tt.metadata, tt.interval)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%s: expected an error", tt.name)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(index, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, index, tt.want)
+		}
+	}
+}
+
+func TestSeekIndexLookup(t *testing.T) {
+
+	index := &SeekIndex{Interval: 4, Frames: []int{0, 4, 8}, Offsets: []int64{0, 20, 40}}
+
+	tests := []struct {
+		frame  int
+		want   int
+		offset int64
+	}{
+		{0, 0, 0},
+		{3, 0, 0},
+		{4, 4, 20},
+		{7, 4, 20},
+		{8, 8, 40},
+		{100, 8, 40},
+	}
+
+	for _, tt := range tests {
+		frame, offset := index.Lookup(tt.frame)
+		if frame != tt.want || offset != tt.offset {
+			t.Errorf("Lookup(%d) = %d, %d, want %d, %d", tt.frame, frame, offset, tt.want, tt.offset)
+		}
+	}
+
+	// a file too short for any entries starts at the start
+	frame, offset := (&SeekIndex{Interval: 4}).Lookup(10)
+	if frame != 0 || offset != 0 {
+		t.Errorf("empty Lookup(10) = %d, %d, want 0, 0", frame, offset)
+	}
+}
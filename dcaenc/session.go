@@ -0,0 +1,79 @@
+package dcaenc
+
+import (
+	"io"
+)
+
+// EncodeSession encodes an input to a writer as a DCA stream in the
+// background, and can be paused, resumed and stopped part way through,
+// such as when a track is skipped
+type EncodeSession struct {
+	encoder *Encoder
+	done    chan struct{}
+	written int64
+	err     error
+}
+
+// NewEncodeSession starts encoding input, a file or url ffmpeg can read,
+// to w with opts, or StdOptions if opts is nil
+func NewEncodeSession(input string, w io.Writer, opts *Options) (*EncodeSession, error) {
+
+	encoder, err := NewEncoder(input, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &EncodeSession{
+		encoder: encoder,
+		done:    make(chan struct{}),
+	}
+
+	go func() {
+		defer close(s.done)
+
+		s.written, s.err = io.Copy(w, encoder)
+		encoder.Close()
+	}()
+
+	return s, nil
+}
+
+// Pause stops encoding until Resume is called
+func (s *EncodeSession) Pause() {
+	s.encoder.Pause()
+}
+
+// Resume carries on encoding after Pause
+func (s *EncodeSession) Resume() {
+	s.encoder.Resume()
+}
+
+// Stop ends the encode, killing ffmpeg, and returns once the frames
+// encoded so far are written, so the output is a complete DCA stream of
+// the audio up to where it stopped
+func (s *EncodeSession) Stop() error {
+
+	s.encoder.Close()
+	return s.Wait()
+}
+
+// Wait waits for the encode to finish or be stopped, and returns the error
+// that ended it, if any
+func (s *EncodeSession) Wait() error {
+
+	<-s.done
+	return s.err
+}
+
+// Done is closed once the encode has finished or been stopped
+func (s *EncodeSession) Done() <-chan struct{} {
+	return s.done
+}
+
+// Written waits for the session to be done and returns how many bytes of
+// the DCA stream were written
+func (s *EncodeSession) Written() int64 {
+
+	<-s.done
+	return s.written
+}
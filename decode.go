@@ -0,0 +1,813 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/dca/dcaenc"
+	"github.com/layeh/gopus"
+)
+
+// Decoding specific global variables
+var (
+	// Sample rate and channels of the pcm written by decode. Zero means
+	// whatever the file was encoded with.
+	OutFrameRate int
+	OutChannels  int
+
+	// Sample format of the pcm written by decode, one of s16le, s32le
+	// or f32le
+	PCMFormat string
+
+	// Gain in dB applied to the decoded pcm, and whether peaks over full
+	// scale are rounded off rather than clipped
+	Gain     float64
+	SoftClip bool
+
+	OpusDecoder *gopus.Decoder
+
+	// Metadata read from the header of the file being decoded
+	InMetadata *MetadataStruct
+
+	// Number of frames to skip before decoding
+	StartFrame int
+
+	// samples per channel, counted from the start of the file, to stop
+	// decoding at for -t, -1 for the end
+	StopSample = -1
+
+	// fd:N or file the metadata is written to as json before decoding
+	EmitMetadata string
+
+	// pcm, wav for pcm with a wav header, or ogg to copy the opus frames
+	// into an Ogg Opus stream without decoding them
+	DecodeFormat string
+
+	// opus packets per Ogg page, and whether pages are written out at
+	// the speed they play at
+	PageFrames int
+	Realtime   bool
+
+	// frames the jitter buffer aims to hold and holds at most, and whether
+	// it adapts to how the stream arrives, 0 frames for none
+	JitterFrames   int
+	JitterMax      int
+	JitterAdaptive bool
+)
+
+// decodeCmd implements "dca decode" which turns a DCA file back into pcm16
+func decodeCmd(args []string) {
+
+	fs := flag.NewFlagSet("decode", flag.ExitOnError)
+	fs.StringVar(&InFile, "i", "pipe:0", "infile")
+	fs.StringVar(&OutFile, "o", "pipe:1", "outfile")
+	fs.IntVar(&Channels, "ac", 2, "audio channels of raw input without metadata")
+	fs.IntVar(&FrameRate, "ar", 48000, "audio sampling rate of raw input without metadata")
+	fs.IntVar(&FrameSize, "as", 960, "audio frame size of raw input without metadata")
+	fs.IntVar(&OutChannels, "out-ac", 0, "output audio channels (default from file)")
+	fs.IntVar(&OutFrameRate, "out-ar", 0, "output audio sampling rate (default from file)")
+	fs.StringVar(&PCMFormat, "pcm-format", "s16le", "output sample format can be s16le, s32le, or f32le")
+	fs.Float64Var(&Gain, "gain", 0, "output gain in dB")
+	fs.BoolVar(&SoftClip, "soft-clip", false, "soft clip peaks instead of hard clipping them")
+	fs.IntVar(&StartFrame, "start-frame", 0, "frame to start decoding at")
+	fs.Var((*clockValue)(&StartTime), "ss", "time to start decoding at, like 1:23, 90 or 1m30s, rounded down to a whole frame")
+	fs.Var((*clockValue)(&ClipTime), "t", "how much to decode, like 0:30, 30 or 30s")
+	fs.StringVar(&DecodeFormat, "f", "pcm", "output format can be pcm, wav, or ogg for an Ogg Opus stream of the frames as they are")
+	fs.IntVar(&PageFrames, "page-frames", 0, "opus frames per Ogg page (default fills 4KB pages)")
+	fs.BoolVar(&Realtime, "realtime", false, "write Ogg pages out at the speed they play at")
+	fs.IntVar(&JitterFrames, "jitter", 0, "frames to buffer a stream arriving over a network by, writing pcm at a steady pace")
+	fs.IntVar(&JitterMax, "jitter-max", 0, "most frames the jitter buffer holds, dropping the oldest past it (default 4 times -jitter)")
+	fs.BoolVar(&JitterAdaptive, "jitter-adaptive", false, "grow the jitter buffer each time it runs dry and shrink it while the stream arrives steadily")
+	fs.StringVar(&EmitMetadata, "emit-metadata", "", "fd:N or file to write the metadata to as json before decoding")
+	fs.Parse(args)
+
+	//////////////////////////////////////////////////////////////////////////
+	// BLOCK : Open input and output, read the header
+	//////////////////////////////////////////////////////////////////////////
+
+	input, err := openInFile()
+	if err != nil {
+		reportError(exitInput, "error opening infile:", err)
+		return
+	}
+	defer input.Close()
+
+	if OutFile != "pipe:1" {
+		Output, err = os.Create(OutFile)
+		if err != nil {
+			reportError(exitOutput, "error opening outfile:", err)
+			return
+		}
+		defer Output.Close()
+	}
+
+	// files are read straight from memory when they can be mapped
+	in := io.Reader(input)
+	if data, err := mapFile(input); err == nil {
+		defer unmapFile(data)
+		in = bytes.NewReader(data)
+	}
+
+	rbuf, err := readInput(in)
+	if err != nil {
+		reportError(exitInput, "error reading header:", err)
+		return
+	}
+
+	if StartFrame < 0 || StartTime < 0 || ClipTime < 0 {
+		reportError(exitUsage, "error: -start-frame, -ss and -t can not be negative")
+		return
+	}
+
+	if StartFrame > 0 && StartTime > 0 {
+		reportError(exitUsage, "error: -start-frame can not be used with -ss")
+		return
+	}
+
+	// times are counted in the input, without the encoder delay and any
+	// seams, and -ss starts on the frame that time falls in
+	ranges := trimRanges()
+	if StartTime > 0 {
+		StartFrame = decodedSample(ranges, int(StartTime.Seconds()*float64(FrameRate))) / FrameSize
+	}
+
+	if ClipTime > 0 {
+		start := inputSample(ranges, StartFrame*FrameSize)
+		StopSample = decodedSample(ranges, start+int(ClipTime.Seconds()*float64(FrameRate)))
+	}
+
+	frames := dcaenc.NewFrameReader(rbuf, InMetadata)
+
+	if StartFrame > 0 {
+		err = skipFrames(in, rbuf, frames, seekIndex(InMetadata), StartFrame)
+		if err != nil {
+			reportError(exitInput, "error seeking to start frame:", err)
+			return
+		}
+	}
+
+	if OutFrameRate == 0 {
+		OutFrameRate = FrameRate
+	}
+
+	if OutChannels == 0 {
+		OutChannels = Channels
+	}
+
+	if OutChannels < 1 || OutChannels > 2 {
+		reportError(exitUsage, "error: -out-ac must be 1 or 2")
+		return
+	}
+
+	switch PCMFormat {
+	case "s16le", "s32le", "f32le":
+	default:
+		reportError(exitUsage, "error: unknown pcm format", PCMFormat)
+		return
+	}
+
+	switch DecodeFormat {
+	case "pcm", "wav":
+		if PageFrames != 0 || Realtime {
+			reportError(exitUsage, "error: -page-frames and -realtime require -f ogg")
+			return
+		}
+	case "ogg":
+		// the frames are copied as they are, so nothing can be changed
+		if OutFrameRate != FrameRate || OutChannels != Channels || PCMFormat != "s16le" || Gain != 0 || SoftClip {
+			reportError(exitUsage, "error: -f ogg can not be used with -out-ar, -out-ac, -pcm-format, -gain or -soft-clip")
+			return
+		}
+
+		if PageFrames < 0 || PageFrames > 255 {
+			reportError(exitUsage, "error: -page-frames must be from 0 to 255")
+			return
+		}
+	default:
+		reportError(exitUsage, "error: unknown output format", DecodeFormat)
+		return
+	}
+
+	if JitterMax == 0 {
+		JitterMax = 4 * JitterFrames
+	}
+
+	if JitterFrames < 0 || JitterMax < JitterFrames {
+		reportError(exitUsage, "error: -jitter can not be negative or more than -jitter-max")
+		return
+	}
+
+	if JitterFrames > 0 && DecodeFormat == "ogg" {
+		reportError(exitUsage, "error: -jitter can not be used with -f ogg, use -realtime")
+		return
+	}
+
+	if EmitMetadata != "" {
+		err = emitMetadata(EmitMetadata, InMetadata)
+		if err != nil {
+			reportError(exitOutput, "error writing metadata:", err)
+			return
+		}
+	}
+
+	//////////////////////////////////////////////////////////////////////////
+	// BLOCK : Create chans and decoder, start workers
+	//////////////////////////////////////////////////////////////////////////
+
+	OpusDecoder, err = gopus.NewDecoder(FrameRate, Channels)
+	if err != nil {
+		reportError(exitEncode, "NewDecoder Error:", err)
+		return
+	}
+
+	opus := make(chan []byte, 10)
+	pcm := make(chan []int16, 10)
+
+	handleSignals()
+
+	startStage(func() error {
+		return classify(exitInput, dcaReader(frames, opus))
+	}, func() {
+		close(opus)
+	})
+
+	// frames are played as they are read, or at a steady pace through a
+	// jitter buffer
+	played := (<-chan []byte)(opus)
+	if JitterFrames > 0 {
+		buffered := make(chan []byte, 10)
+		startStage(func() error {
+			return jitterBuffer(opus, buffered)
+		}, func() {
+			close(buffered)
+		})
+		played = buffered
+	}
+
+	if DecodeFormat == "ogg" {
+		startStage(func() error {
+			return classify(exitOutput, oggStreamWriter(played))
+		}, nil)
+	} else {
+		startStage(func() error {
+			return classify(exitEncode, decoder(played, pcm))
+		}, func() {
+			close(pcm)
+		})
+
+		startStage(func() error {
+			return classify(exitOutput, pcmWriter(pcm))
+		}, nil)
+	}
+
+	// wait for above goroutines to finish, then exit.
+	wg.Wait()
+
+	if err := failure(); err != nil {
+		reportError(errorCode(err), err)
+		exit()
+	}
+}
+
+// openInFile opens InFile for reading, or returns stdin for pipe:0
+func openInFile() (*os.File, error) {
+
+	if InFile == "pipe:0" {
+		return os.Stdin, nil
+	}
+
+	return os.Open(InFile)
+}
+
+// emitMetadata writes the metadata of the file being decoded as a line of
+// json to an open file descriptor given as fd:N, or to a file, so a player
+// can show it before any pcm arrives. Raw streams have no metadata and
+// write null.
+func emitMetadata(target string, metadata *MetadataStruct) error {
+
+	var f *os.File
+	var err error
+
+	if strings.HasPrefix(target, "fd:") {
+		f, err = openPipe(target)
+	} else {
+		f, err = os.Create(target)
+	}
+	if err != nil {
+		return err
+	}
+
+	// stdout and stderr stay open, anything else is closed so the reader
+	// sees the end of the metadata
+	if f.Fd() > 2 {
+		defer f.Close()
+	}
+
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(append(data, '\n'))
+	return err
+}
+
+// readInput wraps a DCA stream in a buffered reader and reads its header.
+// Streams without magic bytes are raw opus frames and keep the settings
+// from the flags, everything else is decoded with the settings it was
+// encoded with.
+func readInput(input io.Reader) (*bufio.Reader, error) {
+
+	// 16KB input buffer
+	rbuf := bufio.NewReaderSize(input, 16384)
+
+	magic, err := rbuf.Peek(len(MagicBytes))
+	if err != nil || string(magic) != MagicBytes {
+		return rbuf, nil
+	}
+
+	InMetadata, err = dcaenc.ReadHeader(rbuf)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(InMetadata.Streams) > 0 {
+		return nil, fmt.Errorf("multitrack files must be split with dca demux first")
+	}
+
+	if InMetadata.Opus != nil {
+		FrameRate = InMetadata.Opus.SampleRate
+		Channels = InMetadata.Opus.Channels
+		FrameSize = InMetadata.Opus.FrameSize
+	}
+
+	return rbuf, nil
+}
+
+// seekIndex returns the seek index of a file, nil if it has none
+func seekIndex(metadata *MetadataStruct) *SeekIndex {
+
+	if metadata == nil || metadata.Extra == nil {
+		return nil
+	}
+
+	return metadata.Extra.Index
+}
+
+// skipFrames moves past the first n frames of a stream read through
+// frames, which reads from rbuf. Files and mapped files are scanned by
+// reading only the length of each frame and seeking over its data,
+// starting from the last entry of index before the frame if there is one.
+// Anything else has to be read through.
+func skipFrames(input io.Reader, rbuf *bufio.Reader, frames *dcaenc.FrameReader, index *SeekIndex, n int) error {
+
+	var size int64 = -1
+	switch in := input.(type) {
+	case *bytes.Reader:
+		size = in.Size()
+	case *os.File:
+		if fi, err := in.Stat(); err == nil && fi.Mode().IsRegular() {
+			size = fi.Size()
+		}
+	}
+
+	seeker, ok := input.(interface {
+		io.ReaderAt
+		io.Seeker
+	})
+
+	// the scan starts at the entry of the index before the frame, which
+	// is never a repeat or in the middle of a group
+	start, offset := 0, int64(0)
+	if index != nil {
+		start, offset = index.Lookup(n)
+	}
+
+	// whole groups of frames are skipped along with their parity, and the
+	// rest read so that the group they are in can still be repaired
+	parity := frames.Parity()
+	rest := 0
+	if parity > 0 && size >= 0 && ok {
+		rest = n % parity
+		n = n / parity * (parity + 1)
+		start = start / parity * (parity + 1)
+	}
+
+	if size < 0 || !ok {
+		for i := 0; i < n; i++ {
+			_, err := frames.ReadFrame()
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return fmt.Errorf("input only has %d frames", i)
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	// the position of the next frame is wherever the file is, less what
+	// rbuf has read ahead
+	pos, err := seeker.Seek(0, os.SEEK_CUR)
+	if err != nil {
+		return err
+	}
+	pos -= int64(rbuf.Buffered()) - offset
+
+	// where the last frame skipped is, and how many of the repeats of it
+	// are left over, for repeat markers
+	lastPos, lastLen := int64(-1), 0
+	repeat := 0
+
+	lenbuf := make([]byte, 2)
+	for i := start; i < n; {
+		_, err = seeker.ReadAt(lenbuf, pos)
+		if err == io.EOF {
+			return fmt.Errorf("input only has %d frames", i)
+		}
+		if err != nil {
+			return err
+		}
+
+		opuslen := int16(binary.LittleEndian.Uint16(lenbuf))
+		pos += 2
+
+		// a repeat marker stands for -opuslen frames, of which only some
+		// may be skipped
+		if opuslen < 0 {
+			if lastPos < 0 {
+				return fmt.Errorf("repeat marker before the first frame")
+			}
+
+			i -= int(opuslen)
+			if i > n {
+				repeat = i - n
+			}
+			continue
+		}
+
+		lastPos, lastLen = pos, int(opuslen)
+		pos += int64(opuslen)
+		if pos > size {
+			return fmt.Errorf("input only has %d frames", i)
+		}
+		i++
+	}
+
+	if lastPos >= 0 {
+		last := make([]byte, lastLen)
+		_, err = seeker.ReadAt(last, lastPos)
+		if err != nil {
+			return err
+		}
+		frames.Skipped(last, repeat)
+	}
+
+	_, err = seeker.Seek(pos, os.SEEK_SET)
+	if err != nil {
+		return err
+	}
+	rbuf.Reset(input)
+
+	for i := 0; i < rest; i++ {
+		_, err := frames.ReadFrame()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return fmt.Errorf("input only has %d frames", n/(parity+1)*parity+i)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// dcaReader reads opus frames from a DCA stream and sends them to the
+// decoder, stopping after the frame StopSample falls in
+func dcaReader(frames *dcaenc.FrameReader, out chan<- []byte) error {
+
+	for frame := StartFrame; StopSample < 0 || frame*FrameSize < StopSample; frame++ {
+		opus, err := frames.ReadFrame()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error reading input: %s", err)
+		}
+
+		select {
+		case out <- opus:
+		case <-quit:
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// jitterBuffer passes the frames it receives on at the pace they play at,
+// through a jitter buffer that absorbs irregular arrival. A nil frame is
+// sent on when the buffer has run dry.
+func jitterBuffer(in <-chan []byte, out chan<- []byte) error {
+
+	frame := time.Duration(FrameSize) * time.Second / time.Duration(FrameRate)
+
+	buffer, err := dcaenc.NewJitterBuffer(frame, JitterFrames, JitterMax, JitterAdaptive)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for opus := range in {
+			buffer.Push(opus)
+		}
+		buffer.Close()
+	}()
+
+	for {
+		opus, err := buffer.Pop()
+		if err == io.EOF {
+			return nil
+		}
+
+		select {
+		case out <- opus:
+		case <-quit:
+			return nil
+		}
+	}
+}
+
+// decoder decodes the opus frames it receives to pcm16, converting it to
+// the output channels and sample rate before sending it on
+func decoder(in <-chan []byte, out chan<- []int16) error {
+
+	resample := newResampler(FrameRate, OutFrameRate, OutChannels)
+	gain := math.Pow(10, Gain/20)
+
+	// samples per channel decoded so far, counted from the start of the
+	// file, and the part of them that is the input
+	position := StartFrame * FrameSize
+	ranges := trimRanges()
+
+	for {
+		opus, ok := <-in
+		if !ok {
+			// if chan closed, exit
+			return nil
+		}
+
+		// a frame the jitter buffer didn't have in time plays as silence,
+		// which isn't part of the file so isn't trimmed
+		if opus == nil {
+			pcm := remix(make([]int16, FrameSize*Channels), Channels, OutChannels, 0)
+			select {
+			case out <- resample.Resample(pcm):
+			case <-quit:
+				return nil
+			}
+			continue
+		}
+
+		pcm, err := OpusDecoder.Decode(opus, FrameSize, false)
+		if err != nil {
+			return fmt.Errorf("Decoding Error: %s", err)
+		}
+
+		// drop the encoder delay and the padding of the last frame, and
+		// of each run appended, keeping the input in place
+		n := len(pcm) / Channels
+		kept := 0
+		for _, r := range ranges {
+			start, end := r.from-position, n
+			if r.to >= 0 && r.to-position < end {
+				end = r.to - position
+			}
+			if StopSample >= 0 && StopSample-position < end {
+				end = StopSample - position
+			}
+			if start < 0 {
+				start = 0
+			}
+			if start < end {
+				copy(pcm[kept*Channels:], pcm[start*Channels:end*Channels])
+				kept += end - start
+			}
+		}
+		position += n
+
+		if kept == 0 {
+			continue
+		}
+		pcm = pcm[:kept*Channels]
+
+		if Gain != 0 || SoftClip {
+			applyGain(pcm, gain, SoftClip)
+		}
+
+		pcm = remix(pcm, Channels, OutChannels, 0)
+		select {
+		case out <- resample.Resample(pcm):
+		case <-quit:
+			return nil
+		}
+	}
+}
+
+// audioRange is a run of the decoded samples per channel that holds input.
+// The end is -1 if it is unknown.
+type audioRange struct {
+	from, to int
+}
+
+// trimRanges returns the runs of the decoded audio that hold the input,
+// leaving out the encoder delay at the start and the padding at the end
+// when the metadata records them, and the same at each seam of a file
+// appended to
+func trimRanges() []audioRange {
+
+	if InMetadata == nil || InMetadata.Opus == nil {
+		return []audioRange{{0, -1}}
+	}
+
+	from := InMetadata.Opus.PreSkip * FrameRate / 48000
+
+	if InMetadata.Extra == nil || InMetadata.Extra.Samples == 0 {
+		return []audioRange{{from, -1}}
+	}
+
+	// the first run holds whatever the appended runs don't
+	samples := InMetadata.Extra.Samples
+	for _, seam := range InMetadata.Extra.Seams {
+		samples -= seam.Samples
+	}
+
+	ranges := []audioRange{{from, from + samples}}
+	for _, seam := range InMetadata.Extra.Seams {
+		from = seam.Frame*FrameSize + seam.PreSkip*FrameRate/48000
+		ranges = append(ranges, audioRange{from, from + seam.Samples})
+	}
+
+	return ranges
+}
+
+// decodedSample returns where sample n of the input is in the decoded
+// audio, counted in samples per channel
+func decodedSample(ranges []audioRange, n int) int {
+
+	for _, r := range ranges {
+		if r.to < 0 || n < r.to-r.from {
+			return r.from + n
+		}
+		n -= r.to - r.from
+	}
+
+	last := ranges[len(ranges)-1]
+	return last.to + n
+}
+
+// inputSample returns how much of the input comes before a point of the
+// decoded audio, the inverse of decodedSample
+func inputSample(ranges []audioRange, position int) int {
+
+	n := 0
+	for _, r := range ranges {
+		if position <= r.from {
+			break
+		}
+		if r.to < 0 || position < r.to {
+			return n + position - r.from
+		}
+		n += r.to - r.from
+	}
+
+	return n
+}
+
+// pcmWriter writes the pcm it receives to the output in the requested
+// sample format, after a wav header with -f wav
+func pcmWriter(in <-chan []int16) error {
+
+	// 16KB output buffer
+	wbuf := bufio.NewWriterSize(Output, 16384)
+
+	if DecodeFormat == "wav" {
+		_, err := wbuf.Write(wavHeader(OutFrameRate, OutChannels, PCMFormat, -1))
+		if err != nil {
+			return fmt.Errorf("error writing output: %s", err)
+		}
+	}
+
+	var size int64
+	for pcm := range in {
+		var err error
+		switch PCMFormat {
+		case "s32le":
+			err = binary.Write(wbuf, binary.LittleEndian, pcmToS32(pcm))
+			size += int64(len(pcm)) * 4
+		case "f32le":
+			err = binary.Write(wbuf, binary.LittleEndian, pcmToF32(pcm))
+			size += int64(len(pcm)) * 4
+		default:
+			err = binary.Write(wbuf, binary.LittleEndian, pcm)
+			size += int64(len(pcm)) * 2
+		}
+		if err != nil {
+			return fmt.Errorf("error writing output: %s", err)
+		}
+	}
+
+	err := wbuf.Flush()
+	if err != nil {
+		return fmt.Errorf("error writing output: %s", err)
+	}
+
+	// the header of a wav file gets the size of the audio once it's known,
+	// piped wav keeps the header that says it runs to the end
+	if DecodeFormat == "wav" {
+		if fi, err := Output.Stat(); err == nil && fi.Mode().IsRegular() {
+			_, err = Output.WriteAt(wavHeader(OutFrameRate, OutChannels, PCMFormat, size), 0)
+			if err != nil {
+				return fmt.Errorf("error updating wav header: %s", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// oggStreamWriter writes the opus frames it receives to the output as an
+// Ogg Opus stream, with granule positions and pre-skip set for players and
+// voice clients that take Ogg Opus
+func oggStreamWriter(in <-chan []byte) error {
+
+	metadata := InMetadata
+	if metadata == nil || metadata.Opus == nil {
+		metadata = &MetadataStruct{
+			Opus: &OpusMetadata{
+				SampleRate:  FrameRate,
+				Application: "audio",
+				FrameSize:   FrameSize,
+				Channels:    Channels,
+			},
+		}
+	}
+
+	// pages go straight out when paced, as they are wanted right away
+	var w io.Writer = Output
+	var wbuf *bufio.Writer
+	if !Realtime {
+		wbuf = bufio.NewWriterSize(Output, 16384)
+		w = wbuf
+	}
+
+	ogg := newOggWriter(w, crc32.ChecksumIEEE([]byte(InFile)))
+	ogg.pagePackets = PageFrames
+	if StartFrame == 0 && StopSample < 0 {
+		ogg.end = oggEnd(metadata)
+	}
+
+	err := ogg.WriteHeaders(opusHead(metadata.Opus), opusTags(metadata))
+	if err != nil {
+		return fmt.Errorf("error writing output: %s", err)
+	}
+
+	// granule positions are always counted at 48kHz
+	samples := FrameSize * 48000 / FrameRate
+	frame := time.Duration(FrameSize) * time.Second / time.Duration(FrameRate)
+	start := time.Now()
+	played := time.Duration(0)
+
+	for opus := range in {
+		if Realtime {
+			time.Sleep(played - time.Since(start))
+			played += frame
+		}
+
+		err = ogg.WritePacket(opus, samples)
+		if err != nil {
+			return fmt.Errorf("error writing output: %s", err)
+		}
+	}
+
+	err = ogg.Close()
+	if err == nil && wbuf != nil {
+		err = wbuf.Flush()
+	}
+	if err != nil {
+		return fmt.Errorf("error writing output: %s", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+)
+
+// duplicateGroup is a set of files with the same audio, the first of which
+// is the one kept
+type duplicateGroup struct {
+	Checksum string   `json:"checksum"`
+	Files    []string `json:"files"`
+}
+
+// dedupeCmd implements "dca dedupe" which finds DCA files whose frames are
+// identical, whatever their names or metadata, and optionally replaces
+// the copies with hard links to one of them or removes them
+func dedupeCmd(args []string) {
+
+	var db string
+	var jobs int
+	var link, remove, asJSON bool
+
+	fs := flag.NewFlagSet("dedupe", flag.ExitOnError)
+	fs.StringVar(&db, "db", "", "catalog to take checksums from instead of scanning the folders")
+	fs.IntVar(&jobs, "jobs", runtime.NumCPU(), "number of files to scan at once")
+	fs.BoolVar(&link, "link", false, "replace each copy with a hard link to the file kept")
+	fs.BoolVar(&remove, "remove", false, "remove each copy, keeping one file of each group")
+	fs.BoolVar(&asJSON, "json", false, "print the groups of duplicates as a json array")
+	fs.Parse(args)
+
+	if link && remove {
+		reportError(exitUsage, "error: -link can not be used with -remove")
+		return
+	}
+
+	dirs := fs.Args()
+	if len(dirs) == 0 && db == "" {
+		reportError(exitUsage, "error: dedupe requires a folder or -db")
+		return
+	}
+
+	var entries []*IndexEntry
+	var err error
+	if db != "" {
+		entries, err = findInCatalog(db, dirs, CatalogQuery{})
+	} else {
+		for _, dir := range dirs {
+			abs, err := filepath.Abs(dir)
+			if err != nil {
+				reportError(exitFailure, "error:", err)
+				exit()
+			}
+			entries = append(entries, scanLibrary(abs, jobs, func(file string) string { return file }, nil)...)
+		}
+	}
+	if err != nil {
+		reportError(exitFailure, "error:", err)
+		exit()
+	}
+
+	groups := findDuplicates(entries)
+
+	if asJSON {
+		if groups == nil {
+			groups = []*duplicateGroup{}
+		}
+
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(groups)
+	} else {
+		for i, group := range groups {
+			if i > 0 {
+				fmt.Println()
+			}
+			for _, file := range group.Files {
+				fmt.Printf("%s\t%s\n", group.Checksum, file)
+			}
+		}
+	}
+
+	if !link && !remove {
+		return
+	}
+
+	failed := false
+	for _, group := range groups {
+		for _, file := range group.Files[1:] {
+			err := replaceDuplicate(group.Files[0], file, link)
+			if err != nil {
+				reportError(exitOutput, "error:", file+":", err)
+				failed = true
+			}
+		}
+	}
+
+	if failed {
+		exit()
+	}
+}
+
+// findDuplicates groups files with the same frames and opus settings,
+// returning only groups of more than one file. Each group is sorted by
+// path and the groups by their first file.
+func findDuplicates(entries []*IndexEntry) []*duplicateGroup {
+
+	byAudio := make(map[string]*duplicateGroup)
+
+	for _, entry := range entries {
+		if entry.Error != "" || entry.Checksum == "" || entry.Opus == nil {
+			continue
+		}
+
+		key := fmt.Sprintf("%s %d %d %d", entry.Checksum, entry.Opus.SampleRate, entry.Opus.Channels, entry.Opus.FrameSize)
+
+		group, ok := byAudio[key]
+		if !ok {
+			group = &duplicateGroup{Checksum: entry.Checksum}
+			byAudio[key] = group
+		}
+		group.Files = append(group.Files, entry.Path)
+	}
+
+	var groups []*duplicateGroup
+	for _, group := range byAudio {
+		if len(group.Files) > 1 {
+			sort.Strings(group.Files)
+			groups = append(groups, group)
+		}
+	}
+
+	sort.Sort(byFirstFile(groups))
+
+	return groups
+}
+
+// replaceDuplicate replaces file with a hard link to kept, or removes it,
+// once it has checked the frames of both really are the same rather than
+// trusting the checksums they were grouped by
+func replaceDuplicate(kept, file string, link bool) error {
+
+	a, err := os.Stat(kept)
+	if err != nil {
+		return err
+	}
+	b, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+
+	// already one file
+	if os.SameFile(a, b) {
+		return nil
+	}
+
+	keptSum, err := frameChecksum(kept)
+	if err != nil {
+		return err
+	}
+	fileSum, err := frameChecksum(file)
+	if err != nil {
+		return err
+	}
+	if keptSum != fileSum {
+		return fmt.Errorf("frames differ from %s, checksums are out of date", kept)
+	}
+
+	if !link {
+		return os.Remove(file)
+	}
+
+	// link beside the copy then move it over, so the copy is never missing
+	tmp := file + ".dca-link"
+	err = os.Link(kept, tmp)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmp, file)
+	if err != nil {
+		os.Remove(tmp)
+	}
+
+	return err
+}
+
+// frameChecksum reads every frame of a DCA file and returns their checksum
+func frameChecksum(path string) (string, error) {
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	scan, err := scanFile(f)
+	if err != nil {
+		return "", err
+	}
+
+	return readChecksum(f, scan)
+}
+
+// byFirstFile sorts groups of duplicates by the path of their first file
+type byFirstFile []*duplicateGroup
+
+func (g byFirstFile) Len() int           { return len(g) }
+func (g byFirstFile) Less(i, j int) bool { return g[i].Files[0] < g[j].Files[0] }
+func (g byFirstFile) Swap(i, j int)      { g[i], g[j] = g[j], g[i] }
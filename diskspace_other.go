@@ -0,0 +1,13 @@
+//go:build !linux && !darwin && !freebsd && !dragonfly
+// +build !linux,!darwin,!freebsd,!dragonfly
+
+package main
+
+import (
+	"fmt"
+)
+
+// freeSpace is not supported on this platform
+func freeSpace(path string) (int64, error) {
+	return 0, fmt.Errorf("not supported on this platform")
+}
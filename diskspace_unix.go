@@ -0,0 +1,22 @@
+//go:build linux || darwin || freebsd || dragonfly
+// +build linux darwin freebsd dragonfly
+
+package main
+
+import (
+	"syscall"
+)
+
+// freeSpace returns the bytes free to unprivileged users on the filesystem
+// holding path
+func freeSpace(path string) (int64, error) {
+
+	var st syscall.Statfs_t
+
+	err := syscall.Statfs(path, &st)
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
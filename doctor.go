@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/layeh/gopus"
+)
+
+// doctorCmd implements "dca doctor" which checks that everything dca needs
+// is installed and working
+func doctorCmd(args []string) {
+
+	fs := flag.NewFlagSet("doctor", flag.ExitOnError)
+	fs.Parse(args)
+
+	ok := true
+
+	for _, tool := range []string{"ffmpeg", "ffprobe"} {
+		version, err := toolVersion(tool)
+		if err != nil {
+			fmt.Printf("%-10s FAIL %s\n", tool+":", err)
+			ok = false
+			continue
+		}
+
+		fmt.Printf("%-10s ok   %s\n", tool+":", version)
+	}
+
+	err := roundTrip()
+	if err != nil {
+		fmt.Printf("%-10s FAIL %s\n", "opus:", err)
+		ok = false
+	} else {
+		fmt.Printf("%-10s ok   encoded and decoded a 1s test tone\n", "opus:")
+	}
+
+	if !ok {
+		os.Exit(1)
+	}
+}
+
+// toolVersion runs an external tool with -version and returns the first
+// line it prints
+func toolVersion(tool string) (string, error) {
+
+	path, err := exec.LookPath(tool)
+	if err != nil {
+		return "", fmt.Errorf("not found in PATH")
+	}
+
+	var out bytes.Buffer
+
+	cmd := exec.Command(path, "-version")
+	cmd.Stdout = &out
+
+	err = cmd.Run()
+	if err != nil {
+		return "", fmt.Errorf("%s -version failed: %s", path, err)
+	}
+
+	return strings.TrimSpace(strings.SplitN(out.String(), "\n", 2)[0]), nil
+}
+
+// roundTrip encodes a second of tone with libopus using the default
+// settings, decodes it again and checks the level survived
+func roundTrip() error {
+
+	const (
+		rate      = 48000
+		channels  = 2
+		frameSize = 960
+	)
+
+	encoder, err := gopus.NewEncoder(rate, channels, gopus.Audio)
+	if err != nil {
+		return fmt.Errorf("NewEncoder: %s", err)
+	}
+	encoder.SetBitrate(64000)
+
+	decoder, err := gopus.NewDecoder(rate, channels)
+	if err != nil {
+		return fmt.Errorf("NewDecoder: %s", err)
+	}
+
+	var in, out float64
+
+	for n := 0; n < rate; n += frameSize {
+		pcm := make([]int16, frameSize*channels)
+		for i := 0; i < frameSize; i++ {
+			s := int16(signalLevel * 32767 * math.Sin(2*math.Pi*440*float64(n+i)/rate))
+			pcm[i*channels] = s
+			pcm[i*channels+1] = s
+		}
+
+		opus, err := encoder.Encode(pcm, frameSize, frameSize*channels*2)
+		if err != nil {
+			return fmt.Errorf("Encode: %s", err)
+		}
+
+		decoded, err := decoder.Decode(opus, frameSize, false)
+		if err != nil {
+			return fmt.Errorf("Decode: %s", err)
+		}
+
+		if len(decoded) != len(pcm) {
+			return fmt.Errorf("decoded %d samples from a %d sample frame", len(decoded), len(pcm))
+		}
+
+		for i := range pcm {
+			in += float64(pcm[i]) * float64(pcm[i])
+			out += float64(decoded[i]) * float64(decoded[i])
+		}
+	}
+
+	// opus is lossy, but the level of a plain tone should be within 1 dB
+	diff := 10 * math.Log10(out/in)
+	if math.Abs(diff) > 1 {
+		return fmt.Errorf("level changed by %.1f dB", diff)
+	}
+
+	return nil
+}
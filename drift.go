@@ -0,0 +1,96 @@
+package main
+
+import (
+	"time"
+)
+
+// driftHorizon is how long the drift correction aims to take to get back
+// in step with the wall clock, before its rate is capped
+const driftHorizon = 10 * time.Second
+
+// driftCorrector returns a pcm stage for live inputs whose clock runs a
+// little fast or slow compared to the wall clock. The audio is resampled
+// by up to maxPPM parts per million so that, over a long recording, the
+// output stays as long as the time that actually passed.
+func driftCorrector(maxPPM int) pcmStage {
+
+	return func(in <-chan []int16, out chan<- []int16) error {
+
+		var start time.Time
+
+		// input not resampled yet, and the position in it of the next
+		// output sample, both in samples per channel
+		var pending []int16
+		pos := 0.0
+
+		step := 1.0
+		limit := float64(maxPPM) / 1e6
+		produced := 0
+
+		frame := make([]int16, 0, FrameSize*Channels)
+
+		for pcm := range in {
+			if start.IsZero() {
+				start = time.Now()
+			}
+
+			pending = append(pending, pcm...)
+			n := len(pending) / Channels
+
+			for pos+1 < float64(n) {
+				i := int(pos)
+				frac := pos - float64(i)
+
+				for c := 0; c < Channels; c++ {
+					a := float64(pending[i*Channels+c])
+					b := float64(pending[(i+1)*Channels+c])
+					frame = append(frame, int16(a+(b-a)*frac))
+				}
+				pos += step
+
+				if len(frame) < cap(frame) {
+					continue
+				}
+
+				select {
+				case out <- frame:
+				case <-quit:
+					return nil
+				}
+				frame = make([]int16, 0, FrameSize*Channels)
+				produced += FrameSize
+
+				// the first frame was already captured when it arrived
+				elapsed := time.Since(start).Seconds()*float64(FrameRate) + float64(FrameSize)
+				ahead := (float64(produced) - elapsed) / float64(FrameRate)
+
+				correction := ahead / driftHorizon.Seconds()
+				if correction > limit {
+					correction = limit
+				} else if correction < -limit {
+					correction = -limit
+				}
+				step = 1 + correction
+			}
+
+			drop := int(pos)
+			pending = append(pending[:0], pending[drop*Channels:]...)
+			pos -= float64(drop)
+		}
+
+		// whatever is left is padded out to one last frame, which replaces
+		// the padding of the source
+		EndPadding = 0
+		if len(frame) > 0 {
+			EndPadding = FrameSize - len(frame)/Channels
+			frame = frame[:cap(frame)]
+
+			select {
+			case out <- frame:
+			case <-quit:
+			}
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/bwmarrin/dca/dcaenc"
+)
+
+// scanFrames counts the frames of a DCA file from where its header ends by
+// reading only their lengths and seeking over their data. Repeat markers
+// count for the frames they stand for and parity frames don't count. Along
+// with the number of frames it returns the frames of the longest stream,
+// which for anything but a multitrack file is all of them. A frame cut
+// short at the end of the file isn't counted.
+func scanFrames(r io.ReaderAt, size int64, offset int64, metadata *MetadataStruct) (int, int, error) {
+
+	multitrack := len(metadata.Streams) > 0
+	perStream := make(map[byte]int)
+
+	prefix := 2
+	if multitrack {
+		prefix = 3
+	}
+	buf := make([]byte, prefix)
+
+	frames := 0
+	physical := 0
+	pos := offset
+	for pos+int64(prefix) <= size {
+		_, err := r.ReadAt(buf, pos)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		opuslen := int16(binary.LittleEndian.Uint16(buf[prefix-2:]))
+		pos += int64(prefix)
+
+		if opuslen < 0 {
+			if multitrack || physical == 0 {
+				return 0, 0, fmt.Errorf("invalid frame length %d", opuslen)
+			}
+			frames -= int(opuslen)
+			continue
+		}
+
+		pos += int64(opuslen)
+		if pos > size {
+			break
+		}
+
+		frames++
+		physical++
+
+		if multitrack {
+			perStream[buf[0]]++
+		}
+	}
+
+	if multitrack {
+		longest := 0
+		for _, n := range perStream {
+			if n > longest {
+				longest = n
+			}
+		}
+		return frames, longest, nil
+	}
+
+	// every group ends with its parity frame, the last one included
+	if group := parityGroup(metadata); group > 0 {
+		frames -= (physical + group) / (group + 1)
+	}
+
+	return frames, frames, nil
+}
+
+// durationCmd implements "dca duration" which prints how long DCA files
+// are in milliseconds, scanning their frames for files whose metadata
+// doesn't say
+func durationCmd(args []string) {
+
+	var write bool
+
+	fs := flag.NewFlagSet("duration", flag.ExitOnError)
+	fs.BoolVar(&write, "write", false, "write the duration and frame count into the metadata")
+	fs.Parse(args)
+
+	files := fs.Args()
+	if len(files) == 0 {
+		reportError(exitUsage, "error: no files given")
+		return
+	}
+
+	failed := false
+	for _, file := range files {
+		duration, err := fileDuration(file, write)
+		if err != nil {
+			reportError(errorCode(classify(exitInput, err)), "error:", file+":", err)
+			failed = true
+			continue
+		}
+
+		if len(files) > 1 {
+			fmt.Printf("%d\t%s\n", duration, file)
+		} else {
+			fmt.Println(duration)
+		}
+	}
+
+	if failed {
+		exit()
+	}
+}
+
+// fileScan is what a scan of the frame lengths of a DCA file finds out
+// about it
+type fileScan struct {
+	metadata *MetadataStruct
+	length   int32 // of the json block
+
+	frames   int
+	longest  int
+	duration int // milliseconds
+}
+
+// scanFile reads the header of f and scans its frame lengths
+func scanFile(f *os.File) (*fileScan, error) {
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	metadata, err := dcaenc.ReadHeader(bufio.NewReader(io.NewSectionReader(f, 0, fi.Size())))
+	if err != nil {
+		return nil, fmt.Errorf("error reading header: %s", err)
+	}
+
+	if metadata.Opus == nil || metadata.Opus.SampleRate <= 0 {
+		return nil, fmt.Errorf("no opus metadata")
+	}
+
+	length, err := metadataLength(f)
+	if err != nil {
+		return nil, err
+	}
+
+	// files are read straight from memory when they can be mapped
+	var r io.ReaderAt = f
+	if data, err := mapFile(f); err == nil {
+		defer unmapFile(data)
+		r = bytes.NewReader(data)
+	}
+
+	frames, longest, err := scanFrames(r, fi.Size(), headerOffset+int64(length), metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	// the exact length is only known to whoever encoded the file, as long
+	// as it still has all of its frames
+	samples := longest * metadata.Opus.FrameSize
+	if metadata.Extra != nil && metadata.Extra.Samples > 0 && metadata.Extra.Samples <= samples {
+		samples = metadata.Extra.Samples
+	}
+
+	return &fileScan{
+		metadata: metadata,
+		length:   length,
+		frames:   frames,
+		longest:  longest,
+		duration: int(int64(samples) * 1000 / int64(metadata.Opus.SampleRate)),
+	}, nil
+}
+
+// fileDuration returns the duration of a DCA file in milliseconds from a
+// scan of its frames, and writes it into the metadata if write is set
+func fileDuration(file string, write bool) (int, error) {
+
+	mode := os.O_RDONLY
+	if write {
+		mode = os.O_RDWR
+	}
+
+	f, err := os.OpenFile(file, mode, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	scan, err := scanFile(f)
+	if err != nil {
+		return 0, err
+	}
+
+	if write {
+		metadata := scan.metadata
+		if metadata.Extra == nil {
+			metadata.Extra = &ExtraMetadata{}
+		}
+		metadata.Extra.Duration = scan.duration
+		metadata.Extra.Frames = scan.frames
+
+		err = replaceMetadata(f, metadata, scan.length)
+		if err != nil {
+			return 0, classify(exitOutput, fmt.Errorf("error updating header: %s", err))
+		}
+	}
+
+	return scan.duration, nil
+}
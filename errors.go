@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Exit codes dca ends with, by the class of what went wrong, so a bot
+// running it can tell a bad request from a broken setup
+const (
+	exitFailure = 1 // anything not covered below
+	exitUsage   = 2 // invalid or conflicting flags
+	exitInput   = 3 // an input is missing or can't be read
+	exitFFmpeg  = 4 // ffmpeg or ffprobe failed or couldn't be run
+	exitEncode  = 5 // libopus failed to encode or decode the audio
+	exitOutput  = 6 // the output couldn't be opened or written
+)
+
+// exitClasses name the exit codes in -errjson output
+var exitClasses = map[int]string{
+	exitFailure: "failure",
+	exitUsage:   "usage",
+	exitInput:   "input",
+	exitFFmpeg:  "ffmpeg",
+	exitEncode:  "encode",
+	exitOutput:  "output",
+}
+
+// ErrorJSON is set by -errjson to also write the error dca exits with to
+// stderr as a json object
+var ErrorJSON bool
+
+// exitCode is the code dca exits with, that of the first error recorded
+var exitCode int
+
+// errorReport is the json object -errjson writes for an error
+type errorReport struct {
+	Error string `json:"error"`
+	Class string `json:"class"`
+	Code  int    `json:"code"`
+}
+
+// classError is an error that knows its exit code
+type classError struct {
+	code int
+	err  error
+}
+
+// Error implements error
+func (e *classError) Error() string {
+	return e.err.Error()
+}
+
+// classify returns err with the exit code of a class, unless it already
+// has one from closer to where it happened. A nil err stays nil.
+func classify(code int, err error) error {
+
+	if err == nil {
+		return nil
+	}
+
+	if _, ok := err.(*classError); ok {
+		return err
+	}
+
+	return &classError{code: code, err: err}
+}
+
+// errorCode returns the exit code of err's class
+func errorCode(err error) int {
+
+	if e, ok := err.(*classError); ok {
+		return e.code
+	}
+
+	return exitFailure
+}
+
+// errorLock guards exitCode, for stages and jobs that report errors of
+// their own
+var errorLock sync.Mutex
+
+// reportError prints an error like fmt.Println, but to stderr as stdout may
+// be carrying the output, and makes dca exit with the code of its class
+func reportError(code int, a ...interface{}) {
+
+	fmt.Fprintln(os.Stderr, a...)
+	recordError(code, strings.TrimSpace(fmt.Sprintln(a...)))
+}
+
+// recordError makes dca exit with code for an error that has already been
+// printed, and writes it to stderr as json with -errjson. Only the first
+// error is recorded, as the rest usually follow from it.
+func recordError(code int, msg string) {
+
+	errorLock.Lock()
+	defer errorLock.Unlock()
+
+	if exitCode != 0 {
+		return
+	}
+	exitCode = code
+
+	if ErrorJSON {
+		json.NewEncoder(os.Stderr).Encode(&errorReport{
+			Error: strings.TrimPrefix(msg, "error: "),
+			Class: exitClasses[code],
+			Code:  code,
+		})
+	}
+}
+
+// exit ends dca with the exit code of the first error reported. It is
+// deferred first in main, so everything else main deferred has run.
+func exit() {
+
+	if exitCode != 0 {
+		os.Exit(exitCode)
+	}
+}
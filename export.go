@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/bwmarrin/dca/dcaenc"
+)
+
+// exportCmd implements "dca export" which remuxes DCA files to another
+// container without re-encoding the audio
+func exportCmd(args []string) {
+
+	var format string
+	var jobs int
+	var resume bool
+
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	fs.StringVar(&InFile, "i", "", "DCA file or folder of DCA files to export")
+	fs.StringVar(&OutFile, "o", "", "file or folder to write the exported files to")
+	fs.StringVar(&format, "f", "ogg", "format to export to, only ogg is supported")
+	fs.IntVar(&jobs, "jobs", runtime.NumCPU(), "number of files to export at once")
+	fs.BoolVar(&resume, "resume", false, "skip files an interrupted export of the same folder already finished")
+	fs.IntVar(&Nice, "nice", 0, "scheduling priority, from -20 (highest) to 19 (lowest)")
+	fs.StringVar(&IONice, "ionice", "", "I/O priority on linux, idle or best-effort[:0-7]")
+	fs.Parse(args)
+
+	err := lowerPriority(Nice, IONice)
+	if err != nil {
+		reportError(exitFailure, err)
+		return
+	}
+
+	if InFile == "" || OutFile == "" {
+		reportError(exitUsage, "error: export requires -i and -o")
+		fs.Usage()
+		return
+	}
+
+	if format != "ogg" {
+		reportError(exitUsage, "error: unknown export format", format)
+		return
+	}
+
+	fi, err := os.Stat(InFile)
+	if err != nil {
+		reportError(exitInput, "error:", err)
+		return
+	}
+
+	// a single file is exported straight to the outfile
+	if !fi.IsDir() {
+		err = exportOgg(InFile, OutFile)
+		if err != nil {
+			reportError(errorCode(err), "error exporting", InFile+":", err)
+		}
+		return
+	}
+
+	err = os.MkdirAll(OutFile, 0755)
+	if err != nil {
+		reportError(exitOutput, "error:", err)
+		return
+	}
+
+	state, err := openExportState(filepath.Join(OutFile, exportStateFile), resume)
+	if err != nil {
+		reportError(exitFailure, "error opening export state:", err)
+		return
+	}
+	defer state.Close()
+
+	files := make(chan string)
+
+	var exportWg sync.WaitGroup
+	for i := 0; i < jobs; i++ {
+		exportWg.Add(1)
+		go func() {
+			defer exportWg.Done()
+
+			for file := range files {
+				rel, _ := filepath.Rel(InFile, file)
+				out := filepath.Join(OutFile, strings.TrimSuffix(rel, filepath.Ext(rel))+".ogg")
+
+				if state.Done(out) {
+					continue
+				}
+
+				err := classify(exitOutput, os.MkdirAll(filepath.Dir(out), 0755))
+				if err == nil {
+					err = exportOgg(file, out)
+				}
+				if err == nil {
+					err = classify(exitOutput, state.Finish(out))
+				}
+
+				// any file failing fails the export, once the rest are done
+				if err != nil {
+					reportError(errorCode(err), "error exporting", file+":", err)
+					continue
+				}
+
+				fmt.Println(out)
+			}
+		}()
+	}
+
+	filepath.Walk(InFile, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() && strings.EqualFold(filepath.Ext(path), ".dca") {
+			files <- path
+		}
+		return nil
+	})
+
+	close(files)
+	exportWg.Wait()
+}
+
+// exportOgg remuxes the DCA file in to an Ogg Opus file out
+func exportOgg(in, out string) error {
+
+	input, err := os.Open(in)
+	if err != nil {
+		return classify(exitInput, err)
+	}
+	defer input.Close()
+
+	rbuf := bufio.NewReaderSize(input, 16384)
+
+	metadata, err := dcaenc.ReadHeader(rbuf)
+	if err != nil {
+		return classify(exitInput, err)
+	}
+
+	if metadata.Opus == nil {
+		return classify(exitInput, fmt.Errorf("no opus metadata"))
+	}
+
+	if len(metadata.Streams) > 0 {
+		return classify(exitUsage, fmt.Errorf("multitrack files must be split with dca demux first"))
+	}
+
+	output, err := os.Create(out)
+	if err != nil {
+		return classify(exitOutput, err)
+	}
+	defer output.Close()
+
+	wbuf := bufio.NewWriterSize(output, 16384)
+
+	ogg := newOggWriter(wbuf, crc32.ChecksumIEEE([]byte(out)))
+	ogg.end = oggEnd(metadata)
+
+	err = ogg.WriteHeaders(opusHead(metadata.Opus), opusTags(metadata))
+	if err != nil {
+		return classify(exitOutput, err)
+	}
+
+	// granule positions are always counted at 48kHz
+	samples := metadata.Opus.FrameSize * 48000 / metadata.Opus.SampleRate
+
+	frames := dcaenc.NewFrameReader(rbuf, metadata)
+
+	for {
+		opus, err := frames.ReadFrame()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return classify(exitInput, err)
+		}
+
+		err = ogg.WritePacket(opus, samples)
+		if err != nil {
+			return classify(exitOutput, err)
+		}
+	}
+
+	err = ogg.Close()
+	if err != nil {
+		return classify(exitOutput, err)
+	}
+
+	return classify(exitOutput, wbuf.Flush())
+}
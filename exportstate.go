@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// exportStateFile is kept in the output folder of a folder export and
+// lists every file that has been exported completely
+const exportStateFile = ".dca-export.state"
+
+// exportState records the outputs of a folder export as they finish, so
+// an interrupted export can be resumed. Each line holds the size and SHA-1
+// of an output file followed by its path within the output folder.
+type exportState struct {
+	sync.Mutex
+
+	dir  string
+	file *os.File
+	done map[string]string // path to "size sha1"
+}
+
+// openExportState opens the state file at path. When resuming, the outputs
+// it already lists are loaded, otherwise it is started afresh.
+func openExportState(path string, resume bool) (*exportState, error) {
+
+	state := &exportState{
+		dir:  filepath.Dir(path),
+		done: make(map[string]string),
+	}
+
+	flags := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	if resume {
+		f, err := os.Open(path)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+
+		if err == nil {
+			scanner := bufio.NewScanner(f)
+			for scanner.Scan() {
+				parts := strings.SplitN(scanner.Text(), " ", 3)
+				if len(parts) == 3 {
+					state.done[parts[2]] = parts[0] + " " + parts[1]
+				}
+			}
+			f.Close()
+
+			err = scanner.Err()
+			if err != nil {
+				return nil, err
+			}
+		}
+	} else {
+		flags |= os.O_TRUNC
+	}
+
+	var err error
+	state.file, err = os.OpenFile(path, flags, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return state, nil
+}
+
+// Done reports whether path was exported by an earlier run and is still
+// the same size with the same checksum
+func (s *exportState) Done(path string) bool {
+
+	s.Lock()
+	recorded, ok := s.done[s.key(path)]
+	s.Unlock()
+
+	if !ok {
+		return false
+	}
+
+	sum, err := fileSum(path)
+	if err != nil {
+		return false
+	}
+
+	return sum == recorded
+}
+
+// Finish records that path has been exported completely
+func (s *exportState) Finish(path string) error {
+
+	sum, err := fileSum(path)
+	if err != nil {
+		return err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	_, err = fmt.Fprintf(s.file, "%s %s\n", sum, s.key(path))
+	return err
+}
+
+// key returns the path of an output within the output folder, so a
+// resumed export finds it however the folder was named
+func (s *exportState) key(path string) string {
+
+	rel, err := filepath.Rel(s.dir, path)
+	if err != nil {
+		return path
+	}
+
+	return filepath.ToSlash(rel)
+}
+
+// Close closes the state file
+func (s *exportState) Close() error {
+	return s.file.Close()
+}
+
+// fileSum returns the size and hex SHA-1 of a file, separated by a space
+func fileSum(path string) (string, error) {
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hash := sha1.New()
+	size, err := io.Copy(hash, f)
+	if err != nil {
+		return "", err
+	}
+
+	return strconv.FormatInt(size, 10) + " " + hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"io"
+
+	"github.com/bwmarrin/dca/dcaenc"
+)
+
+// After every group of frames, files using parityExtension have a parity
+// frame, which starts with the number of frames in the group, then holds
+// the length and CRC-32 of each as a uint16 and uint32, and ends with the
+// XOR of all their data. Receivers of a stream sent over an unreliable
+// transport write an empty frame for any they lose, and a frame that is
+// missing or damaged is rebuilt from the rest of its group as long as it
+// is the only one.
+const (
+	parityExtension = "parity"
+
+	// the most frames one parity frame can cover
+	maxParity = 255
+)
+
+// parityGroup returns the frames per parity frame of a file, 0 if it has
+// none
+func parityGroup(metadata *MetadataStruct) int {
+
+	if metadata == nil || metadata.Dca == nil {
+		return 0
+	}
+
+	return metadata.Dca.Parity
+}
+
+// parityWriter writes frames to w with a parity frame after every group of
+// them, for -parity
+type parityWriter struct {
+	w     io.Writer
+	size  int
+	group [][]byte
+}
+
+// WriteFrame writes a frame, and the parity of its group once it is full
+func (pw *parityWriter) WriteFrame(opus []byte) error {
+
+	err := writeOutputFrame(pw.w, opus)
+	if err != nil {
+		return err
+	}
+
+	pw.group = append(pw.group, opus)
+	if len(pw.group) < pw.size {
+		return nil
+	}
+
+	return pw.Flush()
+}
+
+// Flush writes the parity of the frames written since the last one
+func (pw *parityWriter) Flush() error {
+
+	if len(pw.group) == 0 {
+		return nil
+	}
+
+	parity := dcaenc.ParityFrame(pw.group)
+	pw.group = pw.group[:0]
+
+	return dcaenc.WriteFrame(pw.w, parity)
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bwmarrin/dca/dcaenc"
+)
+
+// Match reports whether song info matches the query, which is the same
+// test Search makes in the catalog
+func (q CatalogQuery) Match(info *SongMetadata) bool {
+
+	if info == nil {
+		info = &SongMetadata{}
+	}
+
+	contains := func(s, sub string) bool {
+		return strings.Contains(strings.ToLower(s), strings.ToLower(sub))
+	}
+
+	all := strings.Join([]string{info.Title, info.Artist, info.Album, info.Genre}, " ")
+
+	return contains(info.Title, q.Title) && contains(info.Artist, q.Artist) &&
+		contains(info.Album, q.Album) && contains(info.Genre, q.Genre) &&
+		contains(all, q.Text)
+}
+
+// findCmd implements "dca find" which prints the DCA files below the
+// folders given whose song info matches, reading only their headers or
+// looking them up in a catalog
+func findCmd(args []string) {
+
+	var db string
+	var asJSON bool
+	var q CatalogQuery
+
+	fs := flag.NewFlagSet("find", flag.ExitOnError)
+	fs.StringVar(&q.Title, "title", "", "title contains")
+	fs.StringVar(&q.Artist, "artist", "", "artist contains")
+	fs.StringVar(&q.Album, "album", "", "album contains")
+	fs.StringVar(&q.Genre, "genre", "", "genre contains")
+	fs.StringVar(&q.Text, "text", "", "any of the title, artist, album or genre contains")
+	fs.StringVar(&db, "db", "", "catalog to look files up in instead of reading their headers")
+	fs.BoolVar(&asJSON, "json", false, "print the files as a json array")
+	fs.Parse(args)
+
+	dirs := fs.Args()
+	if len(dirs) == 0 && db == "" {
+		reportError(exitUsage, "error: find requires a folder or -db")
+		return
+	}
+
+	var found []*IndexEntry
+	var err error
+	if db != "" {
+		found, err = findInCatalog(db, dirs, q)
+	} else {
+		found, err = findInFolders(dirs, q)
+	}
+	if err != nil {
+		reportError(exitFailure, "error:", err)
+		exit()
+	}
+
+	if asJSON {
+		if found == nil {
+			found = []*IndexEntry{}
+		}
+
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(found)
+		return
+	}
+
+	for _, entry := range found {
+		fmt.Println(entry.Path)
+	}
+}
+
+// findInFolders returns the DCA files below dirs whose headers match q
+func findInFolders(dirs []string, q CatalogQuery) ([]*IndexEntry, error) {
+
+	var found []*IndexEntry
+
+	for _, dir := range dirs {
+		err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() || !strings.EqualFold(filepath.Ext(path), ".dca") {
+				return nil
+			}
+
+			metadata, err := readFileHeader(path)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "error reading", path+":", err)
+				return nil
+			}
+
+			if !q.Match(metadata.SongInfo) {
+				return nil
+			}
+
+			entry := &IndexEntry{
+				Path:    path,
+				Size:    info.Size(),
+				ModTime: info.ModTime().UnixNano(),
+				Opus:    metadata.Opus,
+			}
+
+			// covers are left out as they are with the index
+			if metadata.SongInfo != nil {
+				song := *metadata.SongInfo
+				song.Cover = nil
+				entry.Info = &song
+			}
+
+			if metadata.Extra != nil {
+				entry.Duration = metadata.Extra.Duration
+				entry.Frames = metadata.Extra.Frames
+				entry.Checksum = metadata.Extra.Checksum
+			}
+
+			found = append(found, entry)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return found, nil
+}
+
+// findInCatalog returns the files of the catalog at path below dirs, or
+// anywhere if none are given, that match q
+func findInCatalog(path string, dirs []string, q CatalogQuery) ([]*IndexEntry, error) {
+
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+
+	catalog, err := OpenCatalog(path)
+	if err != nil {
+		return nil, err
+	}
+	defer catalog.Close()
+
+	entries, err := catalog.Search(q)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(dirs) == 0 {
+		return entries, nil
+	}
+
+	var prefixes []string
+	for _, dir := range dirs {
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, strings.TrimSuffix(abs, string(filepath.Separator))+string(filepath.Separator))
+	}
+
+	var found []*IndexEntry
+	for _, entry := range entries {
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(entry.Path, prefix) {
+				found = append(found, entry)
+				break
+			}
+		}
+	}
+
+	return found, nil
+}
+
+// readFileHeader reads the metadata of the DCA file at path
+func readFileHeader(path string) (*MetadataStruct, error) {
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return dcaenc.ReadHeader(bufio.NewReader(f))
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/bwmarrin/dca/dcaenc"
+)
+
+// What dca fsck finds wrong with a file. A truncated file ends part way
+// through its header or a frame, or has fewer frames than its metadata
+// says. A corrupt file has a header or frames that can't be read, or
+// frames that don't match the checksum in its metadata. A repairable file
+// has damaged frames that its parity frames can rebuild.
+const (
+	fsckOK         = "ok"
+	fsckTruncated  = "truncated"
+	fsckCorrupt    = "corrupt"
+	fsckEmpty      = "empty"
+	fsckRepairable = "repairable"
+	fsckUnreadable = "unreadable"
+)
+
+// FsckResult is what dca fsck finds out about a file
+type FsckResult struct {
+	Path    string `json:"path"`
+	Status  string `json:"status"`
+	Problem string `json:"problem,omitempty"`
+	Frames  int    `json:"frames"`
+}
+
+// fsckCmd implements "dca fsck" which checks every DCA file below the
+// folders given, reading each in full, and reports those that are
+// truncated, corrupt or have no frames
+func fsckCmd(args []string) {
+
+	var jobs int
+	var asJSON bool
+
+	fs := flag.NewFlagSet("fsck", flag.ExitOnError)
+	fs.IntVar(&jobs, "jobs", runtime.NumCPU(), "number of files to check at once")
+	fs.BoolVar(&asJSON, "json", false, "print every file checked as a json array")
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		reportError(exitUsage, "error: fsck requires a folder")
+		return
+	}
+
+	if jobs < 1 {
+		jobs = 1
+	}
+
+	results := checkLibrary(fs.Args(), jobs)
+
+	failed := 0
+	for _, result := range results {
+		if result.Status != fsckOK {
+			failed++
+		}
+	}
+
+	if asJSON {
+		if results == nil {
+			results = []*FsckResult{}
+		}
+
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(results)
+	} else {
+		for _, result := range results {
+			if result.Status != fsckOK {
+				fmt.Printf("%s\t%s\t%s\n", result.Status, result.Path, result.Problem)
+			}
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "checked %d files, %d with problems\n", len(results), failed)
+
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// checkLibrary checks every DCA file below dirs, jobs of them at once, and
+// returns the results sorted by path
+func checkLibrary(dirs []string, jobs int) []*FsckResult {
+
+	var results []*FsckResult
+
+	var lock sync.Mutex
+	files := make(chan string)
+
+	var checkWg sync.WaitGroup
+	for i := 0; i < jobs; i++ {
+		checkWg.Add(1)
+		go func() {
+			defer checkWg.Done()
+
+			for file := range files {
+				result := checkFile(file)
+
+				lock.Lock()
+				results = append(results, result)
+				lock.Unlock()
+			}
+		}()
+	}
+
+	for _, dir := range dirs {
+		filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				lock.Lock()
+				results = append(results, &FsckResult{Path: path, Status: fsckUnreadable, Problem: err.Error()})
+				lock.Unlock()
+				return nil
+			}
+			if !info.IsDir() && strings.EqualFold(filepath.Ext(path), ".dca") {
+				files <- path
+			}
+			return nil
+		})
+	}
+
+	close(files)
+	checkWg.Wait()
+
+	sort.Sort(byResultPath(results))
+
+	return results
+}
+
+// checkFile reads a DCA file in full and reports the first problem found
+// with it
+func checkFile(path string) *FsckResult {
+
+	result := &FsckResult{Path: path, Status: fsckOK}
+
+	fail := func(status string, format string, a ...interface{}) *FsckResult {
+		result.Status = status
+		result.Problem = fmt.Sprintf(format, a...)
+		return result
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return fail(fsckUnreadable, "%s", err)
+	}
+	defer f.Close()
+
+	r := bufio.NewReaderSize(f, 16384)
+
+	metadata, err := dcaenc.ReadHeader(r)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return fail(fsckTruncated, "header is cut short")
+	}
+	if err != nil {
+		return fail(fsckCorrupt, "error reading header: %s", err)
+	}
+
+	if metadata.Opus == nil || metadata.Opus.SampleRate <= 0 {
+		return fail(fsckCorrupt, "no opus metadata")
+	}
+
+	check := &frameCheck{
+		metadata: metadata,
+		parity:   parityGroup(metadata),
+	}
+
+	err = check.read(r)
+	result.Frames = check.frames
+	if err == io.ErrUnexpectedEOF {
+		return fail(fsckTruncated, "frame %d is cut short", check.physical+1)
+	}
+	if err != nil {
+		return fail(fsckCorrupt, "frame %d: %s", check.physical+1, err)
+	}
+
+	if check.unrepaired > 0 {
+		return fail(fsckCorrupt, "damaged frames parity can't rebuild: %d", check.unrepaired)
+	}
+
+	if check.frames == 0 {
+		return fail(fsckEmpty, "no frames")
+	}
+
+	if extra := metadata.Extra; extra != nil {
+		if extra.Frames > check.frames {
+			return fail(fsckTruncated, "has %d of %d frames", check.frames, extra.Frames)
+		}
+		if extra.Frames > 0 && extra.Frames < check.frames {
+			return fail(fsckCorrupt, "has %d frames, metadata says %d", check.frames, extra.Frames)
+		}
+		if extra.Checksum != "" && extra.Checksum != check.checksum() {
+			return fail(fsckCorrupt, "frames don't match the checksum in the metadata")
+		}
+	}
+
+	if check.repaired > 0 {
+		return fail(fsckRepairable, "damaged frames parity can rebuild: %d", check.repaired)
+	}
+
+	return result
+}
+
+// frameCheck reads the frames of a DCA file, expanding repeat markers and
+// checking groups against their parity frames, and hashes them the same
+// way readFrameStats does
+type frameCheck struct {
+	metadata *MetadataStruct
+	parity   int
+
+	hash     []byte
+	frames   int // once repeat markers are expanded, parity frames aside
+	physical int // frames as they are in the file
+
+	// damaged frames that parity could and couldn't rebuild
+	repaired   int
+	unrepaired int
+}
+
+// read reads every frame from r, positioned after the header. It returns
+// io.ErrUnexpectedEOF if the last frame is cut short.
+func (c *frameCheck) read(r io.Reader) error {
+
+	hash := sha1.New()
+	defer func() { c.hash = hash.Sum(nil) }()
+
+	multitrack := len(c.metadata.Streams) > 0
+
+	add := func(index int, opus []byte) {
+		if multitrack {
+			hash.Write([]byte{byte(index)})
+		}
+		binary.Write(hash, binary.LittleEndian, int16(len(opus)))
+		hash.Write(opus)
+		c.frames++
+	}
+
+	var last []byte
+	var group [][]byte
+
+	// the last frame of a group, full or not, is its parity
+	checkGroup := func() error {
+		if len(group) == 0 {
+			return nil
+		}
+
+		parity := group[len(group)-1]
+		frames := group[:len(group)-1]
+		group = nil
+
+		damaged, err := dcaenc.DamagedFrames(frames, parity)
+		if err != nil {
+			return err
+		}
+		if len(damaged) > 0 && dcaenc.RepairGroup(frames, parity) != nil {
+			c.unrepaired += len(damaged)
+		} else {
+			c.repaired += len(damaged)
+		}
+
+		for _, opus := range frames {
+			add(0, opus)
+		}
+		return nil
+	}
+
+	for {
+		index := 0
+
+		// the file may only end before a frame
+		start := true
+		if multitrack {
+			var b [1]byte
+			_, err := io.ReadFull(r, b[:])
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			index = int(b[0])
+			start = false
+		}
+
+		var opuslen int16
+		err := binary.Read(r, binary.LittleEndian, &opuslen)
+		if err == io.EOF && start {
+			return checkGroup()
+		}
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return err
+		}
+
+		if multitrack && index >= len(c.metadata.Streams) {
+			return fmt.Errorf("frame for unknown stream %d", index)
+		}
+
+		if opuslen < 0 {
+			if multitrack || c.parity > 0 || last == nil {
+				return fmt.Errorf("invalid frame length %d", opuslen)
+			}
+			c.physical++
+			for i := 0; i < -int(opuslen); i++ {
+				add(0, last)
+			}
+			continue
+		}
+
+		opus := make([]byte, opuslen)
+		_, err = io.ReadFull(r, opus)
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return err
+		}
+		c.physical++
+
+		if c.parity > 0 {
+			group = append(group, opus)
+			if len(group) > c.parity {
+				err = checkGroup()
+				if err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		last = opus
+		add(index, opus)
+	}
+}
+
+// checksum returns the checksum of the frames read, as it is in the extra
+// block of the metadata
+func (c *frameCheck) checksum() string {
+	return hex.EncodeToString(c.hash)
+}
+
+// byResultPath sorts fsck results by path
+type byResultPath []*FsckResult
+
+func (r byResultPath) Len() int           { return len(r) }
+func (r byResultPath) Less(i, j int) bool { return r[i].Path < r[j].Path }
+func (r byResultPath) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
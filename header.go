@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/bwmarrin/dca/dcaenc"
+)
+
+// headerReserve is the number of spaces written after the json metadata of
+// a file output, on top of any -metadata-padding, so the header can be
+// updated in place once encoding is done. Trailing whitespace is valid
+// json so readers are not affected.
+const headerReserve = 512
+
+// headerOffset is where the json metadata starts, after the magic bytes
+// and the int32 json length
+var headerOffset = int64(len(MagicBytes) + 4)
+
+// patchHeader updates the metadata of a finished DCA file with its
+// duration, frame count, average bitrate and a checksum of its frames,
+// all of which are unknown while streaming. The json is rewritten in place
+// when it fits the space the header already has, otherwise the whole file
+// is rewritten with a larger header.
+func patchHeader(f *os.File) error {
+
+	_, err := f.Seek(0, os.SEEK_SET)
+	if err != nil {
+		return err
+	}
+
+	rbuf := bufio.NewReaderSize(f, 16384)
+
+	metadata, err := dcaenc.ReadHeader(rbuf)
+	if err != nil {
+		return err
+	}
+
+	length, err := metadataLength(f)
+	if err != nil {
+		return err
+	}
+
+	// scan the frames after the header, from memory if the file can be
+	// mapped
+	_, err = f.Seek(headerOffset+int64(length), os.SEEK_SET)
+	if err != nil {
+		return err
+	}
+	rbuf.Reset(f)
+
+	var frameData io.Reader = rbuf
+	if data, err := mapFile(f); err == nil {
+		defer unmapFile(data)
+
+		if start := headerOffset + int64(length); start <= int64(len(data)) {
+			frameData = bytes.NewReader(data[start:])
+		}
+	}
+
+	stats, err := readFrameStats(frameData, metadata)
+	if err != nil {
+		return err
+	}
+	frames, longest, size := stats.frames, stats.longest, stats.size
+	multitrack := len(metadata.Streams) > 0
+
+	if metadata.Extra == nil {
+		metadata.Extra = &ExtraMetadata{}
+	}
+
+	extra := metadata.Extra
+	extra.Frames = frames
+	extra.Checksum = stats.checksum
+
+	// the padding of the last frame is only known for a single stream
+	// that was just encoded
+	if metadata.Opus != nil && !multitrack && frames > 0 {
+		if Appending {
+			appendSeam(metadata, frames)
+		} else {
+			extra.Samples = frames*metadata.Opus.FrameSize - EndPadding
+		}
+
+		// segments after the first carry on from the one before without
+		// a delay of their own, so the last one also holds the delayed
+		// end of the input
+		if SegmentTime != 0 && !OpusInput && metadata.Opus.PreSkip == 0 {
+			extra.Samples += dcaenc.PreSkip(Application) * metadata.Opus.SampleRate / 48000
+			if extra.Samples > frames*metadata.Opus.FrameSize {
+				extra.Samples = frames * metadata.Opus.FrameSize
+			}
+		}
+	}
+
+	if metadata.Opus != nil && metadata.Opus.SampleRate > 0 {
+		samples := int64(longest) * int64(metadata.Opus.FrameSize)
+		if extra.Samples > 0 {
+			samples = int64(extra.Samples)
+		}
+		extra.Duration = int(samples * 1000 / int64(metadata.Opus.SampleRate))
+
+		// the average bitrate is per stream
+		if frames > 0 {
+			perFrame := int64(frames) * int64(metadata.Opus.FrameSize)
+			extra.Bitrate = int(int64(size) * 8 * int64(metadata.Opus.SampleRate) / perFrame)
+		}
+	}
+
+	if metadata.Opus != nil && !multitrack {
+		extra.SplicePoints = dcaenc.SplicePoints(metadata.Opus.SpliceInterval, frames)
+	}
+
+	if len(Gaps) > 0 && Appending {
+		for _, gap := range Gaps {
+			extra.Gaps = append(extra.Gaps, &GapMetadata{Offset: AppendFrame + gap.Offset, Frames: gap.Frames})
+		}
+	} else if len(Gaps) > 0 {
+		extra.Gaps = Gaps
+	}
+
+	if Quality != nil {
+		extra.Quality = Quality
+	}
+
+	// the index is rebuilt from the frames as they are now
+	if extra.Index != nil && !multitrack {
+		if mapped, ok := frameData.(*bytes.Reader); ok {
+			_, err = mapped.Seek(0, os.SEEK_SET)
+		} else {
+			_, err = f.Seek(headerOffset+int64(length), os.SEEK_SET)
+			rbuf.Reset(f)
+		}
+		if err != nil {
+			return err
+		}
+
+		extra.Index, err = dcaenc.BuildSeekIndex(frameData, metadata, extra.Index.Interval)
+		if err != nil {
+			return err
+		}
+	}
+
+	if SourceError != "" {
+		extra.SourceError = SourceError
+	}
+
+	return replaceMetadata(f, metadata, length)
+}
+
+// appendSeam records the run just appended to a file that now has the
+// given number of frames, adding its input to that of the runs before it
+func appendSeam(metadata *MetadataStruct, frames int) {
+
+	extra, opus := metadata.Extra, metadata.Opus
+	if frames <= AppendFrame {
+		return
+	}
+
+	// a file whose samples were never filled in is taken to hold input up
+	// to the end of its last frame
+	previous := extra.Samples
+	if previous == 0 {
+		previous = AppendFrame*opus.FrameSize - opus.PreSkip*opus.SampleRate/48000
+	}
+
+	seam := &SeamMetadata{
+		Frame:   AppendFrame,
+		PreSkip: Metadata.Opus.PreSkip,
+		Samples: (frames-AppendFrame)*opus.FrameSize - EndPadding,
+	}
+
+	extra.Seams = append(extra.Seams, seam)
+	extra.Samples = previous + seam.Samples
+}
+
+// frameStats is what reading every frame of a DCA file finds out about it
+type frameStats struct {
+	frames   int
+	longest  int // frames of the longest stream of a multitrack file
+	size     int // bytes of opus data
+	checksum string
+}
+
+// readFrameStats reads the frames of a DCA file with the given metadata
+// from r, positioned after its header, counting them and taking the SHA-1
+// of their lengths and data
+func readFrameStats(r io.Reader, metadata *MetadataStruct) (*frameStats, error) {
+
+	// repeat markers are expanded, so the checksum and counts are the
+	// same as without them
+	stream := dcaenc.NewFrameReader(r, metadata)
+
+	hash := sha1.New()
+	stats := &frameStats{}
+
+	// frames of a multitrack file are counted per stream, and the longest
+	// stream sets the duration
+	multitrack := len(metadata.Streams) > 0
+	perStream := make([]int, len(metadata.Streams)+1)
+
+	for {
+		var index int
+		var opus []byte
+		var err error
+
+		if multitrack {
+			index, opus, err = readStreamFrame(r)
+		} else {
+			opus, err = stream.ReadFrame()
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if index >= len(perStream) {
+			return nil, fmt.Errorf("frame for unknown stream %d", index)
+		}
+
+		if multitrack {
+			hash.Write([]byte{byte(index)})
+		}
+		binary.Write(hash, binary.LittleEndian, int16(len(opus)))
+		hash.Write(opus)
+
+		stats.frames++
+		stats.size += len(opus)
+		perStream[index]++
+	}
+
+	for _, n := range perStream {
+		if n > stats.longest {
+			stats.longest = n
+		}
+	}
+
+	stats.checksum = hex.EncodeToString(hash.Sum(nil))
+
+	return stats, nil
+}
+
+// metadataLength returns the length of the json block of a DCA file,
+// padding included
+func metadataLength(f *os.File) (int32, error) {
+
+	lenbuf := make([]byte, 4)
+	_, err := f.ReadAt(lenbuf, int64(len(MagicBytes)))
+	if err != nil {
+		return 0, err
+	}
+
+	return int32(binary.LittleEndian.Uint32(lenbuf)), nil
+}
+
+// replaceMetadata replaces the json block of f, which is length bytes, with
+// metadata. It is written in place when it fits, otherwise the whole file
+// is rewritten with a larger header.
+func replaceMetadata(f *os.File, metadata *MetadataStruct, length int32) error {
+
+	// the header stays compressed if it was written compressed, which the
+	// first two bytes of the block tell
+	flag := make([]byte, 2)
+	_, err := f.ReadAt(flag, headerOffset)
+	if err != nil {
+		return err
+	}
+
+	patched, err := dcaenc.EncodeMetadata(metadata, dcaenc.IsCompressed(flag))
+	if err != nil {
+		return err
+	}
+
+	if len(patched) <= int(length) {
+		patched = append(patched, bytes.Repeat([]byte(" "), int(length)-len(patched))...)
+		_, err = f.WriteAt(patched, headerOffset)
+		return err
+	}
+
+	return rewriteHeader(f, patched, headerOffset+int64(length))
+}
+
+// rewriteHeader writes a copy of f with a new json header followed by the
+// frames starting at offset, then replaces f with it
+func rewriteHeader(f *os.File, metadata []byte, offset int64) error {
+
+	tmp, err := ioutil.TempFile(filepath.Dir(f.Name()), ".dca")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	// keep the permissions of the original
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	err = tmp.Chmod(fi.Mode())
+	if err != nil {
+		return err
+	}
+
+	metadata = append(metadata, bytes.Repeat([]byte(" "), MetadataPadding+headerReserve)...)
+
+	wbuf := bufio.NewWriterSize(tmp, 16384)
+	wbuf.WriteString(MagicBytes)
+	binary.Write(wbuf, binary.LittleEndian, int32(len(metadata)))
+	wbuf.Write(metadata)
+
+	_, err = f.Seek(offset, os.SEEK_SET)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(wbuf, f)
+	if err != nil {
+		return err
+	}
+
+	err = wbuf.Flush()
+	if err != nil {
+		return err
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return fmt.Errorf("error closing rewritten file: %s", err)
+	}
+
+	return os.Rename(tmp.Name(), f.Name())
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// indexFile is the sidecar index dca index keeps in the folder it indexes
+const indexFile = ".dca-index.json"
+
+// LibraryIndex is the sidecar index of a folder of DCA files
+type LibraryIndex struct {
+	Version int           `json:"version"`
+	Files   []*IndexEntry `json:"files"`
+}
+
+// IndexEntry is what the index holds about a DCA file. Path is relative to
+// the indexed folder with forward slashes, ModTime is in unix nanoseconds,
+// and Duration is in milliseconds. Checksum is the SHA-1 of the frames,
+// the same as the checksum in the extra block of the metadata.
+type IndexEntry struct {
+	Path     string        `json:"path"`
+	Size     int64         `json:"size"`
+	ModTime  int64         `json:"mtime"`
+	Duration int           `json:"duration"`
+	Frames   int           `json:"frames"`
+	Checksum string        `json:"checksum"`
+	Info     *SongMetadata `json:"info,omitempty"`
+	Opus     *OpusMetadata `json:"opus,omitempty"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// indexCmd implements "dca index" which writes a sidecar index of every
+// DCA file in a folder, so players can load a library without opening
+// each file. Files that haven't changed since the last index are kept as
+// they were rather than scanned again.
+func indexCmd(args []string) {
+
+	var out string
+	var jobs int
+
+	fs := flag.NewFlagSet("index", flag.ExitOnError)
+	fs.StringVar(&out, "o", "", "file to write the index to (default is "+indexFile+" in the folder)")
+	fs.IntVar(&jobs, "jobs", runtime.NumCPU(), "number of files to scan at once")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		reportError(exitUsage, "error: index requires a folder")
+		return
+	}
+	dir := fs.Arg(0)
+
+	if out == "" {
+		out = filepath.Join(dir, indexFile)
+	}
+
+	index, err := buildIndex(dir, out, jobs)
+	if err != nil {
+		reportError(exitFailure, "error:", err)
+		exit()
+	}
+
+	err = writeIndex(out, index)
+	if err != nil {
+		reportError(exitOutput, "error writing index:", err)
+		exit()
+	}
+
+	failed := 0
+	for _, entry := range index.Files {
+		if entry.Error != "" {
+			reportError(exitInput, "error indexing", entry.Path+":", entry.Error)
+			failed++
+		}
+	}
+
+	fmt.Printf("indexed %d files to %s\n", len(index.Files)-failed, out)
+}
+
+// readIndex reads the index at path, or returns an empty one if there is
+// none
+func readIndex(path string) (*LibraryIndex, error) {
+
+	index := &LibraryIndex{Version: 1}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return index, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, index)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	return index, nil
+}
+
+// writeIndex replaces the index at path, so a reader never sees half of it
+func writeIndex(path string, index *LibraryIndex) error {
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".dca-index")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	wbuf := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(wbuf)
+	enc.SetIndent("", "  ")
+
+	err = enc.Encode(index)
+	if err == nil {
+		err = wbuf.Flush()
+	}
+	if err == nil {
+		err = tmp.Close()
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// buildIndex indexes every DCA file below dir, reusing the entries of the
+// index at path for files that are the same size and age as before
+func buildIndex(dir, path string, jobs int) (*LibraryIndex, error) {
+
+	old, err := readIndex(path)
+	if err != nil {
+		return nil, err
+	}
+
+	known := make(map[string]*IndexEntry)
+	for _, entry := range old.Files {
+		known[entry.Path] = entry
+	}
+
+	// paths in the index are relative to the folder
+	key := func(file string) string {
+		rel, err := filepath.Rel(dir, file)
+		if err != nil {
+			return file
+		}
+		return filepath.ToSlash(rel)
+	}
+
+	index := &LibraryIndex{
+		Version: 1,
+		Files:   scanLibrary(dir, jobs, key, known),
+	}
+
+	return index, nil
+}
+
+// scanLibrary returns an index entry for every DCA file below dir, scanning
+// jobs of them at once. Each is named by key, and the entry in known under
+// that name is reused if the file hasn't changed. Entries are sorted by
+// name.
+func scanLibrary(dir string, jobs int, key func(string) string, known map[string]*IndexEntry) []*IndexEntry {
+
+	var entries []*IndexEntry
+
+	var lock sync.Mutex
+	files := make(chan string)
+
+	var scanWg sync.WaitGroup
+	for i := 0; i < jobs; i++ {
+		scanWg.Add(1)
+		go func() {
+			defer scanWg.Done()
+
+			for file := range files {
+				entry := indexEntry(key(file), file, known)
+
+				lock.Lock()
+				entries = append(entries, entry)
+				lock.Unlock()
+			}
+		}()
+	}
+
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() && strings.EqualFold(filepath.Ext(path), ".dca") {
+			files <- path
+		}
+		return nil
+	})
+
+	close(files)
+	scanWg.Wait()
+
+	sort.Sort(byPath(entries))
+
+	return entries
+}
+
+// indexEntry returns the index entry of file named name, reusing the one
+// in known if the file hasn't changed
+func indexEntry(name, file string, known map[string]*IndexEntry) *IndexEntry {
+
+	entry := &IndexEntry{Path: name}
+
+	fi, err := os.Stat(file)
+	if err != nil {
+		entry.Error = err.Error()
+		return entry
+	}
+
+	entry.Size = fi.Size()
+	entry.ModTime = fi.ModTime().UnixNano()
+
+	if prev, ok := known[entry.Path]; ok && prev.Error == "" &&
+		prev.Size == entry.Size && prev.ModTime == entry.ModTime {
+		return prev
+	}
+
+	err = scanEntry(file, entry)
+	if err != nil {
+		entry.Error = err.Error()
+	}
+
+	return entry
+}
+
+// scanEntry fills in an index entry from the header and frames of file.
+// The checksum in the metadata is used when there is one, otherwise the
+// frames are read in full to work it out.
+func scanEntry(file string, entry *IndexEntry) error {
+
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scan, err := scanFile(f)
+	if err != nil {
+		return err
+	}
+
+	metadata := scan.metadata
+	entry.Duration = scan.duration
+	entry.Frames = scan.frames
+	entry.Opus = metadata.Opus
+
+	// covers are left out to keep the index small
+	if metadata.SongInfo != nil {
+		info := *metadata.SongInfo
+		info.Cover = nil
+		entry.Info = &info
+	}
+
+	if metadata.Extra != nil && metadata.Extra.Checksum != "" {
+		entry.Checksum = metadata.Extra.Checksum
+		return nil
+	}
+
+	entry.Checksum, err = readChecksum(f, scan)
+	return err
+}
+
+// readChecksum reads every frame of a scanned file and returns their
+// checksum
+func readChecksum(f *os.File, scan *fileScan) (string, error) {
+
+	_, err := f.Seek(headerOffset+int64(scan.length), os.SEEK_SET)
+	if err != nil {
+		return "", err
+	}
+
+	stats, err := readFrameStats(bufio.NewReaderSize(f, 16384), scan.metadata)
+	if err != nil {
+		return "", err
+	}
+
+	return stats.checksum, nil
+}
+
+// byPath sorts index entries by path
+type byPath []*IndexEntry
+
+func (e byPath) Len() int           { return len(e) }
+func (e byPath) Less(i, j int) bool { return e[i].Path < e[j].Path }
+func (e byPath) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/bwmarrin/dca/dcaenc"
+)
+
+// stringList is a flag.Value that collects every use of a flag
+type stringList []string
+
+// String implements flag.Value
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+// Set implements flag.Value
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// isPipe reports whether an input is raw pcm16 read from stdin or from an
+// already open file descriptor given as fd:N, rather than a file for
+// ffmpeg to decode
+func isPipe(input string) bool {
+	return input == "pipe:0" || strings.HasPrefix(input, "fd:")
+}
+
+// inputSource returns the origin source an input is described with
+func inputSource(input string) string {
+
+	if input == "pipe:0" {
+		return "pipe"
+	}
+
+	if isPipe(input) {
+		return "fd"
+	}
+
+	return "file"
+}
+
+// openPipe returns the reader for a pipe input
+func openPipe(input string) (*os.File, error) {
+
+	if input == "pipe:0" {
+		return os.Stdin, nil
+	}
+
+	fd, err := strconv.Atoi(strings.TrimPrefix(input, "fd:"))
+	if err != nil || fd < 0 {
+		return nil, fmt.Errorf("invalid file descriptor %q", input)
+	}
+
+	f := os.NewFile(uintptr(fd), input)
+	if f == nil {
+		return nil, fmt.Errorf("invalid file descriptor %q", input)
+	}
+
+	// make sure it is actually open
+	_, err = f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// mixReader reads every input at once, mixes them together and sends the
+// result to the encoder. Inputs that end early are treated as silence
+// until the last one ends.
+func mixReader(out chan<- []int16) error {
+
+	// each input is read in its own stage so a producer writing to
+	// several of them doesn't block on the one we aren't reading
+	frames := make([]chan []int16, len(Inputs))
+	for i, input := range Inputs {
+		c := make(chan []int16, 5*ChannelDepth)
+		frames[i] = c
+
+		input := input
+		startStage(func() error {
+			return readPCM(input, c)
+		}, func() {
+			close(c)
+		})
+	}
+
+	for {
+		mix := make([]int32, FrameSize*Channels)
+		active := 0
+
+		for _, c := range frames {
+			pcm, ok := <-c
+			if !ok {
+				continue
+			}
+
+			active++
+			for i, s := range pcm {
+				mix[i] += int32(s)
+			}
+		}
+
+		if active == 0 {
+			return nil
+		}
+
+		pcm := make([]int16, len(mix))
+		for i, s := range mix {
+			if s > 32767 {
+				s = 32767
+			} else if s < -32768 {
+				s = -32768
+			}
+			pcm[i] = int16(s)
+		}
+
+		select {
+		case out <- pcm:
+		case <-quit:
+			return nil
+		}
+	}
+}
+
+// readPCM reads whole frames of pcm16 from an input into frames, padding
+// the last one with silence
+func readPCM(input string, frames chan<- []int16) error {
+
+	var r io.Reader
+
+	if isPipe(input) {
+		f, err := openPipe(input)
+		if err != nil {
+			return fmt.Errorf("error opening input: %s", err)
+		}
+		r = f
+	} else {
+		ffmpeg := pcmCommand(input)
+		stdout, err := ffmpeg.StdoutPipe()
+		if err != nil {
+			return classify(exitFFmpeg, fmt.Errorf("StdoutPipe Error: %s", err))
+		}
+
+		err = startCommand(ffmpeg)
+		if err != nil {
+			return classify(exitFFmpeg, fmt.Errorf("RunStart Error: %s", err))
+		}
+
+		defer func() {
+			err := waitCommand(ffmpeg)
+			if err != nil && !aborted() {
+				sourceFailed(ffmpeg, err)
+			}
+		}()
+
+		r = stdout
+	}
+
+	buf := make([]byte, FrameSize*Channels*2)
+
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			for i := n; i < len(buf); i++ {
+				buf[i] = 0
+			}
+
+			select {
+			case frames <- pcmFrame(buf):
+			case <-quit:
+				return nil
+			}
+		}
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error reading input: %s", err)
+		}
+	}
+}
+
+// readOpus reads length prefixed opus packets, such as those a bot
+// receives from Discord voice, from an input into frames without decoding
+// them
+func readOpus(input string, frames chan<- []byte) error {
+
+	var in *os.File
+	var err error
+
+	if isPipe(input) {
+		in, err = openPipe(input)
+	} else {
+		in, err = os.Open(input)
+		if err == nil {
+			defer in.Close()
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("error opening input: %s", err)
+	}
+
+	// input buffer, 16KB unless -low-latency
+	rbuf := bufio.NewReaderSize(in, BufferSize)
+
+	for {
+		opus, err := dcaenc.ReadFrame(rbuf)
+		if err == io.EOF {
+			return nil
+		}
+		if err == io.ErrUnexpectedEOF {
+			reportError(exitInput, "error reading input: truncated opus packet")
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error reading input: %s", err)
+		}
+
+		select {
+		case frames <- opus:
+		case <-quit:
+			return nil
+		}
+	}
+}
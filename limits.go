@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// limitPoll is how often the usage of dca and its children is checked
+// when -max-rss and -cpu-limit aren't enforced by a cgroup
+const limitPoll = time.Second
+
+// resourceUsage is the memory and cpu time used by dca and its children
+type resourceUsage struct {
+	rss int64
+	cpu time.Duration
+}
+
+// applyLimits puts dca, and every process it starts from then on, under
+// -max-rss and -cpu-limit. With -cgroup the kernel enforces them in a
+// cgroup of their own, otherwise their usage is watched: going over
+// -max-rss stops the encode, and going over -cpu-limit is only warned
+// about as there is nothing to slow ffmpeg down with. It returns a func to
+// call once encoding is done, which may be called more than once.
+func applyLimits(maxRSS string, cores float64, cgroup string) (func(), error) {
+
+	if maxRSS == "" && cores == 0 {
+		if cgroup != "" {
+			return nil, fmt.Errorf("error: -cgroup requires -max-rss or -cpu-limit")
+		}
+		return func() {}, nil
+	}
+
+	var limit int64
+	if maxRSS != "" {
+		var err error
+		limit, err = parseSize(maxRSS)
+		if err != nil {
+			return nil, fmt.Errorf("error: -max-rss: %s", err)
+		}
+	}
+
+	if cores < 0 {
+		return nil, fmt.Errorf("error: -cpu-limit must be a number of cores")
+	}
+
+	if cgroup != "" {
+		release, err := enterCgroup(cgroup, limit, cores)
+		if err != nil {
+			return nil, fmt.Errorf("error setting up -cgroup: %s", err)
+		}
+
+		var once sync.Once
+		return func() { once.Do(release) }, nil
+	}
+
+	_, err := processUsage()
+	if err != nil {
+		return nil, fmt.Errorf("error watching -max-rss and -cpu-limit: %s", err)
+	}
+
+	stop := make(chan struct{})
+	go watchUsage(limit, cores, stop)
+
+	var once sync.Once
+	return func() { once.Do(func() { close(stop) }) }, nil
+}
+
+// watchUsage checks the usage of dca and its children every limitPoll
+// until stop is closed, stopping the encode if it goes over limit bytes of
+// memory and warning once if it uses more than cores
+func watchUsage(limit int64, cores float64, stop <-chan struct{}) {
+
+	ticker := time.NewTicker(limitPoll)
+	defer ticker.Stop()
+
+	last, _ := processUsage()
+	lastTime := time.Now()
+	warned := false
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-quit:
+			return
+		case now := <-ticker.C:
+			usage, err := processUsage()
+			if err != nil {
+				continue
+			}
+
+			if limit > 0 && usage.rss > limit {
+				fail(fmt.Errorf("error: using %d bytes of memory, over -max-rss", usage.rss))
+				return
+			}
+
+			// children that exit take their cpu time with them, so the
+			// usage can go down
+			used := float64(usage.cpu-last.cpu) / float64(now.Sub(lastTime))
+			if cores > 0 && used > cores && !warned {
+				fmt.Fprintf(os.Stderr, "warning: using %.1f cores, over -cpu-limit, which only -cgroup can enforce\n", used)
+				warned = true
+			}
+
+			last, lastTime = usage, now
+		}
+	}
+}
+
+// childPids returns the process ids of the children dca has running
+func childPids() []int {
+
+	childrenMu.Lock()
+	defer childrenMu.Unlock()
+
+	var pids []int
+	for _, cmd := range children {
+		if cmd.Process != nil {
+			pids = append(pids, cmd.Process.Pid)
+		}
+	}
+
+	return pids
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cpuPeriod is the period of cpu.max in microseconds, the kernel default
+const cpuPeriod = 100000
+
+// clockTicks is the unit of the cpu times in /proc, USER_HZ, which is 100
+// on every architecture Linux runs dca on
+const clockTicks = 100
+
+// enterCgroup moves dca into a new cgroup below parent, a cgroup v2 folder
+// delegated to the user with the memory and cpu controllers enabled for
+// its children, and sets its limits there. Processes started later are
+// in it too. The returned func moves dca back out and removes it.
+func enterCgroup(parent string, maxRSS int64, cores float64) (func(), error) {
+
+	if _, err := os.Stat(filepath.Join(parent, "cgroup.controllers")); err != nil {
+		return nil, fmt.Errorf("%s is not a cgroup v2 folder", parent)
+	}
+
+	home, err := currentCgroup()
+	if err != nil {
+		return nil, err
+	}
+
+	dir := filepath.Join(parent, fmt.Sprintf("dca-%d", os.Getpid()))
+	err = os.Mkdir(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	write := func(dir, file, value string) error {
+		return ioutil.WriteFile(filepath.Join(dir, file), []byte(value), 0644)
+	}
+
+	if maxRSS > 0 {
+		err = write(dir, "memory.max", strconv.FormatInt(maxRSS, 10))
+	}
+	if err == nil && cores > 0 {
+		err = write(dir, "cpu.max", fmt.Sprintf("%d %d", int64(cores*cpuPeriod), cpuPeriod))
+	}
+	if err == nil {
+		err = write(dir, "cgroup.procs", strconv.Itoa(os.Getpid()))
+	}
+	if err != nil {
+		os.Remove(dir)
+		return nil, err
+	}
+
+	release := func() {
+		// a cgroup can only be removed once nothing is left in it
+		write(home, "cgroup.procs", strconv.Itoa(os.Getpid()))
+		for i := 0; i < 10 && os.Remove(dir) != nil; i++ {
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+
+	return release, nil
+}
+
+// currentCgroup returns the folder of the cgroup v2 dca is in
+func currentCgroup() (string, error) {
+
+	data, err := ioutil.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return "", err
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "0::") {
+			return filepath.Join("/sys/fs/cgroup", line[3:]), nil
+		}
+	}
+
+	return "", fmt.Errorf("not in a cgroup v2")
+}
+
+// processUsage returns the resident memory and cpu time of dca and the
+// children it has running, from /proc
+func processUsage() (resourceUsage, error) {
+
+	var usage resourceUsage
+
+	for i, pid := range append([]int{os.Getpid()}, childPids()...) {
+		rss, cpu, err := procUsage(pid)
+		if err != nil {
+			// children may exit at any time, dca itself can't
+			if i == 0 {
+				return usage, err
+			}
+			continue
+		}
+
+		usage.rss += rss
+		usage.cpu += cpu
+	}
+
+	return usage, nil
+}
+
+// procUsage reads the resident memory and cpu time of a process from /proc
+func procUsage(pid int) (int64, time.Duration, error) {
+
+	dir := filepath.Join("/proc", strconv.Itoa(pid))
+
+	statm, err := ioutil.ReadFile(filepath.Join(dir, "statm"))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	fields := strings.Fields(string(statm))
+	if len(fields) < 2 {
+		return 0, 0, fmt.Errorf("unexpected %s/statm", dir)
+	}
+
+	pages, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	stat, err := ioutil.ReadFile(filepath.Join(dir, "stat"))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// the name in brackets may hold spaces, so fields are counted from
+	// after it, where utime and stime are the 12th and 13th
+	end := strings.LastIndex(string(stat), ")")
+	if end < 0 {
+		return 0, 0, fmt.Errorf("unexpected %s/stat", dir)
+	}
+
+	fields = strings.Fields(string(stat)[end+1:])
+	if len(fields) < 13 {
+		return 0, 0, fmt.Errorf("unexpected %s/stat", dir)
+	}
+
+	utime, err := strconv.ParseInt(fields[11], 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	stime, err := strconv.ParseInt(fields[12], 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	cpu := time.Duration(utime+stime) * time.Second / clockTicks
+
+	return pages * int64(os.Getpagesize()), cpu, nil
+}
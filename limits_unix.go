@@ -0,0 +1,38 @@
+//go:build !windows && !linux
+// +build !windows,!linux
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"syscall"
+	"time"
+)
+
+// enterCgroup is only supported on Linux
+func enterCgroup(parent string, maxRSS int64, cores float64) (func(), error) {
+	return nil, fmt.Errorf("cgroups are only supported on linux")
+}
+
+// processUsage returns the peak resident memory and cpu time of dca. Those
+// of children are only known once they exit, so they aren't counted.
+func processUsage() (resourceUsage, error) {
+
+	var ru syscall.Rusage
+
+	err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru)
+	if err != nil {
+		return resourceUsage{}, err
+	}
+
+	// macOS gives bytes, the BSDs kilobytes
+	rss := int64(ru.Maxrss)
+	if runtime.GOOS != "darwin" {
+		rss *= 1024
+	}
+
+	cpu := time.Duration(ru.Utime.Nano() + ru.Stime.Nano())
+
+	return resourceUsage{rss: rss, cpu: cpu}, nil
+}
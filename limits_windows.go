@@ -0,0 +1,15 @@
+package main
+
+import (
+	"fmt"
+)
+
+// enterCgroup is only supported on Linux
+func enterCgroup(parent string, maxRSS int64, cores float64) (func(), error) {
+	return nil, fmt.Errorf("cgroups are only supported on linux")
+}
+
+// processUsage is not supported on Windows
+func processUsage() (resourceUsage, error) {
+	return resourceUsage{}, fmt.Errorf("not supported on windows")
+}
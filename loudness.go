@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+
+	"github.com/bwmarrin/dca/dcaenc"
+	"github.com/layeh/gopus"
+)
+
+// Loudness measurement follows ITU-R BS.1770 and EBU R128: K-weighted
+// 400ms blocks gated at -70 LUFS and 10 LU below the ungated level for
+// integrated loudness, 3s blocks gated 20 LU below for loudness range, and
+// 4x oversampling for true peak.
+const (
+	loudnessAbsoluteGate = -70.0
+	loudnessRelativeGate = -10.0
+	loudnessRangeGate    = -20.0
+
+	// floor reported for true peak of silence
+	truePeakFloor = -144.0
+)
+
+// LoudnessReport is the result printed by the loudness command
+type LoudnessReport struct {
+	Integrated float64 `json:"integrated"`
+	TruePeak   float64 `json:"true_peak"`
+	Range      float64 `json:"range"`
+}
+
+// loudnessCmd implements "dca loudness" which decodes a DCA file and
+// reports its loudness without writing any audio
+func loudnessCmd(args []string) {
+
+	var jsonOutput bool
+
+	fs := flag.NewFlagSet("loudness", flag.ExitOnError)
+	fs.StringVar(&InFile, "i", "pipe:0", "infile")
+	fs.IntVar(&Channels, "ac", 2, "audio channels of raw input without metadata")
+	fs.IntVar(&FrameRate, "ar", 48000, "audio sampling rate of raw input without metadata")
+	fs.IntVar(&FrameSize, "as", 960, "audio frame size of raw input without metadata")
+	fs.BoolVar(&jsonOutput, "json", false, "print the report as json")
+	fs.Parse(args)
+
+	input, err := openInFile()
+	if err != nil {
+		reportError(exitInput, "error opening infile:", err)
+		return
+	}
+	defer input.Close()
+
+	// files are read straight from memory when they can be mapped
+	in := io.Reader(input)
+	if data, err := mapFile(input); err == nil {
+		defer unmapFile(data)
+		in = bytes.NewReader(data)
+	}
+
+	rbuf, err := readInput(in)
+	if err != nil {
+		reportError(exitInput, "error reading header:", err)
+		return
+	}
+
+	OpusDecoder, err = gopus.NewDecoder(FrameRate, Channels)
+	if err != nil {
+		reportError(exitEncode, "NewDecoder Error:", err)
+		return
+	}
+
+	meter := newLoudnessMeter(FrameRate, Channels)
+
+	frames := dcaenc.NewFrameReader(rbuf, InMetadata)
+
+	for {
+		opus, err := frames.ReadFrame()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			reportError(exitInput, "error reading input:", err)
+			return
+		}
+
+		pcm, err := OpusDecoder.Decode(opus, FrameSize, false)
+		if err != nil {
+			reportError(exitEncode, "Decoding Error:", err)
+			return
+		}
+
+		meter.Add(pcm)
+	}
+
+	report := meter.Report()
+
+	if jsonOutput {
+		json.NewEncoder(os.Stdout).Encode(report)
+		return
+	}
+
+	fmt.Printf("integrated: %.1f LUFS\n", report.Integrated)
+	fmt.Printf("true peak:  %.1f dBTP\n", report.TruePeak)
+	fmt.Printf("range:      %.1f LU\n", report.Range)
+}
+
+// biquad is a second order IIR filter section
+type biquad struct {
+	b0, b1, b2 float64
+	a1, a2     float64
+	z1, z2     float64
+}
+
+// process filters one sample
+func (f *biquad) process(x float64) float64 {
+
+	y := f.b0*x + f.z1
+	f.z1 = f.b1*x - f.a1*y + f.z2
+	f.z2 = f.b2*x - f.a2*y
+
+	return y
+}
+
+// kWeighting returns the two filter stages of the BS.1770 K-weighting
+// curve, a high shelf followed by a high pass, for the given sample rate
+func kWeighting(rate int) [2]biquad {
+
+	fs := float64(rate)
+
+	// high shelf modelling the acoustic effect of the head
+	f0 := 1681.974450955533
+	g := 3.999843853973347
+	q := 0.7071752369554196
+
+	k := math.Tan(math.Pi * f0 / fs)
+	vh := math.Pow(10, g/20)
+	vb := math.Pow(vh, 0.4996667741545416)
+	a0 := 1 + k/q + k*k
+
+	shelf := biquad{
+		b0: (vh + vb*k/q + k*k) / a0,
+		b1: 2 * (k*k - vh) / a0,
+		b2: (vh - vb*k/q + k*k) / a0,
+		a1: 2 * (k*k - 1) / a0,
+		a2: (1 - k/q + k*k) / a0,
+	}
+
+	// RLB high pass
+	f0 = 38.13547087602444
+	q = 0.5003270373238773
+
+	k = math.Tan(math.Pi * f0 / fs)
+	a0 = 1 + k/q + k*k
+
+	highpass := biquad{
+		b0: 1,
+		b1: -2,
+		b2: 1,
+		a1: 2 * (k*k - 1) / a0,
+		a2: (1 - k/q + k*k) / a0,
+	}
+
+	return [2]biquad{shelf, highpass}
+}
+
+// truePeakTaps is the number of taps per phase of the oversampling filter
+const truePeakTaps = 12
+
+// truePeakFilter holds the polyphase coefficients used to oversample by 4
+// for true peak measurement, a Hann windowed sinc low pass at the original
+// Nyquist frequency
+var truePeakFilter = func() [4][truePeakTaps]float64 {
+
+	var phases [4][truePeakTaps]float64
+
+	n := 4 * truePeakTaps
+	center := float64(n-1) / 2
+
+	for i := 0; i < n; i++ {
+		x := (float64(i) - center) / 4
+
+		h := 1.0
+		if x != 0 {
+			h = math.Sin(math.Pi*x) / (math.Pi * x)
+		}
+		h *= 0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(n-1))
+
+		phases[i%4][i/4] = h
+	}
+
+	// unity gain for each phase
+	for p := range phases {
+		sum := 0.0
+		for _, h := range phases[p] {
+			sum += h
+		}
+		for t := range phases[p] {
+			phases[p][t] /= sum
+		}
+	}
+
+	return phases
+}()
+
+// loudnessMeter accumulates pcm and measures its loudness
+type loudnessMeter struct {
+	channels int
+
+	filters [][2]biquad
+
+	// samples per channel in each 100ms sub-block
+	subLength int
+
+	// samples and energy so far in the current sub-block
+	subCount  int
+	subEnergy float64
+
+	// energy of each finished sub-block
+	subs []float64
+
+	// mean square of each 400ms and 3s block, at 100ms steps
+	momentary []float64
+	shortTerm []float64
+
+	// recent samples of each channel for oversampling, and the peak
+	history [][truePeakTaps]float64
+	peak    float64
+}
+
+// newLoudnessMeter returns a meter for pcm of the given sample rate and
+// channel count
+func newLoudnessMeter(rate, channels int) *loudnessMeter {
+
+	m := &loudnessMeter{
+		channels:  channels,
+		filters:   make([][2]biquad, channels),
+		subLength: rate / 10,
+		history:   make([][truePeakTaps]float64, channels),
+	}
+
+	for c := range m.filters {
+		m.filters[c] = kWeighting(rate)
+	}
+
+	return m
+}
+
+// Add measures a chunk of interleaved pcm
+func (m *loudnessMeter) Add(pcm []int16) {
+
+	for i := 0; i+m.channels <= len(pcm); i += m.channels {
+
+		for c := 0; c < m.channels; c++ {
+			x := float64(pcm[i+c]) / 32768
+
+			m.truePeak(c, x)
+
+			y := m.filters[c][0].process(x)
+			y = m.filters[c][1].process(y)
+			m.subEnergy += y * y
+		}
+
+		m.subCount++
+		if m.subCount == m.subLength {
+			m.finishSub()
+		}
+	}
+}
+
+// truePeak oversamples one sample of a channel and updates the peak
+func (m *loudnessMeter) truePeak(c int, x float64) {
+
+	h := &m.history[c]
+	copy(h[1:], h[:truePeakTaps-1])
+	h[0] = x
+
+	if math.Abs(x) > m.peak {
+		m.peak = math.Abs(x)
+	}
+
+	for p := range truePeakFilter {
+		y := 0.0
+		for t, coeff := range truePeakFilter[p] {
+			y += coeff * h[t]
+		}
+		if math.Abs(y) > m.peak {
+			m.peak = math.Abs(y)
+		}
+	}
+}
+
+// finishSub closes a 100ms sub-block and records any 400ms and 3s blocks
+// ending with it
+func (m *loudnessMeter) finishSub() {
+
+	m.subs = append(m.subs, m.subEnergy)
+	m.subCount = 0
+	m.subEnergy = 0
+
+	block := func(n int) float64 {
+		sum := 0.0
+		for _, e := range m.subs[len(m.subs)-n:] {
+			sum += e
+		}
+		return sum / float64(n*m.subLength)
+	}
+
+	if len(m.subs) >= 4 {
+		m.momentary = append(m.momentary, block(4))
+	}
+
+	if len(m.subs) >= 30 {
+		m.shortTerm = append(m.shortTerm, block(30))
+	}
+}
+
+// Report returns the integrated loudness, true peak and loudness range of
+// everything measured so far
+func (m *loudnessMeter) Report() *LoudnessReport {
+
+	report := &LoudnessReport{
+		Integrated: loudnessAbsoluteGate,
+		TruePeak:   truePeakFloor,
+	}
+
+	if m.peak > 0 {
+		report.TruePeak = math.Max(20*math.Log10(m.peak), truePeakFloor)
+	}
+
+	if gated := gateBlocks(m.momentary, loudnessRelativeGate); len(gated) > 0 {
+		report.Integrated = blockLoudness(meanEnergy(gated))
+	}
+
+	if gated := gateBlocks(m.shortTerm, loudnessRangeGate); len(gated) > 1 {
+		levels := make([]float64, len(gated))
+		for i, e := range gated {
+			levels[i] = blockLoudness(e)
+		}
+		sort.Float64s(levels)
+
+		low := levels[int(math.Floor(0.10*float64(len(levels)-1)+0.5))]
+		high := levels[int(math.Floor(0.95*float64(len(levels)-1)+0.5))]
+		report.Range = high - low
+	}
+
+	report.Integrated = roundLevel(report.Integrated)
+	report.TruePeak = roundLevel(report.TruePeak)
+	report.Range = roundLevel(report.Range)
+
+	return report
+}
+
+// roundLevel rounds a level to hundredths of a dB
+func roundLevel(x float64) float64 {
+	return math.Floor(x*100+0.5) / 100
+}
+
+// gateBlocks returns the blocks above the absolute gate and above the
+// relative gate below their mean loudness
+func gateBlocks(blocks []float64, relative float64) []float64 {
+
+	var absolute []float64
+	for _, e := range blocks {
+		if blockLoudness(e) > loudnessAbsoluteGate {
+			absolute = append(absolute, e)
+		}
+	}
+
+	if len(absolute) == 0 {
+		return nil
+	}
+
+	threshold := blockLoudness(meanEnergy(absolute)) + relative
+
+	var gated []float64
+	for _, e := range absolute {
+		if blockLoudness(e) > threshold {
+			gated = append(gated, e)
+		}
+	}
+
+	return gated
+}
+
+// meanEnergy averages block energies
+func meanEnergy(blocks []float64) float64 {
+
+	sum := 0.0
+	for _, e := range blocks {
+		sum += e
+	}
+
+	return sum / float64(len(blocks))
+}
+
+// blockLoudness converts a block's mean square to LUFS
+func blockLoudness(energy float64) float64 {
+	return -0.691 + 10*math.Log10(energy)
+}
@@ -13,16 +13,19 @@ import (
 	"io"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
+	"time"
 
-	"github.com/layeh/gopus"
+	"github.com/bwmarrin/dca/dcaenc"
 )
 
 // Define constants
 const (
 	// The current version of the DCA format
-	FormatVersion int8 = 1
+	FormatVersion int8 = dcaenc.FormatVersion
 
 	// The current version of the DCA program
 	ProgramVersion string = "0.0.1"
@@ -34,17 +37,20 @@ const (
 // All global variables used within the program
 var (
 	// Buffer for some commands
-	CmdBuf bytes.Buffer
-	PngBuf bytes.Buffer
+	CmdBuf *spillBuffer
+	PngBuf *spillBuffer
+
+	// MB of cover art kept in memory before spilling to a temp file
+	MaxMemory int64
 
 	CoverImage string
 
 	// Metadata structures
 	Metadata    MetadataStruct
-	FFprobeData FFprobeMetadata
+	FFprobeData *FFprobeMetadata
 
 	// Magic bytes to write at the start of a DCA file
-	MagicBytes string = fmt.Sprintf("DCA%d", FormatVersion)
+	MagicBytes string = dcaenc.Magic
 
 	// 1 for mono, 2 for stereo
 	Channels int
@@ -66,402 +72,1748 @@ var (
 	RawOutput bool
 
 	FrameSize int // uint16 size of each audio frame
-	MaxBytes  int // max size of opus data
 
 	Volume int // change audio volume (256=normal)
 
-	OpusEncoder *gopus.Encoder
+	OpusEncoder *dcaenc.FrameEncoder
 
 	InFile      string
 	CoverFormat string = "jpeg"
 
+	// if set, the cover art is written to this file instead of being
+	// embedded in the metadata
+	CoverOut string
+
+	// every -i given, more than one are mixed together unless Multitrack
+	// is set
+	Inputs stringList
+	Mixing bool
+
+	// if true, each input is encoded as its own stream of a multitrack file
+	Multitrack bool
+	Streams    []*StreamMetadata
+
+	// if true, the inputs are length prefixed opus packets as received
+	// from Discord voice, written out without decoding or re-encoding
+	OpusInput bool
+
+	// if true, a wav or pcm16 infile is converted without ffmpeg
+	NoFFmpeg bool
+	WavIn    *wavInput
+
+	// set when the infile is a generated test signal
+	Signal *TestSignal
+
 	OutFile string = "pipe:1"
 	OutBuf  []byte
 
-	EncodeChan chan []int16
-	OutputChan chan []byte
+	// if true, the files given as arguments are encoded back-to-back
+	// into one output with a track index in the metadata
+	AlbumMode bool
+	Tracks    []string
+
+	// if true, album mode starts each track on a frame of its own and
+	// names it after its file, for soundboards holding many short clips
+	SpriteMode bool
+
+	// if true, new frames are appended to an existing OutFile
+	AppendOutput bool
+
+	// the file the writer sends its output to, stdout unless -o is given
+	Output *os.File = os.Stdout
+
+	// true when Output already holds a DCA header and only frames are written
+	Appending bool
+
+	// the frames Output held before appending, where the appended run starts
+	AppendFrame int
+
+	// true when Output is a regular file whose header can be updated
+	// once encoding is done
+	Seekable bool
+
+	// bytes of space left after the json metadata for retagging later
+	MetadataPadding int
+
+	// samples per channel of silence the last frame was padded with
+	EndPadding int
+
+	// if true, frames repeated back to back are written as repeat markers
+	Dedup bool
+
+	// frames per parity frame, which lets receivers rebuild a lost frame
+	// of each group, 0 for none
+	Parity int
+
+	// where to start in the input and how much of it to encode, or to
+	// decode of a DCA file, 0 for all of it
+	StartTime time.Duration
+	ClipTime  time.Duration
+
+	// how often the opus encoder is reset so the file can be cut there
+	// cleanly, and the same in frames
+	SpliceInterval time.Duration
+	SpliceFrames   int
+
+	// if true, the json metadata is gzip compressed, which mostly pays off
+	// for files with a cover or lyrics
+	GzipMetadata bool
+
+	// if true, file outputs get a seek index in their metadata
+	WriteIndex bool
+
+	// if set, the output is split into files on wall clock boundaries of
+	// this length, named by using OutFile as a strftime pattern
+	SegmentTime time.Duration
+
+	// if true, buffering is cut to a minimum and 10ms lowdelay frames are
+	// used, for bridging live voice rather than encoding music
+	LowLatency bool
+
+	// size of the buffers on the encoding path and depth of the chans
+	// between its stages
+	BufferSize   = 16384
+	ChannelDepth = 10
+
+	// most parts per million a live input is resampled by to keep it in
+	// step with the wall clock, 0 for none
+	DriftCorrect int
+
+	// how late a frame of a live input can be before silence is sent in
+	// its place, 0 to wait for it however long it takes
+	FillGaps time.Duration
+
+	// file of time and gain points applied to the pcm before encoding
+	Automation string
+	Envelope   []gainPoint
+
+	// scheduling and I/O priority for dca and its children
+	Nice   int
+	IONice string
+
+	// named set of encode settings, overridden by any given explicitly
+	Preset string
+
+	// if true, the input is measured first and brought to LoudnessTarget
+	// LUFS by a gain of NormalizeGain dB
+	Normalize      bool
+	LoudnessTarget float64
+	NormalizeGain  float64
+
+	// metric the finished file is scored against its input with, if any
+	QualityMetric string
+
+	// a second pass spreads the bytes of TargetSize over the input by how
+	// many each part needed in the first
+	Passes     int
+	TargetSize string
+	Plan       *bitratePlan
+
+	// limits on the memory and cores dca and its children may use, enforced
+	// in a cgroup below Cgroup if given
+	MaxRSS   string
+	CPULimit float64
+	Cgroup   string
+
+	// limits on the space the output may take, checked before encoding and
+	// before each frame is written
+	MinFree     string
+	MaxOutput   string
+	OutputQuota string
+	Guard       *diskGuard
+
+	// if true, ffmpeg and ffprobe run in a sandbox
+	Sandbox bool
+
+	// if true, the audio format of the input and how ffmpeg converts it
+	// are printed to stderr
+	ShowConversion bool
+
+	// if true, the same input always gives byte-identical output, with
+	// encoder settings pinned and nothing about this build in the metadata
+	Deterministic bool
 
 	err error
 
 	wg sync.WaitGroup
 )
 
+// commands are run instead of encoding when named as the first argument
+var commands = map[string]func(args []string){
+	"abx":            abxCmd,
+	"catalog":        catalogCmd,
+	"clip":           clipCmd,
+	"cut":            cutCmd,
+	"decode":         decodeCmd,
+	"dedupe":         dedupeCmd,
+	"demux":          demuxCmd,
+	"doctor":         doctorCmd,
+	"duration":       durationCmd,
+	"export":         exportCmd,
+	"find":           findCmd,
+	"fsck":           fsckCmd,
+	"index":          indexCmd,
+	"loudness":       loudnessCmd,
+	"needs-reencode": needsReencodeCmd,
+	"worker":         workerCmd,
+}
+
 // init configures and parses the command line arguments
 func init() {
 
-	flag.StringVar(&InFile, "i", "pipe:0", "infile")
+	flag.Var(&Inputs, "i", "infile, fd:N for pcm16 on an open file descriptor, or a test signal like tone:440hz:30s or noise:pink:10s; repeat to mix several inputs")
+	flag.StringVar(&OutFile, "o", "pipe:1", "outfile")
+	flag.BoolVar(&AlbumMode, "album", false, "encode the files given as arguments gaplessly into one output with a track index")
+	flag.BoolVar(&SpriteMode, "sprite", false, "encode the files given as arguments into one output with an index of named clips")
+	flag.IntVar(&MetadataPadding, "metadata-padding", 0, "bytes of space to reserve after the metadata for retagging")
+	flag.BoolVar(&Dedup, "dedup", false, "write runs of repeated frames, such as silence, as repeat markers (needs a reader that supports them)")
+	flag.IntVar(&Parity, "parity", 0, "write a parity frame after every this many frames, so one lost frame of each group can be rebuilt")
+	flag.Var((*clockValue)(&StartTime), "ss", "time to start encoding the input at, like 1:23, 90 or 1m30s")
+	flag.Var((*clockValue)(&ClipTime), "t", "how much of the input to encode, like 0:30, 30 or 30s")
+	flag.DurationVar(&SpliceInterval, "splice-interval", 0, "reset the encoder every this long, e.g. 10s, recording the frames in the metadata so the file can be cut there cleanly")
+	flag.BoolVar(&GzipMetadata, "gzip-metadata", false, "gzip compress the metadata, for files with large covers")
+	flag.BoolVar(&WriteIndex, "index", false, "write an index of frame offsets into the metadata of file outputs, for seeking without reading every frame")
+	flag.BoolVar(&Multitrack, "multitrack", false, "encode each -i, given as id=input, as its own stream of a multitrack file")
+	flag.BoolVar(&OpusInput, "opus-in", false, "inputs are length prefixed 48kHz stereo opus packets to store without re-encoding")
+	flag.BoolVar(&NoFFmpeg, "no-ffmpeg", false, "read a wav file or pcm16 pipe without ffmpeg, doing -vol, resampling and channel mixing in dca")
+	flag.DurationVar(&SegmentTime, "segment-time", 0, "start a new outfile on each wall clock multiple of this, e.g. 1h with -o rec_%Y%m%d_%H.dca")
+	flag.StringVar(&Automation, "automation", "", "file of time and gain in dB points, like 1m30s -12, applied to the volume before encoding")
+	flag.IntVar(&DriftCorrect, "drift-correct", 0, "resample a live pcm input by up to this many parts per million to keep it in step with the wall clock")
+	flag.BoolVar(&AppendOutput, "append", false, "append frames to an existing outfile with the same opus settings")
+	flag.IntVar(&Nice, "nice", 0, "scheduling priority for dca and ffmpeg, from -20 (highest) to 19 (lowest)")
+	flag.StringVar(&IONice, "ionice", "", "I/O priority for dca and ffmpeg on linux, idle or best-effort[:0-7]")
+	flag.DurationVar(&FillGaps, "fill-gaps", 0, "send silence in place of frames a live input is this late with, e.g. 100ms, and mark the gaps in the metadata")
+	flag.BoolVar(&LowLatency, "low-latency", false, "minimal buffering with 10ms lowdelay frames, for live voice (overrides -as and -aa)")
 	flag.IntVar(&Volume, "vol", 256, "change audio volume (256=normal)")
 	flag.IntVar(&Channels, "ac", 2, "audio channels")
 	flag.IntVar(&FrameRate, "ar", 48000, "audio sampling rate")
 	flag.IntVar(&FrameSize, "as", 960, "audio frame size can be 960 (20ms), 1920 (40ms), or 2880 (60ms)")
 	flag.IntVar(&Bitrate, "ab", 64, "audio encoding bitrate in kb/s can be 8 - 128")
+	flag.BoolVar(&Normalize, "normalize", false, "measure the loudness of the input first and adjust its volume to -loudness-target")
+	flag.Float64Var(&LoudnessTarget, "loudness-target", -18, "integrated loudness in LUFS -normalize brings the input to")
+	flag.StringVar(&QualityMetric, "quality-metric", "", "score the finished file against the input with spectral, visqol or pesq, recording it in the metadata")
+	flag.IntVar(&Passes, "passes", 1, "encoding passes, 2 to fit the output into -target-size")
+	flag.StringVar(&TargetSize, "target-size", "", "most bytes the output may take, like 8MB, picking the bitrate to fit")
+	flag.StringVar(&MaxRSS, "max-rss", "", "most memory dca and ffmpeg may use together, like 512MB, stopping the encode past it")
+	flag.Float64Var(&CPULimit, "cpu-limit", 0, "most cores dca and ffmpeg may use together, like 1.5, only enforced with -cgroup")
+	flag.StringVar(&Cgroup, "cgroup", "", "delegated cgroup v2 folder to enforce -max-rss and -cpu-limit in, on linux")
+	flag.StringVar(&MinFree, "min-free", "", "free space to leave on the outfile's filesystem, like 1GB, stopping the encode rather than filling it")
+	flag.StringVar(&MaxOutput, "max-output", "", "most bytes the output may take, like 500MB, stopping the encode there")
+	flag.StringVar(&OutputQuota, "output-quota", "", "most bytes the outfile's folder may hold, like 50GB, stopping the encode there")
 	flag.BoolVar(&RawOutput, "raw", false, "Raw opus output (no metadata or magic bytes)")
 	flag.StringVar(&Application, "aa", "audio", "audio application can be voip, audio, or lowdelay")
 	flag.StringVar(&CoverFormat, "cf", "jpeg", "format the cover art will be encoded with")
+	flag.Int64Var(&MaxMemory, "max-memory", 0, "MB of cover art to buffer in memory before spilling to a temp file, with -cover-out (0 for no limit)")
+	flag.StringVar(&CoverOut, "cover-out", "", "write the cover art to this file instead of embedding it")
+	flag.StringVar(&Preset, "preset", "", "encode settings to start from, one of "+presetNames())
+	flag.BoolVar(&ShowConversion, "show-conversion", false, "print the audio format of the infile and how ffmpeg converts it for encoding to stderr")
+	flag.BoolVar(&Sandbox, "sandbox", false, "run ffmpeg and ffprobe under bubblewrap, with a read-only filesystem, no network for local files and no privileges")
+	flag.BoolVar(&Deterministic, "deterministic", false, "byte-identical output for identical input, for caching and dedup")
+
+	flag.BoolVar(&ErrorJSON, "errjson", false, "also write errors to stderr as json objects with their class and exit code")
 
 	if len(os.Args) < 2 {
 		flag.Usage()
-		os.Exit(1)
+		os.Exit(exitUsage)
 	}
 
 	flag.Parse()
 
-	MaxBytes = (FrameSize * Channels) * 2 // max size of opus data
+	if Preset != "" {
+		err := applyPreset(Preset, flag.CommandLine)
+		if err != nil {
+			reportError(exitUsage, "error:", err)
+			exit()
+		}
+	}
+
+	InFile = "pipe:0"
+	if len(Inputs) > 0 {
+		InFile = Inputs[0]
+	}
 }
 
 // very simple program that wraps ffmpeg and outputs raw opus data frames
 // with a uint16 header for each frame with the frame length in bytes
 func main() {
 
+	// exit with the code of the first error, once the rest of main's
+	// deferred cleanup has run
+	defer exit()
+
 	//////////////////////////////////////////////////////////////////////////
 	// BLOCK : Basic setup and validation
 	//////////////////////////////////////////////////////////////////////////
 
-	// If only one argument provided assume it's a filename.
-	if len(os.Args) == 2 {
-		InFile = os.Args[1]
+	// If the first argument names a command, run that instead.
+	if command, ok := commands[os.Args[1]]; ok {
+		command(os.Args[2:])
+		return
 	}
 
-	// If reading from a file, verify it exists.
-	if InFile != "pipe:0" {
+	// Lower our priority first so ffmpeg inherits it.
+	err = lowerPriority(Nice, IONice)
+	if err != nil {
+		reportError(exitFailure, err)
+		return
+	}
 
-		if _, err := os.Stat(InFile); os.IsNotExist(err) {
-			fmt.Println("error: infile does not exist")
-			flag.Usage()
-			return
-		}
+	// Likewise for the limits on memory and cores.
+	releaseLimits, err := applyLimits(MaxRSS, CPULimit, Cgroup)
+	if err != nil {
+		reportError(exitFailure, err)
+		return
 	}
+	defer releaseLimits()
 
-	// If reading from pipe, make sure pipe is open
-	if InFile == "pipe:0" {
-		fi, err := os.Stdin.Stat()
+	// Fail now rather than at the first ffmpeg if it can't be sandboxed.
+	if Sandbox {
+		err = checkSandbox()
 		if err != nil {
-			fmt.Println(err)
-			return
-		}
-
-		if (fi.Mode() & os.ModeCharDevice) == 0 {
-		} else {
-			fmt.Println("error: stdin is not a pipe.")
-			flag.Usage()
+			reportError(exitFailure, err)
 			return
 		}
 	}
 
-	//////////////////////////////////////////////////////////////////////////
-	// BLOCK : Create chans, buffers, and encoder for use
-	//////////////////////////////////////////////////////////////////////////
-
-	// create an opusEncoder to use
-	OpusEncoder, err = gopus.NewEncoder(FrameRate, Channels, gopus.Audio)
-	if err != nil {
-		fmt.Println("NewEncoder Error:", err)
-		return
+	// If only one argument provided assume it's a filename.
+	if len(os.Args) == 2 {
+		InFile = os.Args[1]
 	}
 
-	// set opus encoding options
-	//	OpusEncoder.SetVbr(true)                // bool
+	// A sprite is an album of clips that can each be played on their own.
+	if SpriteMode {
+		if RawOutput {
+			reportError(exitUsage, "error: -sprite can not be used with -raw")
+			return
+		}
 
-	if Bitrate < 1 || Bitrate > 512 {
-		Bitrate = 64 // Set to Discord default
-	}
-	OpusEncoder.SetBitrate(Bitrate * 1000)
+		names := make(map[string]bool)
+		for _, track := range flag.Args() {
+			name := clipName(track)
+			if names[name] {
+				reportError(exitUsage, "error: more than one clip is named", name)
+				return
+			}
+			names[name] = true
+		}
 
-	switch Application {
-	case "voip":
-		OpusEncoder.SetApplication(gopus.Voip)
-	case "audio":
-		OpusEncoder.SetApplication(gopus.Audio)
-	case "lowdelay":
-		OpusEncoder.SetApplication(gopus.RestrictedLowDelay)
-	default:
-		OpusEncoder.SetApplication(gopus.Audio)
+		AlbumMode = true
 	}
 
-	OutputChan = make(chan []byte, 10)
-	EncodeChan = make(chan []int16, 10)
-
-	if RawOutput == false {
-		// Setup the metadata
-		Metadata = MetadataStruct{
-			Dca: &DCAMetadata{
-				Version: FormatVersion,
-				Tool: &DCAToolMetadata{
-					Name:    "dca",
-					Version: ProgramVersion,
-					Url:     GitHubRepositoryURL,
-					Author:  "bwmarrin",
-				},
-			},
-			SongInfo: &SongMetadata{},
-			Origin:   &OriginMetadata{},
-			Opus: &OpusMetadata{
-				Bitrate:     Bitrate * 1000,
-				SampleRate:  FrameRate,
-				Application: Application,
-				FrameSize:   FrameSize,
-				Channels:    Channels,
-			},
-			Extra: &ExtraMetadata{},
+	// In album mode the tracks are the remaining arguments, in order.
+	if AlbumMode {
+		Tracks = flag.Args()
+		if len(Tracks) == 0 {
+			reportError(exitUsage, "error: -album requires at least one track")
+			flag.Usage()
+			return
 		}
-		_ = Metadata
-
-		// get ffprobe data
-		if InFile != "pipe:0" {
-			ffprobe := exec.Command("ffprobe", "-v", "quiet", "-print_format", "json", "-show_format", InFile)
-			ffprobe.Stdout = &CmdBuf
 
-			err = ffprobe.Start()
-			if err != nil {
-				fmt.Println("RunStart Error:", err)
+		for _, track := range Tracks {
+			if _, err := os.Stat(track); os.IsNotExist(err) {
+				reportError(exitInput, "error: track does not exist:", track)
 				return
 			}
+		}
 
-			err = ffprobe.Wait()
-			if err != nil {
-				fmt.Println("FFprobe Error:", err)
-				return
-			}
+		if AppendOutput {
+			reportError(exitUsage, "error: -album can not be used with -append")
+			return
+		}
 
-			err = json.Unmarshal(CmdBuf.Bytes(), &FFprobeData)
-			if err != nil {
-				fmt.Println("Erorr unmarshaling the FFprobe JSON:", err)
-				return
-			}
+		// song info and cover art for the album come from the first track
+		InFile = Tracks[0]
+	}
 
-			bitrateInt, err := strconv.Atoi(FFprobeData.Format.Bitrate)
-			if err != nil {
-				fmt.Println("Could not convert bitrate to int:", err)
-				return
-			}
+	// Each input of a multitrack file may be named with its stream id.
+	if Multitrack {
+		if AlbumMode || AppendOutput || RawOutput {
+			reportError(exitUsage, "error: -multitrack can not be used with -album, -append or -raw")
+			return
+		}
 
-			Metadata.SongInfo = &SongMetadata{
-				Title:    FFprobeData.Format.Tags.Title,
-				Artist:   FFprobeData.Format.Tags.Artist,
-				Album:    FFprobeData.Format.Tags.Album,
-				Genre:    FFprobeData.Format.Tags.Genre,
-				Comments: "", // change later?
-			}
+		if len(Inputs) == 0 {
+			reportError(exitUsage, "error: -multitrack requires at least one -i")
+			return
+		}
 
-			Metadata.Origin = &OriginMetadata{
-				Source:   "file",
-				Bitrate:  bitrateInt,
-				Channels: Channels,
-				Encoding: FFprobeData.Format.FormatLongName,
-			}
+		Streams, Inputs, err = parseStreams(Inputs)
+		if err != nil {
+			reportError(exitUsage, "error:", err)
+			return
+		}
+		InFile = Inputs[0]
+	} else {
+		Mixing = len(Inputs) > 1
+	}
 
-			CmdBuf.Reset()
+	// Discord voice is always 48kHz stereo in 20ms packets.
+	if OpusInput {
+		if Mixing || AlbumMode || isSignal(InFile) {
+			reportError(exitUsage, "error: -opus-in can not be used with -album, test signals or mixed inputs")
+			return
+		}
 
-			// get cover art
-			cover := exec.Command("ffmpeg", "-loglevel", "0", "-i", InFile, "-f", "singlejpeg", "pipe:1")
-			cover.Stdout = &CmdBuf
+		FrameRate = 48000
+		Channels = 2
+		FrameSize = 960
+	}
 
-			err = cover.Start()
-			if err != nil {
-				fmt.Println("RunStart Error:", err)
+	// Several inputs are mixed into one output, or kept as streams.
+	if len(Inputs) > 1 || Multitrack {
+		if AlbumMode {
+			reportError(exitUsage, "error: -album can not be used with more than one -i")
+			return
+		}
+
+		for _, input := range Inputs {
+			if isSignal(input) {
+				reportError(exitUsage, "error: test signals can not be mixed with other inputs")
 				return
 			}
 
-			err = cover.Wait()
-			if err == nil {
-				buf := bytes.NewBufferString(CmdBuf.String())
-
-				if CoverFormat == "png" {
-					img, err := jpeg.Decode(buf)
-					if err == nil { // silently drop it, no image
-						err = png.Encode(&PngBuf, img)
-						if err == nil {
-							CoverImage = base64.StdEncoding.EncodeToString(PngBuf.Bytes())
-						}
-					}
-				} else {
-					CoverImage = base64.StdEncoding.EncodeToString(CmdBuf.Bytes())
-				}
-
-				Metadata.SongInfo.Cover = &CoverImage
+			if isPipe(input) {
+				continue
 			}
 
-			CmdBuf.Reset()
-			PngBuf.Reset()
-		} else {
-			Metadata.Origin = &OriginMetadata{
-				Source:   "pipe",
-				Channels: Channels,
-				Encoding: "pcm16/s16le",
+			if _, err := os.Stat(input); os.IsNotExist(err) {
+				reportError(exitInput, "error: infile does not exist:", input)
+				return
 			}
 		}
 	}
 
-	//////////////////////////////////////////////////////////////////////////
-	// BLOCK : Start reader and writer workers
-	//////////////////////////////////////////////////////////////////////////
-
-	wg.Add(1)
-	go reader()
-
-	wg.Add(1)
-	go encoder()
-
-	wg.Add(1)
-	go writer()
-
-	// wait for above goroutines to finish, then exit.
-	wg.Wait()
-}
-
-// reader reads from the input
-func reader() {
-
-	defer func() {
-		close(EncodeChan)
-		wg.Done()
-	}()
+	// Test signals are generated instead of read from a file.
+	if isSignal(InFile) {
+		Signal, err = parseSignal(InFile)
+		if err != nil {
+			reportError(exitUsage, "error:", err)
+			return
+		}
+	}
 
-	// read from file
-	if InFile != "pipe:0" {
+	// If reading from a file, verify it exists.
+	if !isPipe(InFile) && Signal == nil {
 
-		// Create a shell command "object" to run.
-		ffmpeg := exec.Command("ffmpeg", "-i", InFile, "-vol", strconv.Itoa(Volume), "-f", "s16le", "-ar", strconv.Itoa(FrameRate), "-ac", strconv.Itoa(Channels), "pipe:1")
-		stdout, err := ffmpeg.StdoutPipe()
-		if err != nil {
-			fmt.Println("StdoutPipe Error:", err)
+		if _, err := os.Stat(InFile); os.IsNotExist(err) {
+			reportError(exitInput, "error: infile does not exist")
+			flag.Usage()
 			return
 		}
+	}
 
-		// Starts the ffmpeg command
-		err = ffmpeg.Start()
+	// If reading from pipe, make sure pipe is open
+	if InFile == "pipe:0" && len(Inputs) < 2 && !Multitrack {
+		fi, err := os.Stdin.Stat()
 		if err != nil {
-			fmt.Println("RunStart Error:", err)
+			reportError(exitInput, err)
 			return
 		}
 
-		for {
-
-			// read data from ffmpeg stdout
-			InBuf := make([]int16, FrameSize*Channels)
-			err = binary.Read(stdout, binary.LittleEndian, &InBuf)
-			if err == io.EOF || err == io.ErrUnexpectedEOF {
-				return
-			}
-			if err != nil {
-				fmt.Println("error reading from ffmpeg stdout :", err)
-				return
-			}
-
-			// write pcm data to the EncodeChan
-			EncodeChan <- InBuf
-
+		if (fi.Mode() & os.ModeCharDevice) == 0 {
+		} else {
+			reportError(exitInput, "error: stdin is not a pipe.")
+			flag.Usage()
+			return
 		}
 	}
 
-	// read input from stdin pipe
-	if InFile == "pipe:0" {
-
-		// 16KB input buffer
-		rbuf := bufio.NewReaderSize(os.Stdin, 16384)
-		for {
-
-			// read data from stdin
-			InBuf := make([]int16, FrameSize*Channels)
+	// Wav and pcm16 input can be converted without ffmpeg, for containers
+	// that don't have it.
+	if NoFFmpeg {
+		if Mixing || AlbumMode || Multitrack || OpusInput || Signal != nil {
+			reportError(exitUsage, "error: -no-ffmpeg can not be used with -album, -multitrack, -opus-in, test signals or mixed inputs")
+			return
+		}
 
-			err = binary.Read(rbuf, binary.LittleEndian, &InBuf)
-			if err == io.EOF || err == io.ErrUnexpectedEOF {
-				return
-			}
-			if err != nil {
-				fmt.Println("error reading from ffmpeg stdout :", err)
-				return
-			}
+		WavIn, err = openWav(InFile)
+		if err != nil {
+			reportError(exitInput, "error opening input:", err)
+			return
+		}
 
-			// write pcm data to the EncodeChan
-			EncodeChan <- InBuf
+		// there is only a downmix to stereo or mono to go by
+		if WavIn.channels > Channels && Channels > 2 {
+			reportError(exitUsage, "error: -no-ffmpeg can only mix", WavIn.channels, "channels down to stereo or mono")
+			return
 		}
 	}
 
-}
-
-// encoder listens on the EncodeChan and encodes provided PCM16 data
-// to opus, then sends the encoded data to the OutputChan
-func encoder() {
+	if MetadataPadding < 0 {
+		reportError(exitUsage, "error: -metadata-padding can not be negative")
+		return
+	}
 
-	defer func() {
-		close(OutputChan)
-		wg.Done()
-	}()
+	// If appending, the output must be a file.
+	if AppendOutput && OutFile == "pipe:1" {
+		reportError(exitUsage, "error: -append requires an outfile")
+		flag.Usage()
+		return
+	}
 
-	for {
-		pcm, ok := <-EncodeChan
-		if !ok {
-			// if chan closed, exit
+	// Fades and ducking scripted by other tools are applied before encoding.
+	if Automation != "" {
+		if OpusInput || Multitrack {
+			reportError(exitUsage, "error: -automation can not be used with -opus-in or -multitrack")
 			return
 		}
 
-		// try encoding pcm frame with Opus
-		opus, err := OpusEncoder.Encode(pcm, FrameSize, MaxBytes)
+		f, err := os.Open(Automation)
 		if err != nil {
-			fmt.Println("Encoding Error:", err)
+			reportError(exitInput, "error opening automation:", err)
 			return
 		}
 
-		// write opus data to OutputChan
-		OutputChan <- opus
-	}
-}
-
-// writer listens on the OutputChan and writes the output to stdout pipe
-// TODO: Add support for writing directly to a file
-func writer() {
-
-	defer wg.Done()
-
-	var opuslen int16
-	var jsonlen int32
-
-	// 16KB output buffer
-	wbuf := bufio.NewWriterSize(os.Stdout, 16384)
-
-	if RawOutput == false {
-		// write the magic bytes
-		fmt.Print(MagicBytes)
-
-		// encode and write json length
-		json, err := json.Marshal(Metadata)
+		Envelope, err = parseAutomation(f)
+		f.Close()
 		if err != nil {
-			fmt.Println("Failed to encode the Metadata JSON:", err)
+			reportError(exitInput, "error reading automation:", err)
 			return
 		}
+	}
 
-		jsonlen = int32(len(json))
-		err = binary.Write(wbuf, binary.LittleEndian, &jsonlen)
-		if err != nil {
-			fmt.Println("error writing output: ", err)
+	// Only live inputs keep time with the wall clock.
+	if DriftCorrect != 0 {
+		if !isPipe(InFile) || Mixing || Multitrack || OpusInput {
+			reportError(exitUsage, "error: -drift-correct requires a single pcm input from stdin or fd:N")
 			return
 		}
 
-		// write the actual json
-		wbuf.Write(json)
+		if DriftCorrect < 0 || DriftCorrect > 10000 {
+			reportError(exitUsage, "error: -drift-correct must be from 0 to 10000 parts per million")
+			return
+		}
 	}
 
-	for {
-		opus, ok := <-OutputChan
-		if !ok {
-			// if chan closed, exit
-			return
+	// Gaps are only filled for inputs that play out as they arrive.
+	if FillGaps != 0 {
+		pipes := isPipe(InFile)
+		for _, input := range Inputs {
+			pipes = pipes && isPipe(input)
 		}
 
-		// write header
-		opuslen = int16(len(opus))
-		err = binary.Write(wbuf, binary.LittleEndian, &opuslen)
-		if err != nil {
-			fmt.Println("error writing output: ", err)
+		if !pipes || Multitrack || OpusInput {
+			reportError(exitUsage, "error: -fill-gaps requires pcm inputs from stdin or fd:N")
 			return
 		}
 
-		// write opus data to stdout
-		err = binary.Write(wbuf, binary.LittleEndian, &opus)
-		if err != nil {
-			fmt.Println("error writing output: ", err)
+		if FillGaps < 0 || SegmentTime != 0 {
+			reportError(exitUsage, "error: -fill-gaps must be positive and can not be used with -segment-time")
 			return
 		}
 	}
+
+	// Embedded cover art ends up in the metadata in memory whatever the
+	// limit, so only a side file is kept from holding it all.
+	if MaxMemory != 0 {
+		if MaxMemory < 0 || CoverOut == "" {
+			reportError(exitUsage, "error: -max-memory must be positive and requires -cover-out")
+			return
+		}
+	}
+
+	// Live voice trades compression and throughput for latency.
+	if LowLatency {
+		if OpusInput {
+			reportError(exitUsage, "error: -low-latency can not be used with -opus-in")
+			return
+		}
+
+		FrameSize = FrameRate / 100
+		Application = "lowdelay"
+
+		BufferSize = 512
+		ChannelDepth = 1
+	}
+
+	// Segmented output names each file after the time it starts.
+	if SegmentTime != 0 {
+		if SegmentTime < time.Second {
+			reportError(exitUsage, "error: -segment-time must be at least 1s")
+			return
+		}
+
+		if OutFile == "pipe:1" || !strings.Contains(OutFile, "%") {
+			reportError(exitUsage, "error: -segment-time requires an outfile pattern like", "rec_%Y%m%d_%H.dca")
+			return
+		}
+
+		if AppendOutput || AlbumMode {
+			reportError(exitUsage, "error: -segment-time can not be used with -append or -album")
+			return
+		}
+
+		if Deterministic {
+			reportError(exitUsage, "error: -segment-time can not be used with -deterministic")
+			return
+		}
+	}
+
+	// Repeat markers need the metadata to say they are used.
+	if Dedup && (RawOutput || AppendOutput || Multitrack) {
+		reportError(exitUsage, "error: -dedup can not be used with -raw, -append or -multitrack")
+		return
+	}
+
+	// Parity frames are declared in the metadata and follow whole groups.
+	if Parity != 0 {
+		if Parity < 1 || Parity > maxParity {
+			reportError(exitUsage, "error: -parity must be from 1 to", maxParity)
+			return
+		}
+
+		if RawOutput || AppendOutput || Multitrack || Dedup {
+			reportError(exitUsage, "error: -parity can not be used with -raw, -append, -multitrack or -dedup")
+			return
+		}
+	}
+
+	// ffmpeg seeks the input and stops reading it, while a single pipe or
+	// -no-ffmpeg input is trimmed in dca.
+	if StartTime != 0 || ClipTime != 0 {
+		if StartTime < 0 || ClipTime < 0 {
+			reportError(exitUsage, "error: -ss and -t can not be negative")
+			return
+		}
+
+		pipes := false
+		if Mixing || Multitrack {
+			for _, input := range Inputs {
+				pipes = pipes || isPipe(input)
+			}
+		}
+
+		if pipes || Signal != nil || OpusInput || AlbumMode || SpriteMode {
+			reportError(exitUsage, "error: -ss and -t can not be used with mixed or multitrack pipes, test signals, -opus-in, -album or -sprite")
+			return
+		}
+	}
+
+	// Splice points are recorded in the metadata once the file is done.
+	if SpliceInterval != 0 {
+		SpliceFrames = int(SpliceInterval * time.Duration(FrameRate) / time.Duration(FrameSize) / time.Second)
+		if SpliceFrames < 1 {
+			reportError(exitUsage, "error: -splice-interval must be at least one frame")
+			return
+		}
+
+		if RawOutput || AppendOutput || SegmentTime != 0 || Multitrack || OpusInput {
+			reportError(exitUsage, "error: -splice-interval can not be used with -raw, -append, -segment-time, -multitrack or -opus-in")
+			return
+		}
+	}
+
+	// The seek index is built from the finished file.
+	if WriteIndex && (OutFile == "pipe:1" || RawOutput || Multitrack) {
+		reportError(exitUsage, "error: -index requires an outfile and can not be used with -raw or -multitrack")
+		return
+	}
+
+	// Normalizing measures the whole input before encoding any of it.
+	if Normalize {
+		if isPipe(InFile) || Mixing || Multitrack || OpusInput || NoFFmpeg || Signal != nil || AlbumMode || SpriteMode {
+			reportError(exitUsage, "error: -normalize requires a single file input")
+			return
+		}
+
+		if LoudnessTarget < -70 || LoudnessTarget > 0 {
+			reportError(exitUsage, "error: -loudness-target must be from -70 to 0 LUFS")
+			return
+		}
+	}
+
+	// Scoring decodes the finished file and the input again to compare.
+	if QualityMetric != "" {
+		if _, ok := qualityMetrics[QualityMetric]; !ok {
+			reportError(exitUsage, "error: -quality-metric must be spectral, visqol or pesq")
+			return
+		}
+
+		if isPipe(InFile) || Mixing || Multitrack || OpusInput || NoFFmpeg || Signal != nil || AlbumMode || SpriteMode {
+			reportError(exitUsage, "error: -quality-metric requires a single file input")
+			return
+		}
+
+		if OutFile == "pipe:1" || RawOutput || AppendOutput || SegmentTime > 0 || Automation != "" {
+			reportError(exitUsage, "error: -quality-metric requires an outfile and can not be used with -raw, -append, -segment-time or -automation")
+			return
+		}
+	}
+
+	// A size budget needs to know how long the input is to spend it.
+	var targetBytes int64
+	if Passes != 1 && Passes != 2 {
+		reportError(exitUsage, "error: -passes must be 1 or 2")
+		return
+	}
+
+	if Passes == 2 && TargetSize == "" {
+		reportError(exitUsage, "error: -passes 2 requires -target-size")
+		return
+	}
+
+	if TargetSize != "" {
+		targetBytes, err = parseSize(TargetSize)
+		if err != nil {
+			reportError(exitUsage, "error:", err)
+			return
+		}
+
+		if AppendOutput || SegmentTime != 0 || Mixing || Multitrack || OpusInput {
+			reportError(exitUsage, "error: -target-size can not be used with -append, -segment-time, -opus-in or more than one -i")
+			return
+		}
+
+		if isPipe(InFile) {
+			reportError(exitUsage, "error: -target-size requires an input of known length")
+			return
+		}
+
+		if Passes == 2 && (Signal != nil || AlbumMode) {
+			reportError(exitUsage, "error: -passes 2 requires a single file input")
+			return
+		}
+	}
+
+	// fail now if there is no room for the output, and stop before there
+	// is none left rather than writing until the disk is full
+	if OutFile == "pipe:1" && (MinFree != "" || OutputQuota != "") {
+		reportError(exitUsage, "error: -min-free and -output-quota require an outfile")
+		return
+	}
+
+	Guard, err = newDiskGuard(strftime(OutFile, time.Now()))
+	if err != nil {
+		reportError(exitOutput, "error:", err)
+		return
+	}
+
+	// If writing to a file, open it now so we fail before encoding anything.
+	if OutFile != "pipe:1" && SegmentTime == 0 {
+		Output, err = openOutput()
+		if err != nil {
+			reportError(exitOutput, "error opening outfile:", err)
+			return
+		}
+		defer Output.Close()
+
+		if fi, err := Output.Stat(); err == nil && fi.Mode().IsRegular() {
+			Seekable = true
+		}
+	}
+
+	//////////////////////////////////////////////////////////////////////////
+	// BLOCK : Create chans, buffers, and encoder for use
+	//////////////////////////////////////////////////////////////////////////
+
+	if Bitrate < 1 || Bitrate > 512 {
+		Bitrate = 64 // Set to Discord default
+	}
+
+	// create an opusEncoder to use
+	OpusEncoder, err = newEncoder()
+	if err != nil {
+		reportError(exitEncode, "NewEncoder Error:", err)
+		return
+	}
+
+	if RawOutput == false {
+		// Setup the metadata
+		Metadata = MetadataStruct{
+			Dca: &DCAMetadata{
+				Version: FormatVersion,
+				Tool: &DCAToolMetadata{
+					Name:    "dca",
+					Version: ProgramVersion,
+					Url:     GitHubRepositoryURL,
+					Author:  "bwmarrin",
+				},
+			},
+			SongInfo: &SongMetadata{},
+			Origin:   &OriginMetadata{},
+			Opus: &OpusMetadata{
+				Bitrate:     Bitrate * 1000,
+				SampleRate:  FrameRate,
+				Application: Application,
+				FrameSize:   FrameSize,
+				Channels:    Channels,
+			},
+			Extra:   &ExtraMetadata{},
+			Streams: Streams,
+		}
+		_ = Metadata
+
+		if Dedup {
+			Metadata.Dca.Extensions = []string{repeatExtension}
+		}
+
+		if Parity > 0 {
+			Metadata.Dca.Extensions = []string{parityExtension}
+			Metadata.Dca.Parity = Parity
+		}
+
+		// an entry for every second, filled in once the file is done
+		if WriteIndex {
+			Metadata.Extra.Index = &SeekIndex{Interval: FrameRate / FrameSize}
+		}
+
+		// which build wrote the file would make otherwise identical
+		// output differ between versions
+		if Deterministic {
+			Metadata.Dca.Tool.Version = ""
+		}
+
+		// the bitrate of opus input is whatever the sender used, the
+		// average is filled in once the file is done
+		encoding := "pcm16/s16le"
+		if OpusInput {
+			encoding = "opus"
+			Metadata.Opus.Bitrate = 0
+		}
+
+		// the delay of whoever encoded opus input is unknown
+		if !OpusInput {
+			Metadata.Opus.PreSkip = dcaenc.PreSkip(Application)
+		}
+
+		Metadata.Opus.SpliceInterval = SpliceFrames
+
+		// get ffprobe data
+		if Multitrack {
+			Metadata.Origin = &OriginMetadata{
+				Source:   "multitrack",
+				Channels: Channels,
+				Encoding: encoding,
+			}
+		} else if OpusInput {
+			Metadata.Origin = &OriginMetadata{
+				Source:   inputSource(InFile),
+				Channels: Channels,
+				Encoding: encoding,
+			}
+		} else if Mixing {
+			Metadata.Origin = &OriginMetadata{
+				Source:   "mix",
+				Channels: Channels,
+				Encoding: "pcm16/s16le",
+			}
+		} else if Signal != nil {
+			Metadata.SongInfo = &SongMetadata{
+				Title: InFile,
+			}
+
+			Metadata.Origin = &OriginMetadata{
+				Source:   "generator",
+				Channels: Channels,
+				Encoding: "pcm16/s16le",
+			}
+		} else if NoFFmpeg {
+			Metadata.Origin = &OriginMetadata{
+				Source:   inputSource(InFile),
+				Channels: WavIn.channels,
+				Encoding: WavIn.encoding,
+			}
+		} else if !isPipe(InFile) {
+			FFprobeData, err = probe(InFile)
+			if err != nil {
+				reportError(exitFFmpeg, "FFprobe Error:", err)
+				return
+			}
+
+			bitrateInt, err := strconv.Atoi(FFprobeData.Format.Bitrate)
+			if err != nil {
+				reportError(exitFFmpeg, "Could not convert bitrate to int:", err)
+				return
+			}
+
+			Metadata.SongInfo = &SongMetadata{
+				Title:    FFprobeData.Format.Tags.Title,
+				Artist:   FFprobeData.Format.Tags.Artist,
+				Album:    FFprobeData.Format.Tags.Album,
+				Genre:    FFprobeData.Format.Tags.Genre,
+				Comments: "", // change later?
+			}
+
+			Metadata.Origin = &OriginMetadata{
+				Source:   "file",
+				Bitrate:  bitrateInt,
+				Channels: Channels,
+				Encoding: FFprobeData.Format.FormatLongName,
+			}
+
+			// cover art is buffered in memory up to -max-memory
+			CmdBuf = newSpillBuffer(MaxMemory << 20)
+			PngBuf = newSpillBuffer(MaxMemory << 20)
+
+			// get cover art
+			cover := mediaCommand(InFile, "ffmpeg", "-loglevel", "0", "-i", InFile)
+			cover.Args = append(cover.Args, bitexactArgs()...)
+			cover.Args = append(cover.Args, "-f", "singlejpeg", "pipe:1")
+			cover.Stdout = CmdBuf
+
+			err = cover.Start()
+			if err != nil {
+				reportError(exitFFmpeg, "RunStart Error:", err)
+				return
+			}
+
+			err = cover.Wait()
+			if err == nil {
+				image := CmdBuf
+
+				if CoverFormat == "png" {
+					image = PngBuf
+
+					buf, err := CmdBuf.Reader()
+					if err == nil {
+						img, err := jpeg.Decode(buf)
+						if err == nil { // silently drop it, no image
+							png.Encode(PngBuf, img)
+						}
+					}
+				}
+
+				// a side file keeps the header small for streaming
+				if CoverOut != "" {
+					if image.Len() > 0 {
+						err = writeCover(CoverOut, image)
+						if err != nil {
+							reportError(exitOutput, "error writing cover:", err)
+							return
+						}
+					}
+				} else {
+					CoverImage, err = encodeCover(image)
+					if err != nil {
+						reportError(exitFailure, "error reading cover:", err)
+						return
+					}
+					Metadata.SongInfo.Cover = &CoverImage
+				}
+			}
+
+			CmdBuf.Close()
+			PngBuf.Close()
+
+			if AlbumMode {
+				Metadata.SongInfo.Title = FFprobeData.Format.Tags.Album
+			}
+		} else {
+			Metadata.Origin = &OriginMetadata{
+				Source:   inputSource(InFile),
+				Channels: Channels,
+				Encoding: "pcm16/s16le",
+			}
+		}
+	}
+
+	if Normalize {
+		report, err := measureLoudness()
+		if err != nil {
+			reportError(errorCode(err), "error measuring loudness:", err)
+			return
+		}
+
+		NormalizeGain = normalizeGain(report, LoudnessTarget)
+		if RawOutput == false {
+			Metadata.Extra.Loudness = &LoudnessMetadata{
+				Integrated: report.Integrated,
+				TruePeak:   report.TruePeak,
+				Range:      report.Range,
+				Gain:       NormalizeGain,
+			}
+		}
+	}
+
+	// both ways of meeting -target-size need the metadata to know how much
+	// room the header leaves for audio
+	if Passes == 2 {
+		Plan, err = planBitrate(targetBytes)
+		if err != nil {
+			reportError(errorCode(err), "error planning bitrate:", err)
+			return
+		}
+
+		if RawOutput == false {
+			Metadata.Opus.Bitrate = Plan.average()
+		}
+	} else if TargetSize != "" {
+		bitrate, err := targetBitrate(targetBytes)
+		if err != nil {
+			reportError(errorCode(err), "error choosing bitrate:", err)
+			return
+		}
+
+		if bitrate < floorBitrate {
+			fmt.Fprintf(os.Stderr, "warning: -target-size leaves %d b/s, quality will suffer below %d b/s\n", bitrate, floorBitrate)
+		}
+		if bitrate < minBitrate {
+			bitrate = minBitrate
+		}
+
+		Bitrate = bitrate / 1000
+		OpusEncoder.SetBitrate(bitrate)
+		if RawOutput == false {
+			Metadata.Opus.Bitrate = bitrate
+		}
+	}
+
+	// the fingerprint hashes the bitrate, which -passes 2 and -target-size
+	// only just settled on
+	if RawOutput == false {
+		Metadata.Opus.Fingerprint = dcaenc.Fingerprint(Metadata.Opus, Volume)
+	}
+
+	if ShowConversion {
+		showConversion()
+	}
+
+	//////////////////////////////////////////////////////////////////////////
+	// BLOCK : Build the pipeline and run it
+	//////////////////////////////////////////////////////////////////////////
+
+	encode := &pipeline{
+		Encoder: encoder,
+		Sink:    writer,
+	}
+
+	if SegmentTime != 0 {
+		encode.Sink = segmentWriter
+	}
+
+	if DriftCorrect != 0 {
+		encode.PCMStages = append(encode.PCMStages, driftCorrector(DriftCorrect))
+	}
+
+	if NormalizeGain != 0 {
+		encode.PCMStages = append(encode.PCMStages, envelope([]gainPoint{{Gain: NormalizeGain}}))
+	}
+
+	if Envelope != nil {
+		encode.PCMStages = append(encode.PCMStages, envelope(Envelope))
+	}
+
+	if FillGaps != 0 {
+		encode.OpusStages = append(encode.OpusStages, gapFiller(FillGaps))
+	}
+
+	switch {
+	case Multitrack:
+		// each stream of a multitrack file has its own encoder
+		encode.OpusSource = multitrackEncoder
+	case OpusInput:
+		encode.OpusSource = func(out chan<- []byte) error {
+			return readOpus(InFile, out)
+		}
+	case AlbumMode:
+		encode.PCMSource = albumReader
+		if SpriteMode {
+			spriteClips = make(chan *spriteClip, len(Tracks))
+		}
+	case Mixing:
+		encode.PCMSource = mixReader
+	case Signal != nil:
+		encode.PCMSource = signalReader
+	case NoFFmpeg:
+		encode.PCMSource = wavReader
+	default:
+		encode.PCMSource = reader
+	}
+
+	// take ffmpeg down with us if we are interrupted
+	handleSignals()
+
+	// run the stages, then exit once they have all finished.
+	encode.Run()
+	releaseLimits()
+
+	// only the first error is reported, the rest follow from it
+	if err := failure(); err != nil {
+		reportError(errorCode(err), err)
+	}
+
+	// the score goes into the header with the rest
+	if QualityMetric != "" && Seekable && failure() == nil && !aborted() {
+		Quality, err = measureQuality(Output, QualityMetric)
+		if err != nil {
+			reportError(errorCode(err), "error measuring quality:", err)
+		}
+	}
+
+	// fill in what could not be known when the header was written
+	if Seekable && RawOutput == false {
+		err = patchHeader(Output)
+		if err != nil {
+			reportError(exitOutput, "error updating header:", err)
+		}
+	}
+
+	if Quality != nil {
+		fmt.Fprintf(os.Stderr, "quality: %s %.2f\n", Quality.Metric, Quality.Score)
+	}
+
+	// ffmpeg's own error has been printed to stderr already
+	if SourceError != "" {
+		recordError(exitFFmpeg, SourceError)
+	}
+	if aborted() {
+		recordError(exitFailure, "interrupted")
+	}
+	if aborted() || SourceError != "" {
+		return
+	}
+
+	// the bitrate can only aim for the budget, so check it was kept. The
+	// header may have been rewritten into a new file, so the path is
+	// looked at again rather than Output.
+	if targetBytes > 0 && Seekable {
+		if fi, err := os.Stat(OutFile); err == nil && fi.Size() > targetBytes {
+			reportError(exitOutput, fmt.Sprintf("error: output is %d bytes, over -target-size by %d", fi.Size(), fi.Size()-targetBytes))
+		}
+	}
+}
+
+// reader reads from the input
+func reader(out chan<- []int16) error {
+
+	// read from file
+	if !isPipe(InFile) {
+
+		// Create a shell command "object" to run.
+		ffmpeg := pcmCommand(InFile)
+		stdout, err := ffmpeg.StdoutPipe()
+		if err != nil {
+			return classify(exitFFmpeg, fmt.Errorf("StdoutPipe Error: %s", err))
+		}
+
+		// Starts the ffmpeg command
+		err = startCommand(ffmpeg)
+		if err != nil {
+			return classify(exitFFmpeg, fmt.Errorf("RunStart Error: %s", err))
+		}
+		defer func() {
+			err := waitCommand(ffmpeg)
+			if err != nil && !aborted() {
+				sourceFailed(ffmpeg, err)
+			}
+		}()
+
+		// raw bytes of one frame, converted to samples by hand as this
+		// runs for every frame
+		buf := make([]byte, FrameSize*Channels*2)
+
+		for {
+
+			// read data from ffmpeg stdout
+			n, err := io.ReadFull(stdout, buf)
+			if n > 0 {
+				padFrame(buf, n)
+
+				// write pcm data to the encoder
+				select {
+				case out <- pcmFrame(buf):
+				case <-quit:
+					return nil
+				}
+			}
+
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return nil
+			}
+			if err != nil {
+				return classify(exitFFmpeg, fmt.Errorf("error reading from ffmpeg stdout: %s", err))
+			}
+		}
+	}
+
+	// read input from stdin or another open pipe
+	if isPipe(InFile) {
+
+		in, err := openPipe(InFile)
+		if err != nil {
+			return fmt.Errorf("error opening input: %s", err)
+		}
+
+		// input buffer, 16KB unless -low-latency
+		rbuf := bufio.NewReaderSize(in, BufferSize)
+		buf := make([]byte, FrameSize*Channels*2)
+
+		r, err := trimInput(rbuf, FrameRate, Channels*2)
+		if err != nil {
+			return fmt.Errorf("error reading input: %s", err)
+		}
+
+		for {
+
+			// read data from stdin
+			n, err := io.ReadFull(r, buf)
+			if n > 0 {
+				padFrame(buf, n)
+
+				// write pcm data to the encoder
+				select {
+				case out <- pcmFrame(buf):
+				case <-quit:
+					return nil
+				}
+			}
+
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("error reading from ffmpeg stdout: %s", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// albumReader reads each of the album tracks in turn and sends their pcm
+// on with no gap between them, so a frame may hold the end
+// of one track and the start of the next.
+func albumReader(out chan<- []int16) error {
+
+	framebytes := FrameSize * Channels * 2
+	buf := make([]byte, framebytes)
+	filled := 0   // bytes of buf already holding pcm
+	position := 0 // samples per channel read so far
+	padding := 0  // samples of silence the last clip was padded with
+
+	for _, track := range Tracks {
+
+		start := position
+
+		var info *TrackMetadata
+		if RawOutput == false {
+			info = &TrackMetadata{
+				Info: &SongMetadata{
+					Title: filepath.Base(track),
+				},
+			}
+
+			// the encoder places the clips of a sprite, as it adds
+			// frames between them
+			if SpriteMode {
+				spriteClips <- &spriteClip{info: info, frame: start / FrameSize, padding: padding}
+			} else {
+				info.Offset = start / FrameSize
+			}
+
+			probed, err := probe(track)
+			if err == nil {
+				tags := probed.Format.Tags
+				if tags.Title != "" {
+					info.Info.Title = tags.Title
+				}
+				info.Info.Artist = tags.Artist
+				info.Info.Album = tags.Album
+				info.Info.Genre = tags.Genre
+			}
+
+			Metadata.Tracks = append(Metadata.Tracks, info)
+		}
+
+		ffmpeg := pcmCommand(track)
+		stdout, err := ffmpeg.StdoutPipe()
+		if err != nil {
+			return classify(exitFFmpeg, fmt.Errorf("StdoutPipe Error: %s", err))
+		}
+
+		err = startCommand(ffmpeg)
+		if err != nil {
+			return classify(exitFFmpeg, fmt.Errorf("RunStart Error: %s", err))
+		}
+
+		for {
+			n, err := io.ReadFull(stdout, buf[filled:])
+			filled += n
+			position += n / (Channels * 2)
+
+			if filled == framebytes {
+				select {
+				case out <- pcmFrame(buf):
+				case <-quit:
+					waitCommand(ffmpeg)
+					return nil
+				}
+				filled = 0
+			}
+
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			if err != nil {
+				waitCommand(ffmpeg)
+				return classify(exitFFmpeg, fmt.Errorf("error reading from ffmpeg stdout: %s", err))
+			}
+		}
+
+		if info != nil {
+			info.Duration = (position - start) * 1000 / FrameRate
+		}
+
+		// clips don't share frames so each can be played on its own
+		if SpriteMode {
+			EndPadding = 0
+			if filled > 0 {
+				padFrame(buf, filled)
+
+				select {
+				case out <- pcmFrame(buf):
+				case <-quit:
+					waitCommand(ffmpeg)
+					return nil
+				}
+
+				filled = 0
+				position += FrameSize - position%FrameSize
+			}
+
+			info.Name = clipName(track)
+			padding = EndPadding
+		}
+
+		err = waitCommand(ffmpeg)
+		if err != nil && !aborted() {
+			sourceFailed(ffmpeg, err)
+			return nil
+		}
+	}
+
+	// pad the end of the last track out to a whole frame
+	if filled > 0 {
+		padFrame(buf, filled)
+
+		select {
+		case out <- pcmFrame(buf):
+		case <-quit:
+		}
+	}
+
+	return nil
+}
+
+// spriteClip is where a clip of a sprite starts in the input, sent by
+// albumReader ahead of its first frame so the encoder can reset between
+// clips. padding is the silence the clip before it was padded with.
+type spriteClip struct {
+	info    *TrackMetadata
+	frame   int
+	padding int
+}
+
+// spriteClips carries the clips of a sprite from albumReader to the
+// encoder
+var spriteClips chan *spriteClip
+
+// pcmFrame converts little endian pcm16 bytes to samples
+func pcmFrame(buf []byte) []int16 {
+
+	pcm := make([]int16, len(buf)/2)
+	for i := range pcm {
+		pcm[i] = int16(binary.LittleEndian.Uint16(buf[i*2:]))
+	}
+
+	return pcm
+}
+
+// flushEncoder sends on the silence that gets the encoder delay back out
+// of the encoder, counted as padding to be trimmed on decode on top of the
+// padding the input already ends with. It returns the frames sent and the
+// padding once it is done.
+func flushEncoder(out chan<- []byte, frames, padding int) (int, int, error) {
+
+	flush, padding, err := OpusEncoder.Flush(padding)
+	for _, opus := range flush {
+		select {
+		case out <- opus:
+		case <-quit:
+			return frames, padding, nil
+		}
+		frames++
+	}
+
+	if err != nil {
+		return frames, padding, fmt.Errorf("Encoding Error: %s", err)
+	}
+
+	return frames, padding, nil
+}
+
+// padFrame fills the end of a frame of which only the first n bytes were
+// read with silence, noting how much was added so it can be trimmed again
+// on decode
+func padFrame(buf []byte, n int) {
+
+	for i := n; i < len(buf); i++ {
+		buf[i] = 0
+	}
+
+	EndPadding = (len(buf) - n) / (Channels * 2)
+}
+
+// pcmCommand returns an ffmpeg command that decodes file to pcm16 on stdout
+// using the current volume, sample rate and channel settings. Its error
+// output is kept so failures can be reported.
+func pcmCommand(file string) *exec.Cmd {
+
+	ffmpeg := mediaCommand(file, "ffmpeg", "-loglevel", "error")
+	if Deterministic {
+		// decoders may otherwise take faster paths that differ by cpu
+		ffmpeg.Args = append(ffmpeg.Args, "-flags", "+bitexact")
+	}
+	// seeking before the input is opened skips to the nearest point ffmpeg
+	// can and decodes from there, rather than decoding everything before it
+	if StartTime > 0 {
+		ffmpeg.Args = append(ffmpeg.Args, "-ss", ffmpegTime(StartTime))
+	}
+	if ClipTime > 0 {
+		ffmpeg.Args = append(ffmpeg.Args, "-t", ffmpegTime(ClipTime))
+	}
+	// the first audio stream is the one probed, rather than whichever
+	// ffmpeg thinks best
+	ffmpeg.Args = append(ffmpeg.Args, "-i", file, "-map", "0:a:0", "-vol", strconv.Itoa(Volume), "-f", "s16le", "-acodec", "pcm_s16le", "-ar", strconv.Itoa(FrameRate), "-ac", strconv.Itoa(Channels), "pipe:1")
+	ffmpeg.Stderr = newTailBuffer(4096)
+
+	return ffmpeg
+}
+
+// ffmpegTime formats a time as the seconds ffmpeg takes
+func ffmpegTime(t time.Duration) string {
+	return strconv.FormatFloat(t.Seconds(), 'f', -1, 64)
+}
+
+// writeCover copies cover art to a file of its own
+func writeCover(name string, image *spillBuffer) error {
+
+	r, err := image.Reader()
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(f, r)
+	if err != nil {
+		return err
+	}
+
+	return f.Close()
+}
+
+// encodeCover returns cover art as base64 for embedding in the metadata
+func encodeCover(image *spillBuffer) (string, error) {
+
+	r, err := image.Reader()
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	enc := base64.NewEncoder(base64.StdEncoding, &buf)
+
+	_, err = io.Copy(enc, r)
+	if err != nil {
+		return "", err
+	}
+	enc.Close()
+
+	return buf.String(), nil
+}
+
+// bitexactArgs returns the ffmpeg output options that keep it from writing
+// anything that depends on its version or the cpu when -deterministic is set
+func bitexactArgs() []string {
+
+	if !Deterministic {
+		return nil
+	}
+
+	return []string{"-fflags", "+bitexact", "-flags", "+bitexact"}
+}
+
+// probe runs ffprobe on file and returns the parsed format information
+func probe(file string) (*FFprobeMetadata, error) {
+
+	var out bytes.Buffer
+
+	ffprobe := mediaCommand(file, "ffprobe", "-v", "quiet", "-print_format", "json", "-show_format", "-show_streams", "-select_streams", "a:0", file)
+	ffprobe.Stdout = &out
+
+	err := ffprobe.Run()
+	if err != nil {
+		return nil, err
+	}
+
+	// files without tags leave these empty rather than nil
+	data := &FFprobeMetadata{
+		Format: &FFprobeFormat{
+			Tags: &FFprobeTags{},
+		},
+	}
+
+	err = json.Unmarshal(out.Bytes(), data)
+	if err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// encoder encodes the PCM16 data it receives to opus, then sends the
+// encoded data on
+func encoder(in <-chan []int16, out chan<- []byte) error {
+
+	frames := 0 // frames sent on, which for a sprite is more than were read
+	input := 0  // frames read
+
+	var clip *spriteClip
+	var last *TrackMetadata
+
+	for {
+		pcm, ok := <-in
+		if !ok {
+			// if chan closed, flush the encoder and exit
+			if frames == 0 || aborted() {
+				return nil
+			}
+
+			var err error
+			frames, EndPadding, err = flushEncoder(out, frames, EndPadding)
+			if last != nil {
+				last.Frames = frames - last.Offset
+			}
+
+			// clips with no audio at the very end start where it ends
+			if clip != nil {
+				clip.info.Offset = frames
+			}
+			for len(spriteClips) > 0 {
+				(<-spriteClips).info.Offset = frames
+			}
+
+			return err
+		}
+
+		// each clip of a sprite starts from a reset encoder, once the
+		// clip before has been flushed out of it, so none depends on
+		// another
+		for SpriteMode {
+			if clip == nil {
+				select {
+				case clip = <-spriteClips:
+				default:
+				}
+			}
+
+			if clip == nil || clip.frame != input {
+				break
+			}
+
+			if last != nil {
+				var err error
+				frames, _, err = flushEncoder(out, frames, clip.padding)
+				if err != nil {
+					return err
+				}
+				last.Frames = frames - last.Offset
+				OpusEncoder.Splice()
+			}
+
+			clip.info.Offset = frames
+			last, clip = clip.info, nil
+		}
+
+		frames++
+		input++
+
+		// a two pass encode sets the bitrate frame by frame
+		if Plan != nil {
+			OpusEncoder.SetBitrate(Plan.Bitrate())
+		}
+
+		// try encoding pcm frame with Opus
+		opus, err := OpusEncoder.Encode(pcm)
+		if err != nil {
+			return fmt.Errorf("Encoding Error: %s", err)
+		}
+
+		if Plan != nil {
+			Plan.Add(len(opus))
+		}
+
+		// send opus data on to the writer
+		select {
+		case out <- opus:
+		case <-quit:
+			return nil
+		}
+	}
+}
+
+// openOutput opens OutFile for writing. When appending to an existing DCA
+// file the header is checked against the current opus settings and the file
+// is positioned at its end so only new frames get written.
+func openOutput() (*os.File, error) {
+
+	if !AppendOutput {
+		return os.Create(OutFile)
+	}
+
+	f, err := os.OpenFile(OutFile, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	// a new or empty file gets a full header like any other output
+	if fi.Size() == 0 {
+		return f, nil
+	}
+
+	if RawOutput == false {
+		existing, err := dcaenc.ReadHeader(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+
+		if len(existing.Streams) > 0 {
+			f.Close()
+			return nil, fmt.Errorf("%s is a multitrack file", OutFile)
+		}
+
+		if existing.Opus == nil ||
+			existing.Opus.SampleRate != FrameRate ||
+			existing.Opus.Channels != Channels ||
+			existing.Opus.FrameSize != FrameSize {
+			f.Close()
+			return nil, fmt.Errorf("%s was encoded with different opus settings", OutFile)
+		}
+
+		// appended frames are plain, which a reader of a file with parity
+		// groups or repeat markers would take for part of them
+		if existing.Dca != nil && (existing.Dca.Parity != 0 || len(existing.Dca.Extensions) > 0) {
+			f.Close()
+			return nil, fmt.Errorf("%s was written with -parity or -dedup, which -append can't continue", OutFile)
+		}
+
+		// the run appended starts with an encoder delay of its own, so
+		// where it starts goes in the metadata
+		stats, err := readFrameStats(bufio.NewReaderSize(f, 16384), existing)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		AppendFrame = stats.frames
+	}
+
+	_, err = f.Seek(0, os.SEEK_END)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	Appending = true
+
+	return f, nil
+}
+
+// writer writes the frames it receives to stdout pipe or the outfile
+func writer(in <-chan []byte) error {
+
+	// output buffer, 16KB unless -low-latency
+	wbuf := bufio.NewWriterSize(Guard.Writer(Output), BufferSize)
+	defer wbuf.Flush()
+
+	// The track index is only complete once every track has been read, so
+	// in album mode the frames are held in memory until the header can be
+	// written.
+	var held [][]byte
+	if AlbumMode && RawOutput == false {
+		for opus := range in {
+			held = append(held, opus)
+		}
+
+		// the readers are done, so any failure can go in the header
+		Metadata.Extra.SourceError = SourceError
+	}
+
+	if RawOutput == false && Appending == false {
+		err = writeHeader(wbuf, Seekable)
+		if err != nil {
+			return fmt.Errorf("error writing output: %s", err)
+		}
+	}
+
+	frames := newFrameWriter(wbuf)
+
+	for _, opus := range held {
+		err = Guard.Check(wbuf.Buffered() + len(opus) + 3)
+		if err == nil {
+			err = frames.WriteFrame(opus)
+		}
+		if err != nil {
+			return fmt.Errorf("error writing output: %s", err)
+		}
+	}
+
+	for {
+		opus, ok := <-in
+		if !ok {
+			// if chan closed, write out any repeats left and exit
+			err = frames.Flush()
+			if err != nil {
+				return fmt.Errorf("error writing output: %s", err)
+			}
+			return nil
+		}
+
+		err = Guard.Check(wbuf.Buffered() + len(opus) + 3)
+		if err == nil {
+			err = frames.WriteFrame(opus)
+		}
+		if err == nil && LowLatency {
+			// don't let frames sit in the buffer
+			err = wbuf.Flush()
+		}
+		if err != nil {
+			return fmt.Errorf("error writing output: %s", err)
+		}
+	}
+}
+
+// writeHeader writes the magic bytes and json metadata. The json is padded
+// for retagging, and to update the header of a file when we're done if
+// the output is seekable.
+func writeHeader(w io.Writer, seekable bool) error {
+
+	padding := MetadataPadding
+	if seekable {
+		padding += headerReserve
+	}
+
+	return dcaenc.WriteHeader(w, &Metadata, GzipMetadata, padding)
+}
+
+// writeOutputFrame writes a frame given to the writer, which carries its
+// stream index in multitrack mode
+func writeOutputFrame(w io.Writer, opus []byte) error {
+
+	if Multitrack {
+		return writeStreamFrame(w, opus)
+	}
+
+	return dcaenc.WriteFrame(w, opus)
 }
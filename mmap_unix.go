@@ -0,0 +1,35 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// mapFile maps the whole of f into memory, read only
+func mapFile(f *os.File) ([]byte, error) {
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	if !fi.Mode().IsRegular() || fi.Size() == 0 {
+		return nil, fmt.Errorf("%s can not be mapped", f.Name())
+	}
+
+	size := int(fi.Size())
+	if int64(size) != fi.Size() {
+		return nil, fmt.Errorf("%s is too large to map", f.Name())
+	}
+
+	return syscall.Mmap(int(f.Fd()), 0, size, syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+// unmapFile releases memory returned by mapFile
+func unmapFile(data []byte) error {
+	return syscall.Munmap(data)
+}
@@ -0,0 +1,16 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// mapFile is not supported on Windows, files are read normally
+func mapFile(f *os.File) ([]byte, error) {
+	return nil, fmt.Errorf("memory mapping is not supported on windows")
+}
+
+// unmapFile does nothing on Windows
+func unmapFile(data []byte) error {
+	return nil
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/dca/dcaenc"
+)
+
+// maxStreams is the number of streams a multitrack file can hold, as each
+// frame names its stream with a single byte
+const maxStreams = 256
+
+// parseStreams splits the inputs of a multitrack encode into the stream
+// ids and the inputs themselves. Inputs are given as id=input, such as the
+// SSRC or user id of a speaker, and default to their position otherwise.
+func parseStreams(inputs []string) ([]*StreamMetadata, []string, error) {
+
+	if len(inputs) > maxStreams {
+		return nil, nil, fmt.Errorf("a multitrack file can hold at most %d streams", maxStreams)
+	}
+
+	streams := make([]*StreamMetadata, len(inputs))
+	files := make([]string, len(inputs))
+	seen := make(map[string]bool)
+
+	for i, input := range inputs {
+		id := strconv.Itoa(i)
+		if n := strings.Index(input, "="); n > 0 {
+			id, input = input[:n], input[n+1:]
+		}
+
+		if seen[id] {
+			return nil, nil, fmt.Errorf("stream id %q is used more than once", id)
+		}
+		seen[id] = true
+
+		streams[i] = &StreamMetadata{
+			ID:     id,
+			Source: inputSource(input),
+		}
+		files[i] = input
+	}
+
+	return streams, files, nil
+}
+
+// newEncoder returns an opus encoder with the current bitrate, application
+// and splice settings
+func newEncoder() (*dcaenc.FrameEncoder, error) {
+
+	return dcaenc.NewFrameEncoder(&dcaenc.Options{
+		Channels:       Channels,
+		FrameRate:      FrameRate,
+		FrameSize:      FrameSize,
+		Bitrate:        Bitrate,
+		Application:    Application,
+		SpliceInterval: SpliceFrames,
+		Deterministic:  Deterministic,
+	})
+}
+
+// multitrackEncoder reads every input at once and encodes each of them as
+// its own stream, sending the frames on prefixed with their stream index.
+// Frames are interleaved in time order, one from each stream that still
+// has audio per frame period. A live input with no frame ready a frame
+// length into the period, such as a speaker who is silent and so sends
+// nothing, gets a frame of silence for it rather than holding up the rest.
+func multitrackEncoder(out chan<- []byte) error {
+
+	silence, err := silenceFrame()
+	if err != nil {
+		return err
+	}
+
+	period := time.Duration(FrameSize) * time.Second / time.Duration(FrameRate)
+
+	// once a period is over, a closed channel lets the rest of it go by
+	// without waiting again
+	over := make(chan time.Time)
+	close(over)
+
+	frames := make([]chan []byte, len(Inputs))
+
+	for i, input := range Inputs {
+		c := make(chan []byte, 5*ChannelDepth)
+		frames[i] = c
+
+		input := input
+		startStage(func() error {
+			if OpusInput {
+				return readOpus(input, c)
+			}
+			return encodeStream(input, c)
+		}, func() {
+			close(c)
+		})
+	}
+
+	done := make([]bool, len(frames))
+
+	for {
+		active := 0
+
+		timer := time.NewTimer(period)
+		var timeout <-chan time.Time = timer.C
+
+		for i, c := range frames {
+			if done[i] {
+				continue
+			}
+
+			// files are always waited for, as they only ever run late
+			// while ffmpeg starts
+			var late <-chan time.Time
+			if isPipe(Inputs[i]) {
+				late = timeout
+			}
+
+			opus, ok := []byte(nil), true
+			select {
+			case opus, ok = <-c:
+			case <-late:
+				opus, timeout = silence, over
+			case <-quit:
+				timer.Stop()
+				return nil
+			}
+			if !ok {
+				done[i] = true
+				continue
+			}
+			active++
+
+			select {
+			case out <- append([]byte{byte(i)}, opus...):
+			case <-quit:
+				timer.Stop()
+				return nil
+			}
+		}
+
+		timer.Stop()
+
+		if active == 0 {
+			return nil
+		}
+	}
+}
+
+// encodeStream encodes one input of a multitrack file with an encoder of
+// its own and sends the opus frames to frames
+func encodeStream(input string, frames chan<- []byte) error {
+
+	encoder, err := newEncoder()
+	if err != nil {
+		return classify(exitEncode, fmt.Errorf("NewEncoder Error: %s", err))
+	}
+
+	pcm := make(chan []int16, ChannelDepth)
+	startStage(func() error {
+		return readPCM(input, pcm)
+	}, func() {
+		close(pcm)
+	})
+
+	for buf := range pcm {
+		opus, err := encoder.Encode(buf)
+		if err != nil {
+			return classify(exitEncode, fmt.Errorf("Encoding Error: %s", err))
+		}
+
+		select {
+		case frames <- opus:
+		case <-quit:
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// writeStreamFrame writes a multitrack frame, the stream index followed by
+// the length prefixed opus frame
+func writeStreamFrame(w io.Writer, frame []byte) error {
+
+	_, err := w.Write(frame[:1])
+	if err != nil {
+		return err
+	}
+
+	return dcaenc.WriteFrame(w, frame[1:])
+}
+
+// readStreamFrame reads one multitrack frame and returns its stream index
+// and opus data
+func readStreamFrame(r io.Reader) (int, []byte, error) {
+
+	var index uint8
+
+	err := binary.Read(r, binary.LittleEndian, &index)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	opus, err := dcaenc.ReadFrame(r)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+
+	return int(index), opus, err
+}
+
+// demuxCmd implements "dca demux" which splits a multitrack file into a
+// DCA file for each of its streams
+func demuxCmd(args []string) {
+
+	fs := flag.NewFlagSet("demux", flag.ExitOnError)
+	fs.StringVar(&InFile, "i", "pipe:0", "multitrack infile")
+	fs.StringVar(&OutFile, "o", ".", "folder to write a file per stream to")
+	fs.Parse(args)
+
+	input, err := openInFile()
+	if err != nil {
+		reportError(exitInput, "error opening infile:", err)
+		return
+	}
+	defer input.Close()
+
+	rbuf := bufio.NewReaderSize(input, 16384)
+
+	metadata, err := dcaenc.ReadHeader(rbuf)
+	if err != nil {
+		reportError(exitInput, "error reading header:", err)
+		return
+	}
+
+	if len(metadata.Streams) == 0 {
+		reportError(exitInput, "error:", InFile, "is not a multitrack file")
+		return
+	}
+
+	err = os.MkdirAll(OutFile, 0755)
+	if err != nil {
+		reportError(exitOutput, "error:", err)
+		return
+	}
+
+	outputs := make([]*os.File, len(metadata.Streams))
+	writers := make([]*bufio.Writer, len(metadata.Streams))
+
+	defer func() {
+		for _, f := range outputs {
+			if f != nil {
+				f.Close()
+			}
+		}
+	}()
+
+	names := make(map[string]bool)
+
+	for i, stream := range metadata.Streams {
+		name := streamFileName(stream.ID)
+		if names[name] {
+			reportError(exitUsage, "error: more than one stream would be written to", name)
+			exit()
+		}
+		names[name] = true
+
+		outputs[i], err = os.Create(filepath.Join(OutFile, name))
+		if err != nil {
+			reportError(exitOutput, "error:", err)
+			exit()
+		}
+
+		writers[i] = bufio.NewWriterSize(outputs[i], 16384)
+
+		err = writeStreamHeader(writers[i], metadata, stream)
+		if err != nil {
+			reportError(exitOutput, "error writing output:", err)
+			exit()
+		}
+	}
+
+	for {
+		index, opus, err := readStreamFrame(rbuf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			reportError(exitInput, "error reading input:", err)
+			exit()
+		}
+
+		if index >= len(writers) {
+			reportError(exitInput, "error reading input: frame for unknown stream", index)
+			exit()
+		}
+
+		err = dcaenc.WriteFrame(writers[index], opus)
+		if err != nil {
+			reportError(exitOutput, "error writing output:", err)
+			exit()
+		}
+	}
+
+	for i, w := range writers {
+		err = w.Flush()
+		if err == nil {
+			err = patchHeader(outputs[i])
+		}
+
+		if err != nil {
+			reportError(exitOutput, "error writing output:", err)
+			exit()
+		}
+
+		fmt.Println(outputs[i].Name())
+	}
+}
+
+// writeStreamHeader writes the header of a single stream split out of a
+// multitrack file
+func writeStreamHeader(w io.Writer, multitrack *MetadataStruct, stream *StreamMetadata) error {
+
+	metadata := *multitrack
+	metadata.Streams = nil
+	metadata.Extra = &ExtraMetadata{}
+
+	if metadata.Origin != nil {
+		origin := *metadata.Origin
+		origin.Source = stream.Source
+		metadata.Origin = &origin
+	}
+
+	data, err := json.Marshal(&metadata)
+	if err != nil {
+		return err
+	}
+	data = append(data, bytes.Repeat([]byte(" "), headerReserve)...)
+
+	_, err = io.WriteString(w, MagicBytes)
+	if err != nil {
+		return err
+	}
+
+	err = binary.Write(w, binary.LittleEndian, int32(len(data)))
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(data)
+	return err
+}
+
+// streamFileName returns the name of the file a stream is split out to,
+// keeping only characters that are safe in file names
+func streamFileName(id string) string {
+
+	name := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.' {
+			return r
+		}
+		return '_'
+	}, id)
+
+	return strings.TrimLeft(name, ".") + ".dca"
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// normalizeCeiling is the true peak in dBTP that -normalize keeps the
+// input under, holding back the gain of quiet inputs with loud peaks
+// rather than clipping them
+const normalizeCeiling = -1.0
+
+// measureLoudness decodes InFile with ffmpeg the same way it is decoded
+// for encoding, and measures its loudness
+func measureLoudness() (*LoudnessReport, error) {
+
+	ffmpeg := pcmCommand(InFile)
+	stdout, err := ffmpeg.StdoutPipe()
+	if err != nil {
+		return nil, classify(exitFFmpeg, fmt.Errorf("StdoutPipe Error: %s", err))
+	}
+
+	err = startCommand(ffmpeg)
+	if err != nil {
+		return nil, classify(exitFFmpeg, fmt.Errorf("RunStart Error: %s", err))
+	}
+
+	meter := newLoudnessMeter(FrameRate, Channels)
+	buf := make([]byte, BufferSize)
+
+	for {
+		n, err := io.ReadFull(stdout, buf)
+		meter.Add(pcmFrame(buf[:n-n%2]))
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			waitCommand(ffmpeg)
+			return nil, classify(exitFFmpeg, fmt.Errorf("error reading from ffmpeg stdout: %s", err))
+		}
+	}
+
+	err = waitCommand(ffmpeg)
+	if err != nil {
+		return nil, classify(exitFFmpeg, fmt.Errorf("ffmpeg: %s", err))
+	}
+
+	return meter.Report(), nil
+}
+
+// normalizeGain returns the gain in dB that brings audio of the measured
+// loudness to target LUFS, as far as its true peak stays under the
+// ceiling. Silence is left as it is.
+func normalizeGain(report *LoudnessReport, target float64) float64 {
+
+	if report.Integrated <= loudnessAbsoluteGate {
+		return 0
+	}
+
+	gain := target - report.Integrated
+	if headroom := normalizeCeiling - report.TruePeak; gain > headroom {
+		gain = headroom
+	}
+
+	return roundLevel(gain)
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net/http"
+
+	"github.com/bwmarrin/dca/dcaenc"
+)
+
+// Ogg page header flags
+const (
+	oggBOS byte = 0x02
+	oggEOS byte = 0x04
+)
+
+// oggPageSize is the amount of packet data a page is filled up to
+const oggPageSize = 4096
+
+// oggCRCTable is the lookup table for the CRC used in Ogg page headers,
+// polynomial 0x04c11db7 without bit reflection
+var oggCRCTable = func() [256]uint32 {
+
+	var table [256]uint32
+
+	for i := range table {
+		r := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if r&0x80000000 != 0 {
+				r = r<<1 ^ 0x04c11db7
+			} else {
+				r <<= 1
+			}
+		}
+		table[i] = r
+	}
+
+	return table
+}()
+
+// oggCRC returns the Ogg checksum of a page
+func oggCRC(page []byte) uint32 {
+
+	var crc uint32
+	for _, b := range page {
+		crc = crc<<8 ^ oggCRCTable[byte(crc>>24)^b]
+	}
+
+	return crc
+}
+
+// oggWriter writes opus packets to an Ogg Opus stream as described in
+// RFC 7845
+type oggWriter struct {
+	w        io.Writer
+	serial   uint32
+	sequence uint32
+
+	// granule position after the last packet added, in 48kHz samples
+	granule int64
+
+	// lacing values and data of the page being built
+	segments []byte
+	data     []byte
+
+	// true until the first page has been written
+	first bool
+
+	// if set, the granule position the stream ends at, which trims the
+	// padding of the last packet
+	end int64
+
+	// if set, pages hold at most this many packets, for streaming where
+	// smaller pages mean less latency
+	pagePackets int
+	packets     int
+}
+
+// newOggWriter returns an oggWriter for a logical stream with the given
+// serial number
+func newOggWriter(w io.Writer, serial uint32) *oggWriter {
+
+	return &oggWriter{
+		w:      w,
+		serial: serial,
+		first:  true,
+	}
+}
+
+// WriteHeaders writes the OpusHead and OpusTags packets, each on a page of
+// its own as the spec requires
+func (o *oggWriter) WriteHeaders(head, tags []byte) error {
+
+	err := o.WritePacket(head, 0)
+	if err != nil {
+		return err
+	}
+
+	err = o.flush(0)
+	if err != nil {
+		return err
+	}
+
+	err = o.WritePacket(tags, 0)
+	if err != nil {
+		return err
+	}
+
+	return o.flush(0)
+}
+
+// WritePacket adds a packet holding the given number of 48kHz samples to
+// the stream, writing out the current page first if the packet does not
+// fit on it. Pages are only written once full so the last one can be
+// marked as the end of the stream.
+func (o *oggWriter) WritePacket(packet []byte, samples int) error {
+
+	lacing := len(packet)/255 + 1
+	full := o.pagePackets > 0 && o.packets >= o.pagePackets
+	if full || len(o.segments)+lacing > 255 || (len(o.data) > 0 && len(o.data)+len(packet) > oggPageSize) {
+		err := o.flush(0)
+		if err != nil {
+			return err
+		}
+	}
+
+	for i := 0; i < lacing-1; i++ {
+		o.segments = append(o.segments, 255)
+	}
+	o.segments = append(o.segments, byte(len(packet)%255))
+
+	o.data = append(o.data, packet...)
+	o.granule += int64(samples)
+	o.packets++
+
+	return nil
+}
+
+// Close writes out the last page, marked as the end of the stream
+func (o *oggWriter) Close() error {
+
+	if o.end > 0 && o.end < o.granule {
+		o.granule = o.end
+	}
+
+	return o.flush(oggEOS)
+}
+
+// flush writes the packets added so far as one page
+func (o *oggWriter) flush(flags byte) error {
+
+	if len(o.segments) == 0 && flags == 0 {
+		return nil
+	}
+
+	if o.first {
+		flags |= oggBOS
+		o.first = false
+	}
+
+	page := make([]byte, 27, 27+len(o.segments)+len(o.data))
+	copy(page, "OggS")
+	page[4] = 0 // version
+	page[5] = flags
+	binary.LittleEndian.PutUint64(page[6:], uint64(o.granule))
+	binary.LittleEndian.PutUint32(page[14:], o.serial)
+	binary.LittleEndian.PutUint32(page[18:], o.sequence)
+	page[26] = byte(len(o.segments))
+
+	page = append(page, o.segments...)
+	page = append(page, o.data...)
+
+	binary.LittleEndian.PutUint32(page[22:], oggCRC(page))
+
+	o.sequence++
+	o.segments = o.segments[:0]
+	o.data = o.data[:0]
+	o.packets = 0
+
+	_, err := o.w.Write(page)
+	return err
+}
+
+// streamPreSkip returns the pre-skip of a DCA file, from its metadata if
+// it was recorded and from its application otherwise
+func streamPreSkip(opus *OpusMetadata) int {
+
+	if opus.PreSkip > 0 {
+		return opus.PreSkip
+	}
+
+	return dcaenc.PreSkip(opus.Application)
+}
+
+// oggEnd returns the granule position an Ogg Opus stream of a DCA file
+// ends at, or 0 if the length of its input is unknown
+func oggEnd(metadata *MetadataStruct) int64 {
+
+	if metadata.Extra == nil || metadata.Extra.Samples == 0 || metadata.Opus.SampleRate == 0 {
+		return 0
+	}
+
+	rate := int64(metadata.Opus.SampleRate)
+
+	// the padding at the seams of a file appended to plays as it is, so
+	// the stream ends with the input of the last run
+	if n := len(metadata.Extra.Seams); n > 0 {
+		last := metadata.Extra.Seams[n-1]
+		return int64(last.Frame*metadata.Opus.FrameSize)*48000/rate + int64(last.PreSkip) + int64(last.Samples)*48000/rate
+	}
+
+	samples := int64(metadata.Extra.Samples) * 48000 / rate
+
+	return int64(streamPreSkip(metadata.Opus)) + samples
+}
+
+// opusHead builds the identification header of an Ogg Opus stream
+func opusHead(opus *OpusMetadata) []byte {
+
+	head := make([]byte, 19)
+	copy(head, "OpusHead")
+	head[8] = 1 // version
+	head[9] = byte(opus.Channels)
+	binary.LittleEndian.PutUint16(head[10:], uint16(streamPreSkip(opus)))
+	binary.LittleEndian.PutUint32(head[12:], uint32(opus.SampleRate))
+	binary.LittleEndian.PutUint16(head[16:], 0) // output gain
+	head[18] = 0                                // channel mapping family
+
+	return head
+}
+
+// opusTags builds the comment header of an Ogg Opus stream, carrying the
+// song info over to Vorbis comments
+func opusTags(metadata *MetadataStruct) []byte {
+
+	var tags bytes.Buffer
+
+	write := func(s string) {
+		binary.Write(&tags, binary.LittleEndian, uint32(len(s)))
+		tags.WriteString(s)
+	}
+
+	var comments []string
+	if info := metadata.SongInfo; info != nil {
+		add := func(key, value string) {
+			if value != "" {
+				comments = append(comments, key+"="+value)
+			}
+		}
+
+		add("TITLE", info.Title)
+		add("ARTIST", info.Artist)
+		add("ALBUM", info.Album)
+		add("GENRE", info.Genre)
+		add("COMMENT", info.Comments)
+
+		if info.Cover != nil {
+			cover, err := base64.StdEncoding.DecodeString(*info.Cover)
+			if err == nil && len(cover) > 0 {
+				add("METADATA_BLOCK_PICTURE", pictureBlock(cover))
+			}
+		}
+	}
+
+	tags.WriteString("OpusTags")
+	write("dca " + ProgramVersion)
+	binary.Write(&tags, binary.LittleEndian, uint32(len(comments)))
+	for _, c := range comments {
+		write(c)
+	}
+
+	return tags.Bytes()
+}
+
+// pictureBlock encodes cover art as a base64 FLAC picture block, the way
+// Vorbis comments carry embedded images
+func pictureBlock(image []byte) string {
+
+	var block bytes.Buffer
+
+	mime := http.DetectContentType(image)
+
+	binary.Write(&block, binary.BigEndian, uint32(3)) // front cover
+	binary.Write(&block, binary.BigEndian, uint32(len(mime)))
+	block.WriteString(mime)
+	binary.Write(&block, binary.BigEndian, uint32(0))   // description
+	binary.Write(&block, binary.BigEndian, [4]uint32{}) // size and colors unknown
+	binary.Write(&block, binary.BigEndian, uint32(len(image)))
+	block.Write(image)
+
+	return base64.StdEncoding.EncodeToString(block.Bytes())
+}
@@ -0,0 +1,264 @@
+package main
+
+import "math"
+
+// softClipKnee is the level, as a fraction of full scale, above which
+// soft clipping starts rounding off peaks
+const softClipKnee = 0.75
+
+// applyGain scales pcm in place by gain. Samples that end up over full
+// scale are clipped, or with soft set, everything above the knee is
+// compressed smoothly towards full scale instead.
+func applyGain(pcm []int16, gain float64, soft bool) {
+
+	for i, s := range pcm {
+		x := float64(s) / 32768 * gain
+
+		if soft {
+			a := math.Abs(x)
+			if a > softClipKnee {
+				a = softClipKnee + (1-softClipKnee)*math.Tanh((a-softClipKnee)/(1-softClipKnee))
+				x = math.Copysign(a, x)
+			}
+		}
+
+		x *= 32768
+		if x > 32767 {
+			x = 32767
+		} else if x < -32768 {
+			x = -32768
+		}
+
+		pcm[i] = int16(x)
+	}
+}
+
+// wav channel mask bits of the speakers a downmix places
+const (
+	speakerFrontLeft = 1 << iota
+	speakerFrontRight
+	speakerFrontCenter
+	speakerLFE
+	speakerBackLeft
+	speakerBackRight
+	speakerFrontLeftOfCenter
+	speakerFrontRightOfCenter
+	speakerBackCenter
+	speakerSideLeft
+	speakerSideRight
+)
+
+// defaultLayouts are the speakers of wav input without a channel mask, by
+// channel count, the same ffmpeg assumes
+var defaultLayouts = map[int]uint32{
+	1: speakerFrontCenter,
+	2: speakerFrontLeft | speakerFrontRight,
+	3: speakerFrontLeft | speakerFrontRight | speakerFrontCenter,
+	4: speakerFrontLeft | speakerFrontRight | speakerBackLeft | speakerBackRight,
+	5: speakerFrontLeft | speakerFrontRight | speakerFrontCenter | speakerBackLeft | speakerBackRight,
+	6: speakerFrontLeft | speakerFrontRight | speakerFrontCenter | speakerLFE | speakerBackLeft | speakerBackRight,
+	7: speakerFrontLeft | speakerFrontRight | speakerFrontCenter | speakerLFE | speakerBackCenter | speakerSideLeft | speakerSideRight,
+	8: speakerFrontLeft | speakerFrontRight | speakerFrontCenter | speakerLFE | speakerBackLeft | speakerBackRight | speakerSideLeft | speakerSideRight,
+}
+
+// downmixLevel is -3 dB, the level ITU-R BS.775 mixes the centre and
+// surrounds into the front left and right at
+var downmixLevel = math.Sqrt(0.5)
+
+// downmixWeights returns how much of each channel goes into the left and
+// the right of a stereo downmix. mask is the wav channel mask of the
+// channels, 0 for the usual layout of their count. The LFE is left out,
+// and each side is scaled so a full scale mix can't clip, as ffmpeg does.
+func downmixWeights(channels int, mask uint32) ([]float64, []float64) {
+
+	speakers := 0
+	for m := mask; m != 0; m &= m - 1 {
+		speakers++
+	}
+	if speakers != channels {
+		mask = defaultLayouts[channels]
+	}
+
+	left := make([]float64, 0, channels)
+	right := make([]float64, 0, channels)
+	for bit := uint32(1); len(left) < channels; bit <<= 1 {
+		if mask != 0 && mask&bit == 0 {
+			continue
+		}
+
+		switch bit {
+		case speakerFrontLeft, speakerFrontLeftOfCenter:
+			left, right = append(left, 1), append(right, 0)
+		case speakerFrontRight, speakerFrontRightOfCenter:
+			left, right = append(left, 0), append(right, 1)
+		case speakerFrontCenter:
+			left, right = append(left, downmixLevel), append(right, downmixLevel)
+		case speakerLFE:
+			left, right = append(left, 0), append(right, 0)
+		case speakerBackLeft, speakerSideLeft:
+			left, right = append(left, downmixLevel), append(right, 0)
+		case speakerBackRight, speakerSideRight:
+			left, right = append(left, 0), append(right, downmixLevel)
+		default:
+			// the back centre, and the top speakers, split between the two
+			left, right = append(left, 0.5), append(right, 0.5)
+		}
+	}
+
+	for _, weights := range [][]float64{left, right} {
+		sum := 0.0
+		for _, w := range weights {
+			sum += w
+		}
+		for c := range weights {
+			if sum > 0 {
+				weights[c] /= sum
+			}
+		}
+	}
+
+	return left, right
+}
+
+// remix converts interleaved pcm from one channel count to another. Going
+// down to stereo or mono mixes the channels with downmixWeights, where mask
+// is the wav channel mask of the input, 0 for the usual layout. Going up
+// from mono copies the one channel to all of them, and anything else keeps
+// the channels both have.
+func remix(pcm []int16, from, to int, mask uint32) []int16 {
+
+	if from == to {
+		return pcm
+	}
+
+	samples := len(pcm) / from
+	out := make([]int16, samples*to)
+
+	if from > 1 && to <= 2 {
+		left, right := downmixWeights(from, mask)
+
+		for i := 0; i < samples; i++ {
+			l, r := 0.0, 0.0
+			for c, s := range pcm[i*from : (i+1)*from] {
+				l += left[c] * float64(s)
+				r += right[c] * float64(s)
+			}
+
+			if to == 1 {
+				out[i] = int16((l + r) / 2)
+			} else {
+				out[i*2], out[i*2+1] = int16(l), int16(r)
+			}
+		}
+
+		return out
+	}
+
+	for i := 0; i < samples; i++ {
+		frame := pcm[i*from : (i+1)*from]
+
+		for c := 0; c < to; c++ {
+			if from == 1 {
+				out[i*to+c] = frame[0]
+			} else if c < from {
+				out[i*to+c] = frame[c]
+			}
+		}
+	}
+
+	return out
+}
+
+// pcmToS32 widens pcm16 samples to 32 bit
+func pcmToS32(pcm []int16) []int32 {
+
+	out := make([]int32, len(pcm))
+	for i, s := range pcm {
+		out[i] = int32(s) << 16
+	}
+
+	return out
+}
+
+// pcmToF32 converts pcm16 samples to floats between -1 and 1
+func pcmToF32(pcm []int16) []float32 {
+
+	out := make([]float32, len(pcm))
+	for i, s := range pcm {
+		out[i] = float32(s) / 32768
+	}
+
+	return out
+}
+
+// resampler converts interleaved pcm between sample rates using linear
+// interpolation. It keeps the last sample of each chunk so consecutive
+// chunks join up without clicks.
+type resampler struct {
+	from     int
+	to       int
+	channels int
+
+	// position of the next output sample, in 1/to steps past last
+	phase int
+
+	last []int16
+}
+
+// newResampler returns a resampler from one sample rate to another
+func newResampler(from, to, channels int) *resampler {
+
+	return &resampler{
+		from:     from,
+		to:       to,
+		channels: channels,
+		phase:    to,
+		last:     make([]int16, channels),
+	}
+}
+
+// Resample converts a chunk of interleaved pcm and returns the samples
+// that can be produced from it so far
+func (r *resampler) Resample(pcm []int16) []int16 {
+
+	if r.from == r.to {
+		return pcm
+	}
+
+	samples := len(pcm) / r.channels
+	if samples == 0 {
+		return nil
+	}
+
+	// sample n of the chunk with the previous chunk's last at n = -1
+	at := func(n, c int) int {
+		if n < 0 {
+			return int(r.last[c])
+		}
+		return int(pcm[n*r.channels+c])
+	}
+
+	out := make([]int16, 0, (samples*r.to/r.from+1)*r.channels)
+
+	for {
+		idx := r.phase/r.to - 1
+		frac := r.phase % r.to
+
+		if idx+1 >= samples {
+			break
+		}
+
+		for c := 0; c < r.channels; c++ {
+			a := at(idx, c)
+			b := at(idx+1, c)
+			out = append(out, int16(a+int(int64(b-a)*int64(frac)/int64(r.to))))
+		}
+
+		r.phase += r.from
+	}
+
+	r.phase -= samples * r.to
+	copy(r.last, pcm[(samples-1)*r.channels:])
+
+	return out
+}
@@ -0,0 +1,123 @@
+package main
+
+// An encode runs as a pipeline of stages, each in its own goroutine and
+// connected by chans:
+//
+//	source -> pcm stages -> encoder -> opus stages -> sink
+//
+// A stage reads its input until it is closed and sends what it produces
+// on its output, which the pipeline closes once the stage returns so the
+// end of the input flows down the chain. Sends select on quit so nothing
+// blocks once the pipeline is aborted. A stage that fails returns an
+// error, which aborts the whole pipeline and is reported once everything
+// has stopped. Errors take the exit code of the stage they came from,
+// unless the stage gave them a class of its own, such as ffmpeg failing.
+//
+// Filters, mixers, tees and stats taps are added as stages, without
+// changing the ones around them.
+type (
+	// pcmSource produces pcm, for example by reading a file
+	pcmSource func(out chan<- []int16) error
+
+	// pcmStage processes pcm on its way to the encoder
+	pcmStage func(in <-chan []int16, out chan<- []int16) error
+
+	// opusSource produces opus frames that need no encoding
+	opusSource func(out chan<- []byte) error
+
+	// opusStage processes opus frames on their way to the sink
+	opusStage func(in <-chan []byte, out chan<- []byte) error
+
+	// opusSink consumes the finished frames, for example by writing them
+	// to the output
+	opusSink func(in <-chan []byte) error
+)
+
+// pipeline describes the stages of an encode. Either PCMSource and Encoder
+// or OpusSource is set.
+type pipeline struct {
+	PCMSource  pcmSource
+	PCMStages  []pcmStage
+	Encoder    func(in <-chan []int16, out chan<- []byte) error
+	OpusSource opusSource
+	OpusStages []opusStage
+	Sink       opusSink
+}
+
+// Run starts every stage of the pipeline and waits for all of them to
+// finish
+func (p *pipeline) Run() {
+
+	// the chans are copied before each stage is started, as opus and pcm
+	// move on down the chain while the stages are still running
+	opus := make(chan []byte, ChannelDepth)
+	encoded := opus
+
+	if p.OpusSource != nil {
+		startStage(func() error {
+			return classify(exitInput, p.OpusSource(encoded))
+		}, func() {
+			close(encoded)
+		})
+	} else {
+		pcm := make(chan []int16, ChannelDepth)
+		source := pcm
+		startStage(func() error {
+			return classify(exitInput, p.PCMSource(source))
+		}, func() {
+			close(source)
+		})
+
+		for _, stage := range p.PCMStages {
+			stage, in, out := stage, pcm, make(chan []int16, ChannelDepth)
+			startStage(func() error {
+				return stage(in, out)
+			}, func() {
+				close(out)
+			})
+			pcm = out
+		}
+
+		in := pcm
+		startStage(func() error {
+			return classify(exitEncode, p.Encoder(in, encoded))
+		}, func() {
+			close(encoded)
+		})
+	}
+
+	for _, stage := range p.OpusStages {
+		stage, in, out := stage, opus, make(chan []byte, ChannelDepth)
+		startStage(func() error {
+			return stage(in, out)
+		}, func() {
+			close(out)
+		})
+		opus = out
+	}
+
+	last := opus
+	startStage(func() error {
+		return classify(exitOutput, p.Sink(last))
+	}, nil)
+
+	wg.Wait()
+}
+
+// startStage runs a stage in its own goroutine. done is called once it
+// returns, to close its output.
+func startStage(run func() error, done func()) {
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if done != nil {
+			defer done()
+		}
+
+		err := run()
+		if err != nil {
+			fail(err)
+		}
+	}()
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/bwmarrin/dca/dcaenc"
+)
+
+// ReencodeJob is a file of a catalog that doesn't match the settings wanted
+// for it, along with the arguments to encode it with and why
+type ReencodeJob struct {
+	File    string   `json:"file"`
+	Args    []string `json:"args"`
+	Reasons []string `json:"reasons"`
+}
+
+// catalogPlanCmd implements "dca catalog plan" which compares the settings
+// of every file of the catalog against a preset and writes a manifest of
+// the ones that need encoding again, one json job per line
+func catalogPlanCmd(args []string) {
+
+	var path, name, out string
+	var bitrate, volume int
+
+	fs := flag.NewFlagSet("catalog plan", flag.ExitOnError)
+	fs.StringVar(&path, "db", catalogFile, "catalog to plan from")
+	fs.StringVar(&name, "preset", "discord", "preset to compare against, one of "+presetNames())
+	fs.IntVar(&bitrate, "ab", 0, "bitrate in kb/s to compare against instead of the preset's")
+	fs.IntVar(&volume, "vol", 256, "volume the files should be encoded at (256=normal)")
+	fs.StringVar(&out, "o", "", "file to write the manifest to (default is stdout)")
+	fs.Parse(args)
+
+	p, ok := presets[name]
+	if !ok {
+		reportError(exitUsage, fmt.Sprintf("error: unknown preset %q, must be one of %s", name, presetNames()))
+		return
+	}
+
+	jobArgs := []string{"-preset", name}
+	if bitrate > 0 {
+		p.Bitrate = bitrate
+		jobArgs = append(jobArgs, "-ab", strconv.Itoa(bitrate))
+	}
+	if volume != 256 {
+		jobArgs = append(jobArgs, "-vol", strconv.Itoa(volume))
+	}
+
+	entries, err := findInCatalog(path, fs.Args(), CatalogQuery{})
+	if err != nil {
+		reportError(exitFailure, "error:", err)
+		exit()
+	}
+
+	var w io.Writer = os.Stdout
+	if out != "" {
+		f, err := os.Create(out)
+		if err != nil {
+			reportError(exitOutput, "error creating manifest:", err)
+			exit()
+		}
+		defer f.Close()
+		w = f
+	}
+
+	wbuf := bufio.NewWriter(w)
+	enc := json.NewEncoder(wbuf)
+
+	jobs := 0
+	for _, entry := range entries {
+		if entry.Error != "" {
+			continue
+		}
+
+		reasons := reencodeReasons(entry.Opus, p, volume)
+		if len(reasons) == 0 {
+			continue
+		}
+
+		enc.Encode(&ReencodeJob{File: entry.Path, Args: jobArgs, Reasons: reasons})
+		jobs++
+	}
+
+	err = wbuf.Flush()
+	if err != nil {
+		reportError(exitOutput, "error writing manifest:", err)
+		exit()
+	}
+
+	fmt.Fprintf(os.Stderr, "%d of %d files need encoding again\n", jobs, len(entries))
+}
+
+// reencodeReasons returns why a file with the given opus metadata doesn't
+// match a preset at the given volume, or nothing if it does
+func reencodeReasons(opus *OpusMetadata, p preset, volume int) []string {
+
+	if opus == nil {
+		return []string{"no opus metadata"}
+	}
+
+	want := p.opus()
+
+	// unknown applications are encoded as audio, as for fingerprints
+	application := opus.Application
+	if application != "voip" && application != "lowdelay" {
+		application = "audio"
+	}
+
+	var reasons []string
+	differs := func(name string, have, want interface{}) {
+		if have != want {
+			reasons = append(reasons, fmt.Sprintf("%s %v, want %v", name, have, want))
+		}
+	}
+
+	differs("abr", opus.Bitrate, want.Bitrate)
+	differs("mode", application, want.Application)
+	differs("sample_rate", opus.SampleRate, want.SampleRate)
+	differs("channels", opus.Channels, want.Channels)
+	differs("frame_size", opus.FrameSize, want.FrameSize)
+
+	if len(reasons) > 0 {
+		return reasons
+	}
+
+	// the settings match but the fingerprint also covers the volume, and
+	// files written before fingerprints were recorded can't be told apart
+	// from ones encoded at another volume, as with needs-reencode
+	if opus.Fingerprint == "" {
+		return []string{"no fingerprint"}
+	}
+	if opus.Fingerprint != dcaenc.Fingerprint(want, volume) {
+		return []string{"encoded at another volume"}
+	}
+
+	return nil
+}
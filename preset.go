@@ -0,0 +1,130 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/bwmarrin/dca/dcaenc"
+)
+
+// preset is a named set of encode settings
+type preset struct {
+	Bitrate     int // kb/s
+	Application string
+	FrameRate   int
+	Channels    int
+	FrameSize   int
+}
+
+// presets are the settings -preset can name
+var presets = map[string]preset{
+	"discord": {64, "audio", 48000, 2, 960},
+	"music":   {128, "audio", 48000, 2, 960},
+	"voice":   {32, "voip", 48000, 2, 960},
+}
+
+// presetNames returns the names of all presets in order
+func presetNames() string {
+
+	var names []string
+	for name := range presets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return strings.Join(names, ", ")
+}
+
+// applyPreset sets the encode settings of the named preset, except those
+// whose flags were given explicitly
+func applyPreset(name string, fs *flag.FlagSet) error {
+
+	p, ok := presets[name]
+	if !ok {
+		return fmt.Errorf("unknown preset %q, must be one of %s", name, presetNames())
+	}
+
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	if !set["ab"] {
+		Bitrate = p.Bitrate
+	}
+	if !set["aa"] {
+		Application = p.Application
+	}
+	if !set["ar"] {
+		FrameRate = p.FrameRate
+	}
+	if !set["ac"] {
+		Channels = p.Channels
+	}
+	if !set["as"] {
+		FrameSize = p.FrameSize
+	}
+
+	return nil
+}
+
+// opus returns the opus metadata of a file encoded with the preset
+func (p preset) opus() *OpusMetadata {
+	return &OpusMetadata{
+		Bitrate:     p.Bitrate * 1000,
+		SampleRate:  p.FrameRate,
+		Application: p.Application,
+		FrameSize:   p.FrameSize,
+		Channels:    p.Channels,
+	}
+}
+
+// needsReencodeCmd implements "dca needs-reencode" which tells scripts
+// whether a DCA file already matches a preset. It prints yes and exits 0
+// when the file should be encoded again, prints no and exits 1 when it
+// matches, and exits 2 on errors.
+func needsReencodeCmd(args []string) {
+
+	var name string
+	var volume int
+
+	fs := flag.NewFlagSet("needs-reencode", flag.ExitOnError)
+	fs.StringVar(&InFile, "i", "pipe:0", "DCA infile")
+	fs.StringVar(&name, "preset", "discord", "preset to compare against, one of "+presetNames())
+	fs.IntVar(&volume, "vol", 256, "volume the file should be encoded at (256=normal)")
+	fs.Parse(args)
+
+	p, ok := presets[name]
+	if !ok {
+		fmt.Printf("error: unknown preset %q, must be one of %s\n", name, presetNames())
+		os.Exit(2)
+	}
+
+	input, err := openInFile()
+	if err != nil {
+		fmt.Println("error opening infile:", err)
+		os.Exit(2)
+	}
+	defer input.Close()
+
+	metadata, err := dcaenc.ReadHeader(input)
+	if err != nil {
+		fmt.Println("error reading header:", err)
+		os.Exit(2)
+	}
+
+	want := dcaenc.Fingerprint(p.opus(), volume)
+
+	// files written before fingerprints were recorded can't be told
+	// apart from ones encoded at another volume, so they always need it
+	if metadata.Opus == nil || metadata.Opus.Fingerprint != want {
+		fmt.Println("yes")
+		return
+	}
+
+	fmt.Println("no")
+	os.Exit(1)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// I/O scheduling classes, as used by ionice(1)
+const (
+	ioClassBestEffort = 2
+	ioClassIdle       = 3
+)
+
+// lowerPriority applies -nice and -ionice to dca. Child processes such as
+// ffmpeg inherit both, so a large encode can run next to a latency
+// sensitive bot without starving it.
+func lowerPriority(nice int, ionice string) error {
+
+	if nice != 0 {
+		err := setNice(nice)
+		if err != nil {
+			return fmt.Errorf("error setting -nice: %s", err)
+		}
+	}
+
+	if ionice != "" {
+		class, level, err := parseIOClass(ionice)
+		if err != nil {
+			return err
+		}
+
+		err = setIOPriority(class, level)
+		if err != nil {
+			return fmt.Errorf("error setting -ionice: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// parseIOClass parses an -ionice value, either idle or best-effort with an
+// optional level from 0 (highest) to 7 (lowest) such as best-effort:7
+func parseIOClass(ionice string) (class, level int, err error) {
+
+	parts := strings.SplitN(ionice, ":", 2)
+
+	switch parts[0] {
+	case "idle":
+		if len(parts) > 1 {
+			return 0, 0, fmt.Errorf("-ionice idle does not take a level")
+		}
+		return ioClassIdle, 0, nil
+
+	case "best-effort":
+		level = 4
+		if len(parts) > 1 {
+			level, err = strconv.Atoi(parts[1])
+			if err != nil || level < 0 || level > 7 {
+				return 0, 0, fmt.Errorf("-ionice best-effort level must be 0 to 7")
+			}
+		}
+		return ioClassBestEffort, level, nil
+	}
+
+	return 0, 0, fmt.Errorf("-ionice can be idle or best-effort[:0-7]")
+}
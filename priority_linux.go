@@ -0,0 +1,62 @@
+package main
+
+import (
+	"io/ioutil"
+	"strconv"
+	"syscall"
+)
+
+// On Linux both priorities belong to threads rather than the process, so
+// they are set on every thread dca has. Threads started later and child
+// processes inherit them from the thread that creates them.
+
+// setNice sets the scheduling priority of dca, from -20 (highest) to 19
+// (lowest)
+func setNice(nice int) error {
+
+	return eachThread(func(tid int) error {
+		return syscall.Setpriority(syscall.PRIO_PROCESS, tid, nice)
+	})
+}
+
+// setIOPriority sets the I/O scheduling class and level of dca with the
+// ioprio_set system call
+func setIOPriority(class, level int) error {
+
+	const (
+		whoProcess = 1
+		classShift = 13
+	)
+
+	return eachThread(func(tid int) error {
+		_, _, errno := syscall.Syscall(syscall.SYS_IOPRIO_SET, whoProcess, uintptr(tid), uintptr(class<<classShift|level))
+		if errno != 0 {
+			return errno
+		}
+		return nil
+	})
+}
+
+// eachThread calls fn with the id of every thread of dca
+func eachThread(fn func(tid int) error) error {
+
+	tasks, err := ioutil.ReadDir("/proc/self/task")
+	if err != nil {
+		// no /proc, settle for the current thread
+		return fn(0)
+	}
+
+	for _, task := range tasks {
+		tid, err := strconv.Atoi(task.Name())
+		if err != nil {
+			continue
+		}
+
+		err = fn(tid)
+		if err != nil && err != syscall.ESRCH {
+			return err
+		}
+	}
+
+	return nil
+}
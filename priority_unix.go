@@ -0,0 +1,20 @@
+//go:build !windows && !linux
+// +build !windows,!linux
+
+package main
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// setNice sets the scheduling priority of dca, from -20 (highest) to 19
+// (lowest)
+func setNice(nice int) error {
+	return syscall.Setpriority(syscall.PRIO_PROCESS, 0, nice)
+}
+
+// setIOPriority is only supported on Linux
+func setIOPriority(class, level int) error {
+	return fmt.Errorf("only supported on linux")
+}
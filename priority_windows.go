@@ -0,0 +1,15 @@
+package main
+
+import (
+	"fmt"
+)
+
+// setNice is not supported on Windows
+func setNice(nice int) error {
+	return fmt.Errorf("not supported on windows")
+}
+
+// setIOPriority is not supported on Windows
+func setIOPriority(class, level int) error {
+	return fmt.Errorf("not supported on windows")
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// Pipeline teardown. When any stage fails, abort closes quit so the other
+// stages stop instead of blocking on channels nobody reads any more, and
+// kills every child process so none are left running or holding pipes.
+var (
+	quit     = make(chan struct{})
+	quitOnce sync.Once
+
+	children   []*exec.Cmd
+	childrenMu sync.Mutex
+
+	// description of the first child process that failed
+	SourceError   string
+	sourceErrorMu sync.Mutex
+
+	// the error that stopped the pipeline
+	firstError   error
+	firstErrorMu sync.Mutex
+)
+
+// abort stops the whole pipeline. It is safe to call more than once and
+// from any goroutine.
+func abort() {
+
+	quitOnce.Do(func() {
+		close(quit)
+
+		childrenMu.Lock()
+		for _, cmd := range children {
+			killProcessGroup(cmd)
+		}
+		childrenMu.Unlock()
+	})
+}
+
+// fail records err as the reason the pipeline stopped and aborts it. Only
+// the first error is kept, as anything failing after that is usually a
+// knock-on effect of the abort rather than the cause.
+func fail(err error) {
+
+	firstErrorMu.Lock()
+	if firstError == nil && !aborted() {
+		firstError = err
+	}
+	firstErrorMu.Unlock()
+
+	abort()
+}
+
+// failure returns the error that stopped the pipeline, if any
+func failure() error {
+
+	firstErrorMu.Lock()
+	defer firstErrorMu.Unlock()
+
+	return firstError
+}
+
+// aborted reports whether abort has been called
+func aborted() bool {
+
+	select {
+	case <-quit:
+		return true
+	default:
+		return false
+	}
+}
+
+// handleSignals aborts the pipeline when dca is interrupted or terminated,
+// since children in their own process group don't get the signal
+func handleSignals() {
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		<-signals
+		abort()
+	}()
+}
+
+// startCommand starts a child process in its own process group and keeps
+// track of it so abort can kill it along with anything it spawned
+func startCommand(cmd *exec.Cmd) error {
+
+	setProcessGroup(cmd)
+
+	childrenMu.Lock()
+	defer childrenMu.Unlock()
+
+	err := cmd.Start()
+	if err != nil {
+		return err
+	}
+
+	children = append(children, cmd)
+
+	// abort may have run before we got here
+	if aborted() {
+		killProcessGroup(cmd)
+	}
+
+	return nil
+}
+
+// waitCommand reaps a child process started with startCommand
+func waitCommand(cmd *exec.Cmd) error {
+
+	err := cmd.Wait()
+
+	childrenMu.Lock()
+	for i, c := range children {
+		if c == cmd {
+			children = append(children[:i], children[i+1:]...)
+			break
+		}
+	}
+	childrenMu.Unlock()
+
+	return err
+}
+
+// sourceFailed reports a child process that exited with an error, along
+// with the end of what it wrote to stderr
+func sourceFailed(cmd *exec.Cmd, err error) {
+
+	msg := fmt.Sprintf("%s failed: %s", filepath.Base(cmd.Path), err)
+	if tail, ok := cmd.Stderr.(*tailBuffer); ok && tail.Len() > 0 {
+		msg += ": " + strings.TrimSpace(tail.String())
+	}
+
+	fmt.Fprintln(os.Stderr, msg)
+
+	sourceErrorMu.Lock()
+	if SourceError == "" {
+		SourceError = msg
+	}
+	sourceErrorMu.Unlock()
+}
+
+// tailBuffer is an io.Writer that keeps only the last bytes written to it
+type tailBuffer struct {
+	bytes.Buffer
+	size int
+}
+
+// newTailBuffer returns a tailBuffer that keeps up to size bytes
+func newTailBuffer(size int) *tailBuffer {
+	return &tailBuffer{size: size}
+}
+
+// Write implements io.Writer
+func (t *tailBuffer) Write(p []byte) (int, error) {
+
+	n, _ := t.Buffer.Write(p)
+	if t.Len() > t.size {
+		t.Next(t.Len() - t.size)
+	}
+
+	return n, nil
+}
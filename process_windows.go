@@ -0,0 +1,15 @@
+package main
+
+import (
+	"os/exec"
+)
+
+// setProcessGroup does nothing on Windows, children are killed one by one
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// killProcessGroup kills cmd
+func killProcessGroup(cmd *exec.Cmd) {
+	if cmd.Process != nil {
+		cmd.Process.Kill()
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/bwmarrin/dca/dcaenc"
+	"github.com/layeh/gopus"
+)
+
+// Quality is the score -quality-metric gave the finished file, for its
+// metadata
+var Quality *QualityMetadata
+
+// qualityMetrics are the metrics -quality-metric can score with, and the
+// sample rate an external tool needs its wav files in, 0 for any
+var qualityMetrics = map[string]int{
+	"spectral": 0,
+	"visqol":   48000,
+	"pesq":     16000,
+}
+
+// measureQuality decodes the DCA file f and InFile again and scores how
+// close the one is to the other with metric
+func measureQuality(f *os.File, metric string) (*QualityMetadata, error) {
+
+	original, err := readInFile()
+	if err != nil {
+		return nil, classify(exitFFmpeg, fmt.Errorf("error reading infile: %s", err))
+	}
+
+	// the input was encoded with the normalize gain already applied
+	if NormalizeGain != 0 {
+		applyGain(original, math.Pow(10, NormalizeGain/20), false)
+	}
+
+	decoded, err := decodeFile(f, len(original)/Channels)
+	if err != nil {
+		return nil, err
+	}
+
+	var score float64
+	if metric == "spectral" {
+		score = spectralDifference(original, decoded)
+	} else {
+		score, err = externalQuality(metric, original, decoded)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &QualityMetadata{Metric: metric, Score: roundLevel(score)}, nil
+}
+
+// decodeFile decodes the frames of the DCA file f and returns samples
+// samples per channel of them, without the encoder delay, so they line up
+// with the input
+func decodeFile(f *os.File, samples int) ([]int16, error) {
+
+	_, err := f.Seek(0, os.SEEK_SET)
+	if err != nil {
+		return nil, err
+	}
+
+	rbuf := bufio.NewReaderSize(f, 16384)
+
+	metadata, err := dcaenc.ReadHeader(rbuf)
+	if err != nil {
+		return nil, err
+	}
+
+	decoder, err := gopus.NewDecoder(FrameRate, Channels)
+	if err != nil {
+		return nil, classify(exitEncode, fmt.Errorf("NewDecoder Error: %s", err))
+	}
+
+	delay := dcaenc.PreSkip(Application) * FrameRate / 48000
+	frames := dcaenc.NewFrameReader(rbuf, metadata)
+
+	var decoded []int16
+	for len(decoded) < (delay+samples)*Channels {
+		opus, err := frames.ReadFrame()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		pcm, err := decoder.Decode(opus, FrameSize, false)
+		if err != nil {
+			return nil, classify(exitEncode, fmt.Errorf("Decoding Error: %s", err))
+		}
+		decoded = append(decoded, pcm...)
+	}
+
+	if len(decoded) < (delay+samples)*Channels {
+		return nil, fmt.Errorf("decoded %d samples of %d", len(decoded)/Channels-delay, samples)
+	}
+
+	return decoded[delay*Channels : (delay+samples)*Channels], nil
+}
+
+// externalQuality writes both versions out as wav files at the sample rate
+// the tool for metric needs, runs it and returns the MOS-LQO it prints
+func externalQuality(metric string, original, decoded []int16) (float64, error) {
+
+	path, err := exec.LookPath(metric)
+	if err != nil {
+		return 0, fmt.Errorf("%s not found in PATH", metric)
+	}
+
+	dir, err := ioutil.TempDir("", "dca-quality")
+	if err != nil {
+		return 0, err
+	}
+	defer os.RemoveAll(dir)
+
+	rate, channels := qualityMetrics[metric], Channels
+
+	// pesq only scores mono narrow and wide band speech
+	if metric == "pesq" {
+		channels = 1
+	}
+
+	reference := filepath.Join(dir, "reference.wav")
+	degraded := filepath.Join(dir, "degraded.wav")
+
+	for name, pcm := range map[string][]int16{reference: original, degraded: decoded} {
+		pcm = remix(pcm, Channels, channels, 0)
+		pcm = newResampler(FrameRate, rate, channels).Resample(pcm)
+
+		err = writeWav(name, pcm, rate, channels)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	var args []string
+	switch metric {
+	case "visqol":
+		args = []string{"--reference_file", reference, "--degraded_file", degraded}
+	case "pesq":
+		args = []string{"+" + strconv.Itoa(rate), reference, degraded}
+	}
+
+	out, err := exec.Command(path, args...).CombinedOutput()
+	if err != nil {
+		return 0, fmt.Errorf("%s: %s", metric, err)
+	}
+
+	score, ok := parseMOS(string(out))
+	if !ok {
+		return 0, fmt.Errorf("%s printed no MOS-LQO score", metric)
+	}
+
+	return score, nil
+}
+
+// parseMOS finds the MOS-LQO score in the output of visqol or pesq, the
+// last number on the last line that mentions it
+func parseMOS(output string) (float64, bool) {
+
+	score, found := 0.0, false
+	for _, line := range strings.Split(output, "\n") {
+		if !strings.Contains(line, "MOS-LQO") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		for i := len(fields) - 1; i >= 0; i-- {
+			if x, err := strconv.ParseFloat(fields[i], 64); err == nil {
+				score, found = x, true
+				break
+			}
+		}
+	}
+
+	return score, found
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// freeCheckInterval is how many bytes are written between checks of the
+// free space left for -min-free
+const freeCheckInterval = 4 << 20
+
+// diskGuard stops an encode before its output takes the filesystem below
+// -min-free, or grows past -max-output or the -output-quota of its folder,
+// so it fails with a clear error and a whole last frame rather than
+// writing until the disk is full
+type diskGuard struct {
+	dir     string
+	minFree int64
+
+	// most bytes the output may still take, -1 for no limit
+	limit int64
+
+	written int64
+	checked int64
+}
+
+// newDiskGuard returns a diskGuard for output written to the file at path,
+// checking there is room to start. It returns nil if no limits are set.
+func newDiskGuard(path string) (*diskGuard, error) {
+
+	if MinFree == "" && MaxOutput == "" && OutputQuota == "" {
+		return nil, nil
+	}
+
+	g := &diskGuard{dir: existingDir(filepath.Dir(path)), limit: -1}
+	var err error
+
+	if MinFree != "" {
+		g.minFree, err = parseSize(MinFree)
+		if err != nil {
+			return nil, fmt.Errorf("-min-free: %s", err)
+		}
+
+		err = g.checkFree(0)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if MaxOutput != "" {
+		g.limit, err = parseSize(MaxOutput)
+		if err != nil {
+			return nil, fmt.Errorf("-max-output: %s", err)
+		}
+	}
+
+	if OutputQuota != "" {
+		quota, err := parseSize(OutputQuota)
+		if err != nil {
+			return nil, fmt.Errorf("-output-quota: %s", err)
+		}
+
+		// the outfile is replaced unless it is appended to
+		skip := path
+		if AppendOutput {
+			skip = ""
+		}
+
+		used, err := folderSize(g.dir, skip)
+		if err != nil {
+			return nil, err
+		}
+		if used >= quota {
+			return nil, fmt.Errorf("%s already holds %d bytes, -output-quota is %d", g.dir, used, quota)
+		}
+
+		if g.limit < 0 || quota-used < g.limit {
+			g.limit = quota - used
+		}
+	}
+
+	return g, nil
+}
+
+// Writer returns w counting the bytes written through it, or w itself if
+// g is nil
+func (g *diskGuard) Writer(w io.Writer) io.Writer {
+
+	if g == nil {
+		return w
+	}
+
+	return &guardedWriter{w, g}
+}
+
+// Check returns an error if writing n more bytes would break a limit. A
+// nil diskGuard has none.
+func (g *diskGuard) Check(n int) error {
+
+	if g == nil {
+		return nil
+	}
+
+	if g.limit >= 0 && g.written+int64(n) > g.limit {
+		return fmt.Errorf("output would be over its limit of %d bytes", g.limit)
+	}
+
+	if g.minFree > 0 && g.written-g.checked >= freeCheckInterval {
+		g.checked = g.written
+		return g.checkFree(n)
+	}
+
+	return nil
+}
+
+// checkFree returns an error if writing n more bytes would leave less than
+// -min-free on the filesystem
+func (g *diskGuard) checkFree(n int) error {
+
+	free, err := freeSpace(g.dir)
+	if err != nil {
+		return fmt.Errorf("error checking free space: %s", err)
+	}
+
+	if free-int64(n) < g.minFree {
+		return fmt.Errorf("%d bytes free on the output filesystem, -min-free is %d", free, g.minFree)
+	}
+
+	return nil
+}
+
+// guardedWriter counts the bytes written to a guarded output
+type guardedWriter struct {
+	w io.Writer
+	g *diskGuard
+}
+
+// Write implements io.Writer
+func (gw *guardedWriter) Write(p []byte) (int, error) {
+
+	n, err := gw.w.Write(p)
+	gw.g.written += int64(n)
+
+	return n, err
+}
+
+// existingDir returns dir, or the closest folder above it that exists
+func existingDir(dir string) string {
+
+	for {
+		if _, err := os.Stat(dir); err == nil {
+			return dir
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return dir
+		}
+		dir = parent
+	}
+}
+
+// folderSize returns the total size of the files below dir, except skip
+func folderSize(dir, skip string) (int64, error) {
+
+	var size int64
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() && !sameFile(path, skip) {
+			size += info.Size()
+		}
+		return nil
+	})
+
+	return size, err
+}
+
+// sameFile reports whether paths a and b name the same file
+func sameFile(a, b string) bool {
+
+	fa, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	fb, err := os.Stat(b)
+	if err != nil {
+		return false
+	}
+
+	return os.SameFile(fa, fb)
+}
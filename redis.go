@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// redisConn is a connection to a redis server, speaking just enough of the
+// protocol for the few commands dca worker sends
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// redisError is an error reply from the server
+type redisError string
+
+func (e redisError) Error() string {
+	return string(e)
+}
+
+// dialRedis connects to the server of a url like
+// redis://:password@host:6379/0, logging in and selecting the database
+// when the url says to
+func dialRedis(rawurl string) (*redisConn, error) {
+
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "redis" {
+		return nil, fmt.Errorf("unsupported queue %q, must be a redis:// url", rawurl)
+	}
+
+	host := u.Host
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, "6379")
+	}
+
+	conn, err := net.Dial("tcp", host)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &redisConn{conn: conn, r: bufio.NewReader(conn)}
+
+	if u.User != nil {
+		password, ok := u.User.Password()
+		if !ok {
+			password = u.User.Username()
+		}
+
+		_, err = c.Do("AUTH", password)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		_, err = c.Do("SELECT", db)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// Close closes the connection
+func (c *redisConn) Close() error {
+	return c.conn.Close()
+}
+
+// Do sends a command and returns its reply, which is a string, an int64,
+// a []byte, nil or a []interface{} of those
+func (c *redisConn) Do(args ...string) (interface{}, error) {
+
+	w := bufio.NewWriter(c.conn)
+	fmt.Fprintf(w, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+
+	err := w.Flush()
+	if err != nil {
+		return nil, err
+	}
+
+	return c.readReply()
+}
+
+// readReply reads one reply from the server
+func (c *redisConn) readReply() (interface{}, error) {
+
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	line = strings.TrimSuffix(line, "\r\n")
+	if len(line) == 0 {
+		return nil, fmt.Errorf("empty reply from redis")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+
+	case '-':
+		return nil, redisError(line[1:])
+
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+
+		data := make([]byte, n+2)
+		_, err = io.ReadFull(c.r, data)
+		if err != nil {
+			return nil, err
+		}
+		return data[:n], nil
+
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+
+		items := make([]interface{}, n)
+		for i := range items {
+			items[i], err = c.readReply()
+			if err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+
+	return nil, fmt.Errorf("unexpected reply from redis: %q", line)
+}
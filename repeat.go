@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+)
+
+// A frame length of -N is a repeat marker, standing for N more copies of
+// the frame before it. Voice recordings are mostly silence, which the
+// encoder turns into the same few bytes every frame, so long runs of it
+// shrink to a couple of bytes. Files using it list repeatExtension in the
+// extensions of their dca metadata.
+const (
+	repeatExtension = "repeat"
+
+	// the most repeats one marker can stand for
+	maxRepeat = 32768
+)
+
+// frameWriter writes the frames of a DCA stream
+type frameWriter interface {
+	WriteFrame(opus []byte) error
+
+	// Flush writes anything held back until more frames were written
+	Flush() error
+}
+
+// newFrameWriter returns a frameWriter writing frames to w, adding parity
+// frames when -parity is set
+func newFrameWriter(w io.Writer) frameWriter {
+
+	if Parity > 0 {
+		return &parityWriter{w: w, size: Parity}
+	}
+
+	return &repeatWriter{w: w}
+}
+
+// repeatWriter writes frames to w, replacing frames that repeat the one
+// before them with repeat markers when -dedup is set
+type repeatWriter struct {
+	w io.Writer
+
+	// the last frame written, and how many repeats of it are waiting to
+	// be written as a marker
+	last  []byte
+	count int
+}
+
+// WriteFrame writes a frame, or counts it if it repeats the last one
+func (rw *repeatWriter) WriteFrame(opus []byte) error {
+
+	if Dedup && rw.last != nil && bytes.Equal(opus, rw.last) {
+		rw.count++
+		if rw.count == maxRepeat {
+			return rw.Flush()
+		}
+		return nil
+	}
+
+	err := rw.Flush()
+	if err != nil {
+		return err
+	}
+
+	rw.last = opus
+	return writeOutputFrame(rw.w, opus)
+}
+
+// Flush writes the marker for any repeats counted so far
+func (rw *repeatWriter) Flush() error {
+
+	if rw.count == 0 {
+		return nil
+	}
+
+	marker := int16(-rw.count)
+	rw.count = 0
+
+	return binary.Write(rw.w, binary.LittleEndian, marker)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// checkSandbox checks that ffmpeg and ffprobe can be run in a sandbox for
+// -sandbox, which needs bubblewrap and so Linux
+func checkSandbox() error {
+
+	if runtime.GOOS != "linux" {
+		return fmt.Errorf("error: -sandbox is only supported on linux")
+	}
+
+	_, err := exec.LookPath("bwrap")
+	if err != nil {
+		return fmt.Errorf("error: -sandbox requires bubblewrap (bwrap) in PATH")
+	}
+
+	return nil
+}
+
+// mediaCommand returns a command running ffmpeg or ffprobe on input. With
+// -sandbox it runs under bubblewrap, which gives it a read-only view of the
+// filesystem, its own namespaces without network access unless input is a
+// url, and no capabilities, as the media it parses is often from whoever
+// asked a bot to play something.
+func mediaCommand(input, name string, args ...string) *exec.Cmd {
+
+	if !Sandbox {
+		return exec.Command(name, args...)
+	}
+
+	wrap := []string{
+		"--ro-bind", "/", "/",
+		"--dev", "/dev",
+		"--proc", "/proc",
+		"--unshare-all",
+		"--die-with-parent",
+		"--new-session",
+		"--cap-drop", "ALL",
+	}
+
+	if isRemote(input) {
+		wrap = append(wrap, "--share-net")
+	}
+
+	wrap = append(wrap, "--", name)
+
+	return exec.Command("bwrap", append(wrap, args...)...)
+}
+
+// isRemote reports whether ffmpeg reads input over the network
+func isRemote(input string) bool {
+	return strings.Contains(input, "://") && !strings.HasPrefix(input, "file://")
+}
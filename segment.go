@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// segmentStart returns the start of the segment t falls in. Segments are
+// counted from local midnight so e.g. hourly segments start on the hour.
+func segmentStart(t time.Time, length time.Duration) time.Time {
+
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+
+	return midnight.Add(t.Sub(midnight) / length * length)
+}
+
+// strftime formats t using the %Y, %m, %d, %H, %M and %S directives of
+// C's strftime, and %% for a literal percent sign
+func strftime(pattern string, t time.Time) string {
+
+	replacer := strings.NewReplacer(
+		"%Y", fmt.Sprintf("%04d", t.Year()),
+		"%m", fmt.Sprintf("%02d", int(t.Month())),
+		"%d", fmt.Sprintf("%02d", t.Day()),
+		"%H", fmt.Sprintf("%02d", t.Hour()),
+		"%M", fmt.Sprintf("%02d", t.Minute()),
+		"%S", fmt.Sprintf("%02d", t.Second()),
+		"%%", "%",
+	)
+
+	return replacer.Replace(pattern)
+}
+
+// segmentWriter writes the frames it receives to a new file each time the
+// wall clock crosses into another segment. OutFile is used as a strftime
+// pattern for the name of each file, given the time its segment starts.
+func segmentWriter(in <-chan []byte) (err error) {
+
+	var f *os.File
+	var wbuf *bufio.Writer
+	var frames frameWriter
+	var end time.Time
+
+	// finish writes out the current segment and fills in its header
+	finish := func() error {
+
+		defer f.Close()
+
+		err := frames.Flush()
+		if err == nil {
+			err = wbuf.Flush()
+		}
+		if err != nil {
+			return fmt.Errorf("error writing output: %s", err)
+		}
+
+		if RawOutput == false {
+			err = patchHeader(f)
+			if err != nil {
+				return fmt.Errorf("error updating header: %s", err)
+			}
+		}
+
+		return f.Close()
+	}
+
+	defer func() {
+		if f == nil {
+			return
+		}
+
+		ferr := finish()
+		if err == nil {
+			err = ferr
+		}
+	}()
+
+	for opus := range in {
+
+		now := time.Now()
+
+		if f == nil || !now.Before(end) {
+			if f != nil {
+				err := finish()
+				f = nil
+				if err != nil {
+					return err
+				}
+			}
+
+			start := segmentStart(now, SegmentTime)
+			end = start.Add(SegmentTime)
+
+			name := strftime(OutFile, start)
+
+			err := os.MkdirAll(filepath.Dir(name), 0755)
+			if err != nil {
+				return fmt.Errorf("error opening outfile: %s", err)
+			}
+
+			f, err = os.Create(name)
+			if err != nil {
+				return fmt.Errorf("error opening outfile: %s", err)
+			}
+
+			// output buffer, 16KB unless -low-latency
+			wbuf = bufio.NewWriterSize(Guard.Writer(f), BufferSize)
+			frames = newFrameWriter(wbuf)
+
+			if RawOutput == false {
+				err = writeHeader(wbuf, true)
+				if err != nil {
+					return fmt.Errorf("error writing output: %s", err)
+				}
+
+				// the encoder runs on from one segment into the next, so
+				// only the first starts with its delay
+				Metadata.Opus.PreSkip = 0
+			}
+		}
+
+		err := Guard.Check(wbuf.Buffered() + len(opus) + 3)
+		if err == nil {
+			err = frames.WriteFrame(opus)
+		}
+		if err != nil {
+			return fmt.Errorf("error writing output: %s", err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// signalLevel is the peak amplitude of generated test signals, about
+// -12 dBFS, leaving headroom for the encoder
+const signalLevel = 0.25
+
+// TestSignal describes a synthetic input given as tone:<freq>hz:<duration>
+// or noise:<white|pink>:<duration>
+type TestSignal struct {
+	Kind      string // tone or noise
+	Frequency float64
+	Color     string // white or pink
+	Duration  time.Duration
+}
+
+// isSignal reports whether an infile names a test signal
+func isSignal(infile string) bool {
+	return strings.HasPrefix(infile, "tone:") || strings.HasPrefix(infile, "noise:")
+}
+
+// parseSignal parses a test signal infile
+func parseSignal(infile string) (*TestSignal, error) {
+
+	parts := strings.Split(infile, ":")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("test signals are given as tone:440hz:30s or noise:pink:10s")
+	}
+
+	duration, err := time.ParseDuration(parts[2])
+	if err != nil {
+		return nil, err
+	}
+
+	if duration <= 0 {
+		return nil, fmt.Errorf("test signal duration must be positive")
+	}
+
+	signal := &TestSignal{
+		Kind:     parts[0],
+		Duration: duration,
+	}
+
+	switch signal.Kind {
+	case "tone":
+		signal.Frequency, err = strconv.ParseFloat(strings.TrimSuffix(strings.ToLower(parts[1]), "hz"), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tone frequency %q", parts[1])
+		}
+
+		if signal.Frequency <= 0 || signal.Frequency >= float64(FrameRate)/2 {
+			return nil, fmt.Errorf("tone frequency must be between 0 and %dhz", FrameRate/2)
+		}
+
+	case "noise":
+		signal.Color = parts[1]
+		if signal.Color != "white" && signal.Color != "pink" {
+			return nil, fmt.Errorf("noise can be white or pink")
+		}
+	}
+
+	return signal, nil
+}
+
+// signalReader generates the test signal and sends it to the encoder in
+// place of reading an input
+func signalReader(out chan<- []int16) error {
+
+	total := int(Signal.Duration.Seconds() * float64(FrameRate))
+	EndPadding = (FrameSize - total%FrameSize) % FrameSize
+
+	// fixed seed so generated noise is the same every run
+	random := rand.New(rand.NewSource(1))
+
+	// state of the pink noise filter
+	var b [7]float64
+
+	for n := 0; n < total; n += FrameSize {
+
+		pcm := make([]int16, FrameSize*Channels)
+
+		for i := 0; i < FrameSize && n+i < total; i++ {
+			var x float64
+
+			switch Signal.Kind {
+			case "tone":
+				x = math.Sin(2 * math.Pi * Signal.Frequency * float64(n+i) / float64(FrameRate))
+
+			case "noise":
+				white := random.Float64()*2 - 1
+				x = white
+
+				// Paul Kellett's refined pink noise filter
+				if Signal.Color == "pink" {
+					b[0] = 0.99886*b[0] + white*0.0555179
+					b[1] = 0.99332*b[1] + white*0.0750759
+					b[2] = 0.96900*b[2] + white*0.1538520
+					b[3] = 0.86650*b[3] + white*0.3104856
+					b[4] = 0.55000*b[4] + white*0.5329522
+					b[5] = -0.7616*b[5] - white*0.0168980
+					x = (b[0] + b[1] + b[2] + b[3] + b[4] + b[5] + b[6] + white*0.5362) * 0.11
+					b[6] = white * 0.115926
+				}
+			}
+
+			s := int16(x * signalLevel * 32767)
+			for c := 0; c < Channels; c++ {
+				pcm[i*Channels+c] = s
+			}
+		}
+
+		select {
+		case out <- pcm:
+		case <-quit:
+			return nil
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// spillBuffer is a buffer that is kept in memory until it grows past its
+// limit, and moves to a temp file from then on. A limit of 0 keeps it in
+// memory whatever its size.
+type spillBuffer struct {
+	limit int64
+	size  int64
+	mem   bytes.Buffer
+	file  *os.File
+}
+
+// newSpillBuffer returns an empty spillBuffer that spills to disk past
+// limit bytes
+func newSpillBuffer(limit int64) *spillBuffer {
+	return &spillBuffer{limit: limit}
+}
+
+// Write implements io.Writer
+func (b *spillBuffer) Write(p []byte) (int, error) {
+
+	if b.file == nil && b.limit > 0 && b.size+int64(len(p)) > b.limit {
+		f, err := ioutil.TempFile("", "dca")
+		if err != nil {
+			return 0, err
+		}
+		b.file = f
+
+		_, err = b.mem.WriteTo(f)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	var n int
+	var err error
+	if b.file != nil {
+		n, err = b.file.Write(p)
+	} else {
+		n, err = b.mem.Write(p)
+	}
+	b.size += int64(n)
+
+	return n, err
+}
+
+// Len returns the number of bytes written to the buffer
+func (b *spillBuffer) Len() int64 {
+	return b.size
+}
+
+// Reader returns a reader for everything written to the buffer so far
+func (b *spillBuffer) Reader() (io.Reader, error) {
+
+	if b.file == nil {
+		return bytes.NewReader(b.mem.Bytes()), nil
+	}
+
+	_, err := b.file.Seek(0, os.SEEK_SET)
+	if err != nil {
+		return nil, err
+	}
+
+	return io.LimitReader(b.file, b.size), nil
+}
+
+// Close frees the buffer and removes its temp file, if it has one
+func (b *spillBuffer) Close() error {
+
+	b.mem.Reset()
+	if b.file == nil {
+		return nil
+	}
+
+	b.file.Close()
+	err := os.Remove(b.file.Name())
+	b.file = nil
+
+	return err
+}
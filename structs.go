@@ -1,79 +1,39 @@
 package main
 
-// Base metadata struct
-// 
-// https://github.com/bwmarrin/dca/issues/5#issuecomment-189713886
-type MetadataStruct struct {
-    Dca             *DCAMetadata    `json:"dca"`
-    SongInfo        *SongMetadata   `json:"info"`
-    Origin          *OriginMetadata `json:"origin"`
-    Opus            *OpusMetadata   `json:"opus"`
-    Extra           *ExtraMetadata  `json:"extra"`
-}
-
-// DCA metadata struct
-// 
-// Contains the DCA version.
-type DCAMetadata struct {
-    Version int8                `json:"version"`
-    Tool    *DCAToolMetadata    `json:"tool"`
-}
-
-// DCA tool metadata struct
-// 
-// Contains the Git revisions, commit author etc.
-type DCAToolMetadata struct {
-    Name        string  `json:"name"`
-    Version     string  `json:"version"`
-    Url         string  `json:"url"`
-    Author      string  `json:"author"`
-}
-
-// Song Information metadata struct
-// 
-// Contains information about the song that was encoded.
-type SongMetadata struct {
-    Title       string  `json:"title"`
-    Artist      string  `json:"artist"`
-    Album       string  `json:"album"`
-    Genre       string  `json:"genre"`
-    Comments    string  `json:"comments"`
-    Cover       *string `json:"cover"`
-}
+import "github.com/bwmarrin/dca/dcaenc"
 
-// Origin information metadata struct
-// 
-// Contains information about where the song came from,
-// audio bitrate, channels and original encoding.
-type OriginMetadata struct {
-    Source      string  `json:"source"`
-    Bitrate     int     `json:"abr"`
-    Channels    int     `json:"channels"`
-    Encoding    string  `json:"encoding"`
-    Url         string  `json:"url"`
-}
-
-// Opus metadata struct
-// 
-// Contains information about how the file was encoded
-// with Opus.
-type OpusMetadata struct {
-    Bitrate     int     `json:"abr"`
-    SampleRate  int     `json:"sample_rate"`
-    Application string  `json:"mode"`
-    FrameSize   int     `json:"frame_size"`
-    Channels    int     `json:"channels"`
-}
+////////////////////////////////////////////////////////
+/// DCA Structures
+////////////////////////////////////////////////////////
 
-// Extra metadata struct
-type ExtraMetadata struct {}
+// The metadata of DCA files lives in the dcaenc package,
+// so bots using it read and write the same format.
+//
+// https://github.com/bwmarrin/dca/issues/5#issuecomment-189713886
+type (
+    MetadataStruct   = dcaenc.Metadata
+    DCAMetadata      = dcaenc.DCAMetadata
+    DCAToolMetadata  = dcaenc.ToolMetadata
+    SongMetadata     = dcaenc.SongMetadata
+    OriginMetadata   = dcaenc.OriginMetadata
+    OpusMetadata     = dcaenc.OpusMetadata
+    TrackMetadata    = dcaenc.TrackMetadata
+    StreamMetadata   = dcaenc.StreamMetadata
+    ExtraMetadata    = dcaenc.ExtraMetadata
+    GapMetadata      = dcaenc.GapMetadata
+    SeamMetadata     = dcaenc.SeamMetadata
+    SeekIndex        = dcaenc.SeekIndex
+    LoudnessMetadata = dcaenc.LoudnessMetadata
+    QualityMetadata  = dcaenc.QualityMetadata
+)
 
 ////////////////////////////////////////////////////////
 /// FFprobe Structures
 ////////////////////////////////////////////////////////
 
 type FFprobeMetadata struct {
-    Format  *FFprobeFormat  `json:"format"`
+    Format  *FFprobeFormat      `json:"format"`
+    Streams []*FFprobeStream    `json:"streams"`
 }
 
 type FFprobeFormat struct {
@@ -99,4 +59,13 @@ type FFprobeTags struct {
     Title       string  `json:"title"`
     Album       string  `json:"album"`
     Compilation string  `json:"compilation"`
+}
+
+type FFprobeStream struct {
+    Index           int             `json:"index"`
+    CodecName       string          `json:"codec_name"`
+    SampleFmt       string          `json:"sample_fmt"`
+    SampleRate      string          `json:"sample_rate"`
+    Channels        int             `json:"channels"`
+    ChannelLayout   string          `json:"channel_layout"`
 }
\ No newline at end of file
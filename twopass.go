@@ -0,0 +1,322 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/dca/dcaenc"
+)
+
+// planSeconds is the length of the segments a two pass encode spreads its
+// budget over
+const planSeconds = 1
+
+// bitrate limits of libopus, in bits per second
+const (
+	minBitrate = 6000
+	maxBitrate = 510000
+)
+
+// floorBitrate is the bitrate below which -target-size warns that music
+// will sound noticeably worse
+const floorBitrate = 24000
+
+// parseSize parses a file size such as 8MB, where KB, MB and GB are powers
+// of 1024 as in Discord's upload limits
+func parseSize(s string) (int64, error) {
+
+	units := []struct {
+		suffix string
+		size   int64
+	}{
+		{"GB", 1 << 30},
+		{"MB", 1 << 20},
+		{"KB", 1 << 10},
+		{"G", 1 << 30},
+		{"M", 1 << 20},
+		{"K", 1 << 10},
+		{"B", 1},
+	}
+
+	unit := int64(1)
+	number := strings.ToUpper(strings.TrimSpace(s))
+	for _, u := range units {
+		if strings.HasSuffix(number, u.suffix) {
+			number = strings.TrimSuffix(number, u.suffix)
+			unit = u.size
+			break
+		}
+	}
+
+	n, err := strconv.ParseFloat(strings.TrimSpace(number), 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+
+	return int64(n * float64(unit)), nil
+}
+
+// bitratePlan spreads a budget of bytes over the segments of an input by
+// how many bytes each needed in a first pass, so busy passages get more
+// of it than quiet ones
+type bitratePlan struct {
+	// bytes planned for each segment, and frames per segment
+	budget  []int
+	perPlan int
+
+	frame   int // frames encoded so far
+	spent   int // bytes they took
+	planned int // bytes planned for the segments before the current one
+}
+
+// newBitratePlan returns a plan spreading budget bytes over segments in
+// proportion to the bytes each took in the first pass
+func newBitratePlan(measured []int, budget int64) *bitratePlan {
+
+	total := int64(0)
+	for _, n := range measured {
+		total += int64(n)
+	}
+
+	plan := &bitratePlan{
+		budget:  make([]int, len(measured)),
+		perPlan: planSeconds * FrameRate / FrameSize,
+	}
+
+	for i, n := range measured {
+		if total > 0 {
+			plan.budget[i] = int(budget * int64(n) / total)
+		} else {
+			plan.budget[i] = int(budget / int64(len(measured)))
+		}
+	}
+
+	return plan
+}
+
+// Bitrate returns the bitrate to encode the next frame at. Half of what
+// earlier segments went over or under their budget is made up in the
+// current one.
+func (p *bitratePlan) Bitrate() int {
+
+	segment := p.frame / p.perPlan
+	if segment >= len(p.budget) {
+		segment = len(p.budget) - 1
+	} else if p.frame%p.perPlan == 0 && segment > 0 {
+		p.planned += p.budget[segment-1]
+	}
+
+	target := p.budget[segment] + (p.planned-p.spent)/2
+	bitrate := target * 8 / planSeconds
+
+	if bitrate < minBitrate {
+		bitrate = minBitrate
+	} else if bitrate > maxBitrate {
+		bitrate = maxBitrate
+	}
+
+	return bitrate
+}
+
+// Add records the size of a frame encoded at the last bitrate
+func (p *bitratePlan) Add(size int) {
+	p.frame++
+	p.spent += size
+}
+
+// measurePass encodes InFile once at the -ab bitrate without writing any
+// of it, and returns the bytes each segment of the input took and the
+// number of frames
+func measurePass() ([]int, int, error) {
+
+	encoder, err := newEncoder()
+	if err != nil {
+		return nil, 0, classify(exitEncode, fmt.Errorf("NewEncoder Error: %s", err))
+	}
+
+	ffmpeg := pcmCommand(InFile)
+	stdout, err := ffmpeg.StdoutPipe()
+	if err != nil {
+		return nil, 0, classify(exitFFmpeg, fmt.Errorf("StdoutPipe Error: %s", err))
+	}
+
+	err = startCommand(ffmpeg)
+	if err != nil {
+		return nil, 0, classify(exitFFmpeg, fmt.Errorf("RunStart Error: %s", err))
+	}
+
+	perPlan := planSeconds * FrameRate / FrameSize
+	buf := make([]byte, FrameSize*Channels*2)
+
+	var measured []int
+	frames := 0
+	for {
+		n, err := io.ReadFull(stdout, buf)
+		if n > 0 {
+			for i := n; i < len(buf); i++ {
+				buf[i] = 0
+			}
+
+			opus, err := encoder.Encode(pcmFrame(buf))
+			if err != nil {
+				waitCommand(ffmpeg)
+				return nil, 0, classify(exitEncode, fmt.Errorf("Encoding Error: %s", err))
+			}
+
+			if frames%perPlan == 0 {
+				measured = append(measured, 0)
+			}
+			measured[len(measured)-1] += len(opus)
+			frames++
+		}
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			waitCommand(ffmpeg)
+			return nil, 0, classify(exitFFmpeg, fmt.Errorf("error reading from ffmpeg stdout: %s", err))
+		}
+	}
+
+	err = waitCommand(ffmpeg)
+	if err != nil {
+		return nil, 0, classify(exitFFmpeg, fmt.Errorf("first pass failed: %s", err))
+	}
+
+	if len(measured) == 0 {
+		return nil, 0, classify(exitInput, fmt.Errorf("first pass found no audio"))
+	}
+
+	return measured, frames, nil
+}
+
+// audioBudget returns the bytes of a file of size bytes left for opus data
+// once the header, room for it to be updated and the frame lengths are
+// taken out
+func audioBudget(size int64, frames int) (int64, error) {
+
+	metadata, err := json.Marshal(Metadata)
+	if err != nil {
+		return 0, err
+	}
+
+	// the header grows a little once the extra block is filled in
+	header := int64(len(MagicBytes)+4+len(metadata)+MetadataPadding+headerReserve) + 512
+
+	budget := size - header - int64(frames)*2
+
+	// a parity frame is about as big as the frames of its group, plus
+	// their lengths and checksums
+	if Parity > 0 {
+		groups := int64(frames/Parity + 1)
+		budget -= int64(frames)*6 + groups*3
+		budget = budget * int64(Parity) / int64(Parity+1)
+	}
+
+	if budget <= 0 {
+		return 0, classify(exitUsage, fmt.Errorf("-target-size is too small for the header and %d frames", frames))
+	}
+
+	return budget, nil
+}
+
+// planBitrate runs the first pass of a two pass encode and returns a plan
+// for the second that fits the output into size bytes
+func planBitrate(size int64) (*bitratePlan, error) {
+
+	measured, frames, err := measurePass()
+	if err != nil {
+		return nil, err
+	}
+
+	budget, err := audioBudget(size, frames)
+	if err != nil {
+		return nil, err
+	}
+
+	return newBitratePlan(measured, budget), nil
+}
+
+// average returns the bitrate the plan comes to over the whole input, in
+// bits per second
+func (p *bitratePlan) average() int {
+
+	total := 0
+	for _, n := range p.budget {
+		total += n
+	}
+
+	return total * 8 / (len(p.budget) * planSeconds)
+}
+
+// inputDuration returns how long the input is, from the generator for
+// test signals or from ffprobe for files and the tracks of an album
+func inputDuration() (time.Duration, error) {
+
+	if Signal != nil {
+		return Signal.Duration, nil
+	}
+
+	files := []string{InFile}
+	if AlbumMode {
+		files = Tracks
+	}
+
+	total := time.Duration(0)
+	for _, file := range files {
+		data, err := probe(file)
+		if err != nil {
+			return 0, classify(exitFFmpeg, fmt.Errorf("ffprobe %s: %s", file, err))
+		}
+
+		seconds, err := strconv.ParseFloat(data.Format.Duration, 64)
+		if err != nil || seconds <= 0 {
+			return 0, classify(exitFFmpeg, fmt.Errorf("unknown duration for %s", file))
+		}
+
+		// only the part of the input -ss and -t pick out is encoded
+		duration := time.Duration(seconds*float64(time.Second)) - StartTime
+		if ClipTime > 0 && ClipTime < duration {
+			duration = ClipTime
+		}
+		if duration <= 0 {
+			return 0, classify(exitUsage, fmt.Errorf("-ss is past the end of %s", file))
+		}
+
+		total += duration
+	}
+
+	return total, nil
+}
+
+// targetBitrate returns the bitrate, in bits per second, that fills size
+// bytes over the length of the input
+func targetBitrate(size int64) (int, error) {
+
+	duration, err := inputDuration()
+	if err != nil {
+		return 0, err
+	}
+
+	// the flushed encoder delay and the padded last frame add a frame or
+	// two to what the duration alone needs
+	frames := int(duration.Seconds()*float64(FrameRate))/FrameSize + 2
+	frames += dcaenc.PreSkip(Application)*FrameRate/48000/FrameSize + 1
+
+	budget, err := audioBudget(size, frames)
+	if err != nil {
+		return 0, err
+	}
+
+	bitrate := int(float64(budget*8) / (float64(frames*FrameSize) / float64(FrameRate)))
+	if bitrate > maxBitrate {
+		bitrate = maxBitrate
+	}
+
+	return bitrate, nil
+}
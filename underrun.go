@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Gaps are the runs of silence frames gapFiller has sent in place of a
+// stalled input, for the metadata of the finished file
+var Gaps []*GapMetadata
+
+// gapFiller returns an opus stage for live inputs that keeps the output
+// playing in step with the wall clock when the input stalls. Frames are
+// due one frame length apart from when the first arrived, and once one is
+// more than late behind, a frame of silence is sent in its place. Frames
+// that turn up afterwards are sent on as they are, so a Discord client
+// playing the output hears a short silence instead of stuttering and then
+// speeding up to catch up.
+func gapFiller(late time.Duration) opusStage {
+
+	return func(in <-chan []byte, out chan<- []byte) error {
+
+		silence, err := silenceFrame()
+		if err != nil {
+			return err
+		}
+
+		frame := time.Duration(FrameSize) * time.Second / time.Duration(FrameRate)
+
+		var start time.Time
+		sent := 0
+
+		for {
+			// nothing is due until the input has started
+			var timeout <-chan time.Time
+			var timer *time.Timer
+			if !start.IsZero() {
+				due := start.Add(time.Duration(sent)*frame + late)
+				timer = time.NewTimer(due.Sub(time.Now()))
+				timeout = timer.C
+			}
+
+			opus, ok := []byte(nil), true
+			select {
+			case opus, ok = <-in:
+			case <-timeout:
+				opus = silence
+				markGap(sent)
+			case <-quit:
+				return nil
+			}
+			if timer != nil {
+				timer.Stop()
+			}
+
+			if !ok {
+				return nil
+			}
+			if start.IsZero() {
+				start = time.Now()
+			}
+
+			select {
+			case out <- opus:
+			case <-quit:
+				return nil
+			}
+			sent++
+		}
+	}
+}
+
+// markGap adds a frame of silence to Gaps, extending the last gap if it
+// ends where this one starts
+func markGap(frame int) {
+
+	if n := len(Gaps); n > 0 && Gaps[n-1].Offset+Gaps[n-1].Frames == frame {
+		Gaps[n-1].Frames++
+		return
+	}
+
+	Gaps = append(Gaps, &GapMetadata{Offset: frame, Frames: 1})
+}
+
+// silenceFrame encodes a frame of silence with the settings of the encode,
+// on an encoder of its own so it is ready before it is needed. The first
+// frames of an encoder carry its start up, so the last of a few is used.
+func silenceFrame() ([]byte, error) {
+
+	encoder, err := newEncoder()
+	if err != nil {
+		return nil, classify(exitEncode, fmt.Errorf("NewEncoder Error: %s", err))
+	}
+
+	pcm := make([]int16, FrameSize*Channels)
+
+	var opus []byte
+	for i := 0; i < 3; i++ {
+		opus, err = encoder.Encode(pcm)
+		if err != nil {
+			return nil, classify(exitEncode, fmt.Errorf("Encoding Error: %s", err))
+		}
+	}
+
+	return opus, nil
+}
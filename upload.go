@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// checkUploadURL checks that a job's output can be uploaded to dest, which
+// must be an http or https url taking a PUT, such as a presigned S3 url
+func checkUploadURL(dest string) error {
+
+	u, err := url.Parse(dest)
+	if err != nil {
+		return err
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("unsupported upload url %q, must be http or https", dest)
+	}
+
+	return nil
+}
+
+// uploadFile sends the file at path to dest with an http PUT and returns
+// how many bytes were sent
+func uploadFile(path, dest string) (int64, error) {
+
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	req, err := http.NewRequest("PUT", dest, f)
+	if err != nil {
+		return 0, err
+	}
+
+	// presigned urls are signed for a set length, and some stores don't
+	// take chunked uploads at all
+	req.ContentLength = fi.Size()
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(&io.LimitedReader{R: resp.Body, N: 512})
+		return 0, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	return fi.Size(), nil
+}
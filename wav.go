@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+)
+
+// wav format tags, with extensible files naming theirs in the first two
+// bytes of the subformat
+const (
+	wavFormatPCM        = 1
+	wavFormatFloat      = 3
+	wavFormatExtensible = 0xfffe
+)
+
+// wavInput is the input of -no-ffmpeg, a wav file or raw pcm16
+type wavInput struct {
+	r        io.Reader
+	rate     int
+	channels int
+	mask     uint32
+	bits     int
+	float    bool
+	encoding string
+}
+
+// openWav opens input for -no-ffmpeg. Wav input is read from its header,
+// anything else on a pipe is taken to be pcm16 at the output sample rate
+// and channels, as without -no-ffmpeg.
+func openWav(input string) (*wavInput, error) {
+
+	var f *os.File
+	var err error
+	if isPipe(input) {
+		f, err = openPipe(input)
+	} else {
+		f, err = os.Open(input)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rbuf := bufio.NewReaderSize(f, BufferSize)
+
+	magic, err := rbuf.Peek(4)
+	if err == nil && string(magic) == "RIFF" {
+		return readWavHeader(rbuf)
+	}
+
+	if !isPipe(input) {
+		return nil, fmt.Errorf("%s is not a wav file, which -no-ffmpeg needs for files", input)
+	}
+
+	return &wavInput{r: rbuf, rate: FrameRate, channels: Channels, bits: 16, encoding: "pcm16/s16le"}, nil
+}
+
+// readWavHeader reads the chunks of a wav file up to the start of its
+// audio
+func readWavHeader(r io.Reader) (*wavInput, error) {
+
+	var riff [12]byte
+	_, err := io.ReadFull(r, riff[:])
+	if err != nil {
+		return nil, err
+	}
+	if string(riff[8:]) != "WAVE" {
+		return nil, fmt.Errorf("not a wav file")
+	}
+
+	var w *wavInput
+	for {
+		var head [8]byte
+		_, err = io.ReadFull(r, head[:])
+		if err != nil {
+			return nil, fmt.Errorf("wav file has no audio")
+		}
+		id := string(head[:4])
+		size := binary.LittleEndian.Uint32(head[4:])
+
+		switch id {
+		case "fmt ":
+			if size < 16 || size > 1024 {
+				return nil, fmt.Errorf("invalid wav format chunk")
+			}
+			chunk := make([]byte, size+size%2)
+			_, err = io.ReadFull(r, chunk)
+			if err != nil {
+				return nil, err
+			}
+
+			w, err = parseWavFormat(chunk)
+			if err != nil {
+				return nil, err
+			}
+
+		case "data":
+			if w == nil {
+				return nil, fmt.Errorf("wav file has audio before its format")
+			}
+
+			// streamed wav leaves the size unset, and is read to the end
+			w.r = r
+			if size != 0 && size != 0xffffffff {
+				w.r = io.LimitReader(r, int64(size))
+			}
+			return w, nil
+
+		default:
+			_, err = io.CopyN(ioutil.Discard, r, int64(size)+int64(size%2))
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// parseWavFormat reads the format chunk of a wav file
+func parseWavFormat(chunk []byte) (*wavInput, error) {
+
+	format := int(binary.LittleEndian.Uint16(chunk))
+	w := &wavInput{
+		channels: int(binary.LittleEndian.Uint16(chunk[2:])),
+		rate:     int(binary.LittleEndian.Uint32(chunk[4:])),
+		bits:     int(binary.LittleEndian.Uint16(chunk[14:])),
+	}
+
+	if format == wavFormatExtensible && len(chunk) >= 26 {
+		w.mask = binary.LittleEndian.Uint32(chunk[20:])
+		format = int(binary.LittleEndian.Uint16(chunk[24:]))
+	}
+
+	switch {
+	case format == wavFormatPCM && (w.bits == 16 || w.bits == 24 || w.bits == 32):
+		w.encoding = fmt.Sprintf("wav/s%dle", w.bits)
+	case format == wavFormatFloat && w.bits == 32:
+		w.float = true
+		w.encoding = "wav/f32le"
+	default:
+		return nil, fmt.Errorf("unsupported wav format %d with %d bit samples, -no-ffmpeg reads 16, 24 and 32 bit pcm and 32 bit float", format, w.bits)
+	}
+
+	if w.channels < 1 || w.channels > 8 || w.rate < 1000 || w.rate > 384000 {
+		return nil, fmt.Errorf("unsupported wav with %d channels at %d Hz", w.channels, w.rate)
+	}
+
+	return w, nil
+}
+
+// samples converts whole samples of the input to pcm16
+func (w *wavInput) samples(buf []byte) []int16 {
+
+	size := w.bits / 8
+	pcm := make([]int16, len(buf)/size)
+
+	for i := range pcm {
+		b := buf[i*size:]
+
+		switch {
+		case w.float:
+			x := float64(math.Float32frombits(binary.LittleEndian.Uint32(b))) * 32768
+			if x > 32767 {
+				x = 32767
+			} else if x < -32768 {
+				x = -32768
+			}
+			pcm[i] = int16(x)
+		default:
+			// the top two bytes of a little endian sample
+			pcm[i] = int16(binary.LittleEndian.Uint16(b[size-2:]))
+		}
+	}
+
+	return pcm
+}
+
+// wavReader reads the input of -no-ffmpeg, doing what ffmpeg otherwise
+// would: mixing it to the output channels, resampling it to the output
+// sample rate and applying -vol
+func wavReader(out chan<- []int16) error {
+
+	w := WavIn
+	resample := newResampler(w.rate, FrameRate, Channels)
+	gain := float64(Volume) / 256
+
+	size := w.bits / 8 * w.channels
+	buf := make([]byte, 1024*size)
+	frame := make([]int16, 0, FrameSize*Channels)
+
+	r, err := trimInput(w.r, w.rate, size)
+	if err != nil {
+		return fmt.Errorf("error reading input: %s", err)
+	}
+
+	for {
+		n, err := io.ReadFull(r, buf)
+
+		pcm := remix(w.samples(buf[:n-n%size]), w.channels, Channels, w.mask)
+		pcm = resample.Resample(pcm)
+		if Volume != 256 {
+			applyGain(pcm, gain, false)
+		}
+
+		for len(pcm) > 0 {
+			take := cap(frame) - len(frame)
+			if take > len(pcm) {
+				take = len(pcm)
+			}
+			frame = append(frame, pcm[:take]...)
+			pcm = pcm[take:]
+
+			if len(frame) < cap(frame) {
+				continue
+			}
+
+			select {
+			case out <- frame:
+			case <-quit:
+				return nil
+			}
+			frame = make([]int16, 0, FrameSize*Channels)
+		}
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("error reading input: %s", err)
+		}
+	}
+
+	// whatever is left is padded out to one last frame
+	EndPadding = 0
+	if len(frame) > 0 {
+		EndPadding = FrameSize - len(frame)/Channels
+		frame = frame[:cap(frame)]
+
+		select {
+		case out <- frame:
+		case <-quit:
+		}
+	}
+
+	return nil
+}
+
+// trimInput skips -ss into r, audio at rate with sample frames of size
+// bytes, and ends it -t later, so without ffmpeg the excerpt still starts
+// and stops on the exact sample
+func trimInput(r io.Reader, rate, size int) (io.Reader, error) {
+
+	if StartTime > 0 {
+		skip := int64(StartTime.Seconds()*float64(rate)) * int64(size)
+
+		// input that ends before -ss leaves nothing to encode
+		_, err := io.CopyN(ioutil.Discard, r, skip)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+	}
+
+	if ClipTime > 0 {
+		r = io.LimitReader(r, int64(ClipTime.Seconds()*float64(rate))*int64(size))
+	}
+
+	return r, nil
+}
+
+// wavHeader returns the header of a wav file of pcm in the given -pcm-format
+// with size bytes of audio. An unknown size is left at its largest, which
+// players take to mean the audio runs to the end of the file.
+func wavHeader(rate, channels int, format string, size int64) []byte {
+
+	tag, bits := wavFormatPCM, 16
+	switch format {
+	case "s32le":
+		bits = 32
+	case "f32le":
+		tag, bits = wavFormatFloat, 32
+	}
+
+	riffSize, dataSize := uint32(0xffffffff), uint32(0xffffffff)
+	if size >= 0 && size <= 0xffffffff-36 {
+		riffSize, dataSize = uint32(36+size), uint32(size)
+	}
+
+	header := make([]byte, 44)
+	copy(header, "RIFF")
+	binary.LittleEndian.PutUint32(header[4:], riffSize)
+	copy(header[8:], "WAVEfmt ")
+	binary.LittleEndian.PutUint32(header[16:], 16)
+	binary.LittleEndian.PutUint16(header[20:], uint16(tag))
+	binary.LittleEndian.PutUint16(header[22:], uint16(channels))
+	binary.LittleEndian.PutUint32(header[24:], uint32(rate))
+	binary.LittleEndian.PutUint32(header[28:], uint32(rate*channels*bits/8))
+	binary.LittleEndian.PutUint16(header[32:], uint16(channels*bits/8))
+	binary.LittleEndian.PutUint16(header[34:], uint16(bits))
+	copy(header[36:], "data")
+	binary.LittleEndian.PutUint32(header[40:], dataSize)
+
+	return header
+}
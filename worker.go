@@ -0,0 +1,330 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// WorkerJob is a job pulled from the queue by dca worker. Args are the
+// arguments to run dca with, as they would be given on the command line.
+// If Upload is set, the output is written to a temp file and uploaded
+// there once the job is done, instead of to a -o in Args.
+type WorkerJob struct {
+	ID     string   `json:"id"`
+	Args   []string `json:"args"`
+	Upload string   `json:"upload,omitempty"`
+}
+
+// WorkerResult is what dca worker reports once it has run a job. Output is
+// the end of what dca printed, Duration is in milliseconds and Uploaded is
+// the size of the output uploaded, if the job had one.
+type WorkerResult struct {
+	ID       string `json:"id"`
+	Worker   string `json:"worker"`
+	OK       bool   `json:"ok"`
+	Error    string `json:"error,omitempty"`
+	Output   string `json:"output,omitempty"`
+	Duration int    `json:"duration"`
+	Uploaded int64  `json:"uploaded,omitempty"`
+}
+
+// workerOutput is how much of what a job prints is kept for its result
+const workerOutput = 4096
+
+// workerPoll is how often a worker with -preempt checks the queues of a
+// higher priority than the job it is running
+const workerPoll = time.Second
+
+// workerCmd implements "dca worker" which pulls jobs from redis lists, runs
+// each with its own dca process, and pushes their results onto another
+// list, so any number of hosts can share the encoding of one queue. With
+// several lists, jobs are always taken from the first that has any, so
+// interactive requests can go ahead of background work.
+func workerCmd(args []string) {
+
+	var queue, keys, results string
+	var preempt bool
+	var drainTimeout time.Duration
+
+	fs := flag.NewFlagSet("worker", flag.ExitOnError)
+	fs.StringVar(&queue, "queue", "", "redis url of the queue, like redis://:password@host:6379/0")
+	fs.StringVar(&keys, "key", "dca:jobs", "lists to pull json jobs from, highest priority first, separated by commas")
+	fs.StringVar(&results, "results", "dca:results", "list to push json results onto")
+	fs.BoolVar(&preempt, "preempt", false, "stop a job when one of a higher priority is waiting, putting it back at the front of its list")
+	fs.DurationVar(&drainTimeout, "drain-timeout", 5*time.Minute, "how long a job may go on for once the worker is told to stop, before it is put back on its list (0 for no limit)")
+	fs.Parse(args)
+
+	if queue == "" {
+		reportError(exitUsage, "error: worker requires -queue")
+		return
+	}
+
+	lists := strings.Split(keys, ",")
+
+	self, err := os.Executable()
+	if err != nil {
+		reportError(exitFailure, "error:", err)
+		exit()
+	}
+
+	hostname, _ := os.Hostname()
+	name := fmt.Sprintf("%s:%d", hostname, os.Getpid())
+
+	conn, err := dialRedis(queue)
+	if err != nil {
+		reportError(exitFailure, "error connecting to queue:", err)
+		exit()
+	}
+	defer conn.Close()
+
+	// On an interrupt or SIGTERM no more jobs are taken, and the one
+	// running has until the deadline to finish before it is stopped and
+	// put back for another worker.
+	drain := make(chan struct{})
+	deadline := make(chan struct{})
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		<-signals
+		close(drain)
+
+		if drainTimeout > 0 {
+			time.Sleep(drainTimeout)
+			close(deadline)
+		}
+	}()
+
+	for {
+		select {
+		case <-drain:
+			return
+		default:
+		}
+
+		// BLPOP takes from the first list given that isn't empty, and
+		// gives up after a second so a drain isn't held up
+		reply, err := conn.Do(append(append([]string{"BLPOP"}, lists...), "1")...)
+		if err != nil {
+			reportError(exitFailure, "error reading queue:", err)
+			exit()
+		}
+
+		// the reply is the list and the job popped from it, or nil if
+		// there was none
+		items, ok := reply.([]interface{})
+		if !ok || len(items) != 2 {
+			continue
+		}
+		list, _ := items[0].([]byte)
+		data, _ := items[1].([]byte)
+
+		// a drain that began while BLPOP waited puts the job back untouched
+		select {
+		case <-drain:
+			_, err = conn.Do("LPUSH", string(list), string(data))
+			if err != nil {
+				reportError(exitFailure, "error requeueing job:", err)
+				exit()
+			}
+			return
+		default:
+		}
+
+		// a job can be stopped for any waiting on the lists before its own
+		var waiting func() bool
+		if preempt {
+			higher := lists[:indexOf(lists, string(list))]
+			waiting = func() bool {
+				return jobsWaiting(conn, higher)
+			}
+		}
+
+		result := runWorkerJob(self, data, waiting, deadline)
+		if result == nil {
+			_, err = conn.Do("LPUSH", string(list), string(data))
+			if err != nil {
+				reportError(exitFailure, "error requeueing job:", err)
+				exit()
+			}
+			continue
+		}
+		result.Worker = name
+
+		encoded, err := json.Marshal(result)
+		if err != nil {
+			reportError(exitFailure, "error:", err)
+			exit()
+		}
+
+		_, err = conn.Do("RPUSH", results, string(encoded))
+		if err != nil {
+			reportError(exitFailure, "error reporting result:", err)
+			exit()
+		}
+	}
+}
+
+// jobsWaiting reports whether any of lists has jobs in it
+func jobsWaiting(conn *redisConn, lists []string) bool {
+
+	for _, list := range lists {
+		n, err := conn.Do("LLEN", list)
+		if count, ok := n.(int64); err == nil && ok && count > 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// indexOf returns the index of s in list, or the length of list if it
+// isn't there
+func indexOf(list []string, s string) int {
+
+	for i, item := range list {
+		if item == s {
+			return i
+		}
+	}
+
+	return len(list)
+}
+
+// runWorkerJob runs the job encoded in data with the dca executable at
+// self. If waiting is set, it is checked every workerPoll while the job
+// runs, and if it returns true, or stop is closed, the job is stopped and
+// nil returned so it can be run again later.
+func runWorkerJob(self string, data []byte, waiting func() bool, stop <-chan struct{}) *WorkerResult {
+
+	result := &WorkerResult{}
+
+	var job WorkerJob
+	err := json.Unmarshal(data, &job)
+	if err != nil {
+		result.Error = "invalid job: " + err.Error()
+		return result
+	}
+	result.ID = job.ID
+
+	if len(job.Args) > 0 && job.Args[0] == "worker" {
+		result.Error = "invalid job: workers can't be started by a job"
+		return result
+	}
+
+	args := job.Args
+	if job.Upload != "" {
+		err = checkUploadJob(&job)
+		if err != nil {
+			result.Error = "invalid job: " + err.Error()
+			return result
+		}
+
+		tmp, err := ioutil.TempFile("", "dca-job")
+		if err != nil {
+			result.Error = err.Error()
+			return result
+		}
+		tmp.Close()
+		defer os.Remove(tmp.Name())
+
+		args = append([]string{"-o", tmp.Name()}, args...)
+	}
+
+	start := time.Now()
+
+	output := newTailBuffer(workerOutput)
+
+	// jobs are in their own process group so an interrupt from the
+	// terminal drains the worker rather than stopping them
+	cmd := exec.Command(self, args...)
+	cmd.Stdout = output
+	cmd.Stderr = output
+	setProcessGroup(cmd)
+
+	err = cmd.Start()
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	ticker := time.NewTicker(workerPoll)
+	defer ticker.Stop()
+
+	// dca kills ffmpeg and the rest of its children when interrupted,
+	// where it can be
+	interrupt := func() {
+		if cmd.Process.Signal(os.Interrupt) != nil {
+			cmd.Process.Kill()
+		}
+		<-done
+	}
+
+wait:
+	for {
+		select {
+		case err = <-done:
+			break wait
+
+		case <-stop:
+			interrupt()
+			return nil
+
+		case <-ticker.C:
+			if waiting != nil && waiting() {
+				interrupt()
+				return nil
+			}
+		}
+	}
+
+	result.Duration = int(time.Since(start) / time.Millisecond)
+	result.Output = output.String()
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	if job.Upload != "" {
+		result.Uploaded, err = uploadFile(args[1], job.Upload)
+		if err != nil {
+			result.Error = "upload failed: " + err.Error()
+			return result
+		}
+	}
+
+	result.OK = true
+	return result
+}
+
+// checkUploadJob checks that the output of a job can be uploaded, which
+// needs it to be an encode that leaves the outfile to the worker
+func checkUploadJob(job *WorkerJob) error {
+
+	// anything else names a command, as encodes start with a flag
+	if len(job.Args) > 0 && !strings.HasPrefix(job.Args[0], "-") {
+		return fmt.Errorf("only encodes can upload their output")
+	}
+
+	for _, arg := range job.Args {
+		if arg == "-o" || arg == "--o" || strings.HasPrefix(arg, "-o=") || strings.HasPrefix(arg, "--o=") {
+			return fmt.Errorf("a job with an upload can't set -o")
+		}
+	}
+
+	return checkUploadURL(job.Upload)
+}